@@ -0,0 +1,168 @@
+package batch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Kind is the kind of an entry in Batch
+type Kind uint8
+
+const (
+	KindDelete Kind = 0
+	KindPut    Kind = 1
+	// KindRangeDelete deletes keys in [key, value)
+	KindRangeDelete Kind = 2
+)
+
+const sizeOfSeq = 8
+
+var ErrInvalidBatch = errors.New("invalid batch")
+
+// Batch collects Puts and Deletes which should be applied atomically.
+// Batch is encoded in this layout:
+// | seq(8B) | count(uvarint) | entry | entry | ... |
+// seq is the sequence number of the first entry, the following entries take seq+1, seq+2 ...
+// entry: | kind(1B) | keyLen(uvarint) | key | valueLen(uvarint) | value |, Delete has no valueLen and value,
+// DeleteRange stores start as key and end as value.
+// Batch is not safe for concurrent use.
+type Batch struct {
+	// entries are encoded entries without count
+	entries []byte
+	count   int
+	seq     uint64
+}
+
+func New() *Batch {
+	return &Batch{}
+}
+
+// Put adds a Put of key-value to Batch
+func (b *Batch) Put(key, value []byte) {
+	b.entries = append(b.entries, byte(KindPut))
+	b.entries = binary.AppendUvarint(b.entries, uint64(len(key)))
+	b.entries = append(b.entries, key...)
+	b.entries = binary.AppendUvarint(b.entries, uint64(len(value)))
+	b.entries = append(b.entries, value...)
+	b.count++
+}
+
+// Delete adds a Delete of key to Batch
+func (b *Batch) Delete(key []byte) {
+	b.entries = append(b.entries, byte(KindDelete))
+	b.entries = binary.AppendUvarint(b.entries, uint64(len(key)))
+	b.entries = append(b.entries, key...)
+	b.count++
+}
+
+// DeleteRange adds a deletion of keys in [start, end) to Batch
+func (b *Batch) DeleteRange(start, end []byte) {
+	b.entries = append(b.entries, byte(KindRangeDelete))
+	b.entries = binary.AppendUvarint(b.entries, uint64(len(start)))
+	b.entries = append(b.entries, start...)
+	b.entries = binary.AppendUvarint(b.entries, uint64(len(end)))
+	b.entries = append(b.entries, end...)
+	b.count++
+}
+
+// Count returns the number of entries in Batch
+func (b *Batch) Count() int {
+	return b.count
+}
+
+// Seq returns the sequence number of the first entry
+func (b *Batch) Seq() uint64 {
+	return b.seq
+}
+
+// SetSeq sets the sequence number of the first entry, it's assigned when Batch is written
+func (b *Batch) SetSeq(seq uint64) {
+	b.seq = seq
+}
+
+// Size returns the size of encoded Batch
+func (b *Batch) Size() int {
+	var buf [binary.MaxVarintLen64]byte
+	return sizeOfSeq + binary.PutUvarint(buf[:], uint64(b.count)) + len(b.entries)
+}
+
+// Reset clears Batch for reuse
+func (b *Batch) Reset() {
+	b.entries = b.entries[:0]
+	b.count = 0
+	b.seq = 0
+}
+
+// Encode returns encoded Batch, it can be decoded by Decode
+func (b *Batch) Encode() []byte {
+	buf := make([]byte, 0, b.Size())
+	buf = binary.BigEndian.AppendUint64(buf, b.seq)
+	buf = binary.AppendUvarint(buf, uint64(b.count))
+	return append(buf, b.entries...)
+}
+
+// Decode returns the Batch encoded in data, an error matching ErrInvalidBatch is returned if data is broken
+func Decode(data []byte) (*Batch, error) {
+	if len(data) < sizeOfSeq {
+		return nil, fmt.Errorf("%w: missing seq", ErrInvalidBatch)
+	}
+	seq := binary.BigEndian.Uint64(data)
+	data = data[sizeOfSeq:]
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: invalid count", ErrInvalidBatch)
+	}
+	b := &Batch{entries: append([]byte{}, data[n:]...), seq: seq}
+	err := b.Iterate(func(Kind, []byte, []byte) error {
+		b.count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if uint64(b.count) != count {
+		return nil, fmt.Errorf("%w: count %d mismatches %d entries", ErrInvalidBatch, count, b.count)
+	}
+	return b, nil
+}
+
+// Iterate calls fn on every entry in the order they were added, value of Delete is nil,
+// key and value of DeleteRange are start and end of the range.
+// The i-th entry(from 0) takes sequence number Seq()+i.
+// It stops at the first error returned by fn.
+func (b *Batch) Iterate(fn func(kind Kind, key, value []byte) error) error {
+	data := b.entries
+	for len(data) != 0 {
+		kind := Kind(data[0])
+		data = data[1:]
+		var key, value []byte
+		var ok bool
+		if key, data, ok = readBytes(data); !ok {
+			return fmt.Errorf("%w: invalid key", ErrInvalidBatch)
+		}
+		switch kind {
+		case KindPut, KindRangeDelete:
+			if value, data, ok = readBytes(data); !ok {
+				return fmt.Errorf("%w: invalid value", ErrInvalidBatch)
+			}
+		case KindDelete:
+		default:
+			return fmt.Errorf("%w: unknown kind %d", ErrInvalidBatch, kind)
+		}
+		if err := fn(kind, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBytes reads | len(uvarint) | bytes | from data
+func readBytes(data []byte) ([]byte, []byte, bool) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return nil, nil, false
+	}
+	data = data[n:]
+	return data[:length:length], data[length:], true
+}
@@ -0,0 +1,81 @@
+package batch_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/batch"
+	"mini-lsm/pkg/test"
+)
+
+type entry struct {
+	kind  batch.Kind
+	key   []byte
+	value []byte
+}
+
+func entriesOf(t *testing.T, b *batch.Batch) []entry {
+	var entries []entry
+	assert.Nil(t, b.Iterate(func(kind batch.Kind, key, value []byte) error {
+		entries = append(entries, entry{kind, key, value})
+		return nil
+	}))
+	return entries
+}
+
+func TestBatchEncodeDecode(t *testing.T) {
+	b := batch.New()
+	var expected []entry
+	for i := uint64(0); i < 100; i++ {
+		if i%3 == 0 {
+			b.Delete(test.KeyOf(i))
+			expected = append(expected, entry{batch.KindDelete, test.KeyOf(i), nil})
+		} else if i%10 == 1 {
+			b.DeleteRange(test.KeyOf(i), test.KeyOf(i+5))
+			expected = append(expected, entry{batch.KindRangeDelete, test.KeyOf(i), test.KeyOf(i + 5)})
+		} else {
+			b.Put(test.KeyOf(i), test.ValueOf(i))
+			expected = append(expected, entry{batch.KindPut, test.KeyOf(i), test.ValueOf(i)})
+		}
+	}
+	b.SetSeq(42)
+	assert.Equal(t, 100, b.Count())
+	assert.Equal(t, expected, entriesOf(t, b))
+
+	data := b.Encode()
+	assert.Len(t, data, b.Size())
+	decoded, err := batch.Decode(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, decoded.Count())
+	assert.Equal(t, uint64(42), decoded.Seq())
+	assert.Equal(t, expected, entriesOf(t, decoded))
+
+	b.Reset()
+	assert.Zero(t, b.Count())
+	assert.Zero(t, b.Seq())
+	assert.Empty(t, entriesOf(t, b))
+}
+
+func TestBatchDecodeInvalid(t *testing.T) {
+	b := batch.New()
+	b.Put(test.KeyOf(0), test.ValueOf(0))
+	b.Delete(test.KeyOf(1))
+	data := b.Encode()
+	// count is after seq(8B)
+	seq, entries := data[:8], data[9:]
+
+	_, err := batch.Decode(nil)
+	assert.ErrorIs(t, err, batch.ErrInvalidBatch)
+	_, err = batch.Decode(seq)
+	assert.ErrorIs(t, err, batch.ErrInvalidBatch)
+	// truncated entry
+	_, err = batch.Decode(data[:len(data)-1])
+	assert.ErrorIs(t, err, batch.ErrInvalidBatch)
+	// count mismatches entries
+	_, err = batch.Decode(append(append(seq, 3), entries...))
+	assert.ErrorIs(t, err, batch.ErrInvalidBatch)
+	// unknown kind
+	_, err = batch.Decode(append(append(seq, 1, 9), entries[1:]...))
+	assert.ErrorIs(t, err, batch.ErrInvalidBatch)
+}
@@ -1,9 +1,9 @@
 package block
 
 import (
-	"bytes"
 	"encoding/binary"
-	"io"
+	"errors"
+	"fmt"
 	"math"
 	"unsafe"
 
@@ -15,65 +15,128 @@ const (
 	SizeOfUint32 = uint16(unsafe.Sizeof(uint32(0)))
 )
 
-type Block struct {
-	data    []byte
-	offsets []uint16
-}
+var ErrInvalidBlock = errors.New("invalid block")
 
-func (b *Block) estimateBlockByteSize() uint16 {
-	return /* 1. offset */ SizeOfUint16 +
-		/* 2. offset items */ uint16(len(b.offsets))*SizeOfUint16 +
-		/* 3. data site */ SizeOfUint16 +
-		/* 4. data bytes */ uint16(len(b.data))
+// Format is the layout of entries in Block data
+type Format uint8
+
+const (
+	// FormatPlain stores every entry as | keyLen | key | valueLen | value |,
+	// offsets point to every entry.
+	FormatPlain Format = iota + 1
+	// FormatPrefix stores every entry as | sharedKeyLen | unsharedKeyLen | valueLen | unshared key | value |,
+	// key is delta encoded against the previous key except at restart points,
+	// offsets point to restart points.
+	FormatPrefix
+	// FormatVarint is FormatPrefix whose lengths in entries are uvarints,
+	// offsets and lengths of Block are uint32, so keys, values and blocks can be larger than 64KiB.
+	FormatVarint
+
+	// LatestFormat is the Format Builder builds
+	LatestFormat = FormatVarint
+)
+
+// sizeOfLength returns the size of offsets and lengths of Block in format
+func (f Format) sizeOfLength() int {
+	if f == FormatVarint {
+		return int(SizeOfUint32)
+	}
+	return int(SizeOfUint16)
 }
 
-// Encode Block to []byte
-func (b *Block) Encode() []byte {
-	bytesBuffer := utils.GlobalPool.Get(int(b.estimateBlockByteSize()))
-	idx := 0
-	offsetLen := len(b.offsets)
-	utils.Assertf(offsetLen < math.MaxUint16, "length of data %d should less than 1<<16 - 1", offsetLen)
+type Block struct {
+	data []byte
+	// offsets points to every restart point, every entry in FormatPlain is a restart point
+	offsets []uint32
+	format  Format
+}
 
-	var buf [SizeOfUint16]byte
-	binary.BigEndian.PutUint16(buf[:], uint16(offsetLen))
+// Size returns the size of Block in memory
+func (b *Block) Size() int {
+	return len(b.data) + len(b.offsets)*int(SizeOfUint32)
+}
 
-	idx += copy(bytesBuffer[idx:], buf[:])
+func (b *Block) estimateBlockByteSize() int {
+	return /* 1. offset */ int(SizeOfUint32) +
+		/* 2. offset items */ len(b.offsets)*int(SizeOfUint32) +
+		/* 3. data site */ int(SizeOfUint32) +
+		/* 4. data bytes */ len(b.data)
+}
 
+// Encode Block in LatestFormat to []byte
+// layout: | offsetLen | offset0(4 Byte) | offset1 ... | offsetN | dataLen | data(N Byte) |
+func (b *Block) Encode() []byte {
+	utils.Assertf(len(b.data) <= math.MaxUint32, "length of data %d should not be greater than 1<<32 - 1", len(b.data))
+	bytesBuffer := utils.GlobalPool.Get(b.estimateBlockByteSize())[:0]
+	bytesBuffer = binary.BigEndian.AppendUint32(bytesBuffer, uint32(len(b.offsets)))
 	for _, offset := range b.offsets {
-		binary.BigEndian.PutUint16(buf[:], offset)
-		idx += copy(bytesBuffer[idx:], buf[:])
+		bytesBuffer = binary.BigEndian.AppendUint32(bytesBuffer, offset)
 	}
+	bytesBuffer = binary.BigEndian.AppendUint32(bytesBuffer, uint32(len(b.data)))
+	bytesBuffer = append(bytesBuffer, b.data...)
 
-	dataLen := len(b.data)
-	utils.Assertf(dataLen < math.MaxUint16, "length of data %d should less than 1<<16 - 1", dataLen)
-
-	binary.BigEndian.PutUint16(buf[:], uint16(dataLen))
-	idx += copy(bytesBuffer[idx:], buf[:])
-	idx += copy(bytesBuffer[idx:], b.data)
-
-	utils.Assertf(uint16(idx) == b.estimateBlockByteSize(),
-		"block size should be %d but be %d", b.estimateBlockByteSize(), idx)
+	utils.Assertf(len(bytesBuffer) == b.estimateBlockByteSize(),
+		"block size should be %d but be %d", b.estimateBlockByteSize(), len(bytesBuffer))
 	return bytesBuffer
 }
 
-// Decode decode Block from []byte
+// Decode decode Block in LatestFormat from []byte
 // after return, the in []byte can be release or reuse, we should copy we need from in
-func (b *Block) Decode(in []byte) {
-	inReader := bytes.NewReader(in)
-	var buffer = make([]byte, SizeOfUint32)
-	offsetsLen, err := readUint16(inReader, buffer)
-	utils.Assertf(err == nil, "read offset length error: %s", err)
-
-	b.offsets = make([]uint16, offsetsLen)
-	for i := uint16(0); i < offsetsLen; i++ {
-		b.offsets[i], err = readUint16(inReader, buffer)
-		utils.Assertf(err == nil, "read offset error: %s", err)
+// ErrInvalidBlock is returned if in is not an encoded Block.
+func (b *Block) Decode(in []byte) error {
+	return b.DecodeWithFormat(in, LatestFormat)
+}
+
+// readLength reads an offset or a length of Block in format
+func readLength(in []byte, format Format) (uint32, []byte, bool) {
+	size := format.sizeOfLength()
+	if len(in) < size {
+		return 0, nil, false
+	}
+	if size == int(SizeOfUint32) {
+		return binary.BigEndian.Uint32(in), in[size:], true
+	}
+	return uint32(binary.BigEndian.Uint16(in)), in[size:], true
+}
+
+// DecodeWithFormat decode Block in format from []byte, it's used to read blocks written by older versions
+func (b *Block) DecodeWithFormat(in []byte, format Format) error {
+	if format != FormatPlain && format != FormatPrefix && format != FormatVarint {
+		return fmt.Errorf("%w: unknown format %d", ErrInvalidBlock, format)
+	}
+	offsetsLen, in, ok := readLength(in, format)
+	if !ok {
+		return fmt.Errorf("%w: read offset length error", ErrInvalidBlock)
+	}
+	if uint64(offsetsLen)*uint64(format.sizeOfLength()) > uint64(len(in)) {
+		return fmt.Errorf("%w: offset length %d out of block size %d", ErrInvalidBlock, offsetsLen, len(in))
 	}
 
-	dataLength, err := readUint16(inReader, buffer)
-	utils.Assertf(err == nil, "read data size error: %s", err)
+	offsets := make([]uint32, offsetsLen)
+	for i := range offsets {
+		offsets[i], in, _ = readLength(in, format)
+	}
 
-	b.data, err = io.ReadAll(inReader)
-	utils.Assertf(err == nil, "read data error error: %s", err)
-	utils.Assertf(dataLength == uint16(len(b.data)), "block size %d mismatch the recorded size %d", len(b.data), dataLength)
+	dataLength, in, ok := readLength(in, format)
+	if !ok {
+		return fmt.Errorf("%w: read data size error", ErrInvalidBlock)
+	}
+	if dataLength != uint32(len(in)) {
+		return fmt.Errorf("%w: block size %d mismatch the recorded size %d", ErrInvalidBlock, len(in), dataLength)
+	}
+	data := make([]byte, len(in))
+	copy(data, in)
+	for i, offset := range offsets {
+		if int(offset) >= len(data) {
+			return fmt.Errorf("%w: offset %d out of block size %d", ErrInvalidBlock, offset, len(data))
+		}
+		if i > 0 && offset <= offsets[i-1] {
+			return fmt.Errorf("%w: offset %d is not greater than the previous one %d", ErrInvalidBlock, offset, offsets[i-1])
+		}
+	}
+	if len(offsets) == 0 || offsets[0] != 0 {
+		return fmt.Errorf("%w: the first entry is not a restart point", ErrInvalidBlock)
+	}
+	b.offsets, b.data, b.format = offsets, data, format
+	return nil
 }
@@ -2,40 +2,64 @@ package block
 
 import (
 	"encoding/binary"
+	"math"
 
 	"mini-lsm/pkg/utils"
 )
 
+// DefaultRestartInterval is the number of entries between two restart points
+const DefaultRestartInterval = 16
+
 // Builder is used to build a block
 // implement an Add func for appending key value on Builder's data
-// Builder build Block in this layout following:
-// data:
-// keyLen | key | valueLen | value
+// Builder build Block in LatestFormat, layout of data:
+// sharedKeyLen(uvarint) | unsharedKeyLen(uvarint) | valueLen(uvarint) | unshared key | value
+// every restartInterval entries there is a restart point, whose sharedKeyLen is 0
+// keys should be added in ascending order of bytes.Compare, sst.TableBuilder adds internal keys(see mvcc),
+// which are ordered by bytes as well, so versions of a user key share their prefix.
 type Builder struct {
-	offsets []uint16
+	// offsets of restart points
+	offsets []uint32
+
+	data []byte
 
-	data       []byte
-	dataCursor int
+	blockSize uint32
 
-	blockSize uint16
+	restartInterval int
+	// count is the number of entries added
+	count int
+	// lastKey is the key of the previous entry
+	lastKey []byte
 }
 
 // NewBlockBuilder return a Builder for giving size
-func NewBlockBuilder(size uint16) *Builder {
+func NewBlockBuilder(size uint32) *Builder {
+	return NewBlockBuilderWithRestartInterval(size, DefaultRestartInterval)
+}
+
+// NewBlockBuilderWithRestartInterval return a Builder for giving size,
+// which places a restart point every restartInterval entries
+func NewBlockBuilderWithRestartInterval(size uint32, restartInterval int) *Builder {
+	utils.Assertf(restartInterval > 0, "restart interval %d should be positive", restartInterval)
 	return &Builder{
-		offsets:    make([]uint16, 0),
-		data:       utils.GlobalPool.Get(int(size)),
-		dataCursor: 0,
-		blockSize:  size,
+		offsets:         make([]uint32, 0),
+		data:            utils.GlobalPool.Get(int(size))[:0],
+		blockSize:       size,
+		restartInterval: restartInterval,
 	}
 }
 
 // currentSize is for estimateSize for Block
 // layout of Block is like this:
-// | offsetLen | offset0(2 Byte) | offset1 ... | offsetN | dataLen | data(N Byte)  |
+// | offsetLen | offset0(4 Byte) | offset1 ... | offsetN | dataLen | data(N Byte)  |
 // Builder can estimate size of a Block
-func (b *Builder) currentSize() uint16 {
-	return uint16(b.dataCursor)
+func (b *Builder) currentSize() int {
+	return int(SizeOfUint32)*(len(b.offsets)+2) + len(b.data)
+}
+
+// EstimatedSize returns the size of encoded Block, it may be greater than blockSize if there is only one entry
+func (b *Builder) EstimatedSize() int {
+	return b.currentSize()
 }
 
 func (b *Builder) IsEmpty() bool {
@@ -46,53 +70,60 @@ type stringOrByteSlice interface {
 	string | []byte
 }
 
-func estimateGrow[T stringOrByteSlice](key, value T) uint16 {
-	return uint16(len(key)) + uint16(len(value)) +
-		SizeOfUint16*2 + SizeOfUint16
+func uvarintLen(x int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(x))
 }
 
-// Add receives a pair of key value(string), return whether it was added to builder
-func (b *Builder) Add(key, value string) bool {
-	utils.Assert(key != "", "expect none empty key")
+// sharedPrefixLen returns the length of common prefix of key and lastKey
+func sharedPrefixLen[T stringOrByteSlice](key T, lastKey []byte) int {
+	n := 0
+	for n < len(key) && n < len(lastKey) && key[n] == lastKey[n] {
+		n++
+	}
+	return n
+}
 
-	if b.currentSize()+estimateGrow(key, value) > b.blockSize &&
-		!b.IsEmpty() {
+func add[T stringOrByteSlice](b *Builder, key, value T) bool {
+	restart := b.count%b.restartInterval == 0
+	shared := 0
+	grow := 0
+	if restart {
+		grow += int(SizeOfUint32)
+	} else {
+		shared = sharedPrefixLen(key, b.lastKey)
+	}
+	grow += uvarintLen(shared) + uvarintLen(len(key)-shared) + uvarintLen(len(value)) + len(key) - shared + len(value)
+	// the first entry is always added, so a key-value pair larger than blockSize gets a Block
+	if b.currentSize()+grow > int(b.blockSize) && !b.IsEmpty() {
 		return false
 	}
-	b.offsets = append(b.offsets, b.currentSize())
-
-	binary.BigEndian.PutUint16(b.data[b.dataCursor:b.dataCursor+int(SizeOfUint16)], uint16(len(key)))
-	b.dataCursor += int(SizeOfUint16)
-
-	b.dataCursor += copy(b.data[b.dataCursor:], key)
+	utils.Assertf(uint64(b.currentSize())+uint64(grow) <= math.MaxUint32, "block size should not be greater than 1<<32 - 1")
+	if restart {
+		b.offsets = append(b.offsets, uint32(len(b.data)))
+	}
 
-	binary.BigEndian.PutUint16(b.data[b.dataCursor:b.dataCursor+int(SizeOfUint16)], uint16(len(value)))
-	b.dataCursor += int(SizeOfUint16)
+	b.data = binary.AppendUvarint(b.data, uint64(shared))
+	b.data = binary.AppendUvarint(b.data, uint64(len(key)-shared))
+	b.data = binary.AppendUvarint(b.data, uint64(len(value)))
+	b.data = append(b.data, key[shared:]...)
+	b.data = append(b.data, value...)
 
-	b.dataCursor += copy(b.data[b.dataCursor:], value)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.count++
 	return true
 }
 
+// Add receives a pair of key value(string), return whether it was added to builder
+func (b *Builder) Add(key, value string) bool {
+	utils.Assert(key != "", "expect none empty key")
+	return add(b, key, value)
+}
+
 // AddByte receives a pair of key value([]byte), return whether it was added to builder
 func (b *Builder) AddByte(key, value []byte) bool {
 	utils.Assert(len(key) != 0, "expect none empty key")
-
-	if b.currentSize()+estimateGrow(key, value) > b.blockSize &&
-		!b.IsEmpty() {
-		return false
-	}
-	b.offsets = append(b.offsets, uint16(b.dataCursor))
-
-	binary.BigEndian.PutUint16(b.data[b.dataCursor:b.dataCursor+int(SizeOfUint16)], uint16(len(key)))
-	b.dataCursor += int(SizeOfUint16)
-
-	b.dataCursor += copy(b.data[b.dataCursor:], key)
-
-	binary.BigEndian.PutUint16(b.data[b.dataCursor:b.dataCursor+int(SizeOfUint16)], uint16(len(value)))
-	b.dataCursor += int(SizeOfUint16)
-
-	b.dataCursor += copy(b.data[b.dataCursor:], value)
-	return true
+	return add(b, key, value)
 }
 
 // Build return the Block which Builder built
@@ -101,7 +132,8 @@ func (b *Builder) Build() *Block {
 		"expect builder is not empty")
 
 	return &Block{
-		data:    b.data[:b.dataCursor],
+		data:    b.data,
 		offsets: b.offsets,
+		format:  LatestFormat,
 	}
 }
@@ -3,26 +3,33 @@ package block
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"sort"
 
-	"mini-lsm/pkg/utils"
+	"mini-lsm/pkg/iterator"
 )
 
 // Iter can hold an Block, for iterating it one-by-one.
-// keys in Iter should be sorted
+// keys in Iter should be sorted.
+// Iter becomes invalid if an entry of the block is broken, Err returns the error.
 type Iter struct {
 	block *Block
 	key   []byte
 	value []byte
-	idx   uint64
+	// offset is the offset of the current entry in block data, nextOffset is the offset of the next entry
+	offset     int
+	nextOffset int
+	err        error
 }
 
+var _ iterator.Iter = (*Iter)(nil)
+
 // NewBlockIter receives a block and return Iter for it.
 func NewBlockIter(block *Block) *Iter {
 	return &Iter{
 		block: block,
 		key:   make([]byte, 0),
 		value: make([]byte, 0),
-		idx:   0,
 	}
 }
 
@@ -36,13 +43,21 @@ func NewBlockIterAndSeekToFirst(block *Block) *Iter {
 // NewBlockIterAndSeekToKey receives a block, create a Iter, seek to specified key, return it.
 func NewBlockIterAndSeekToKey(block *Block, key []byte) *Iter {
 	i := NewBlockIter(block)
-	i.SeekToKey(key)
+	i.Seek(key)
 	return i
 }
 
 // IsValid checks that whether Iter valid
 func (b *Iter) IsValid() bool {
-	return b != nil && b.block != nil && len(b.key) != 0
+	return b != nil && b.block != nil && b.err == nil && len(b.key) != 0
+}
+
+// Err returns the error of decoding entries
+func (b *Iter) Err() error {
+	if b == nil {
+		return nil
+	}
+	return b.err
 }
 
 // SeekToFirst help Iter to seek to first key
@@ -50,9 +65,23 @@ func (b *Iter) SeekToFirst() {
 	b.SeekTo(0)
 }
 
-// Key get key for current pos
+// SeekToLast seeks to the last key, entries are decoded from the last restart point
+func (b *Iter) SeekToLast() {
+	if b.block == nil {
+		return
+	}
+	if len(b.block.offsets) == 0 {
+		b.seekToRestart(0)
+		return
+	}
+	b.seekToRestart(uint64(len(b.block.offsets) - 1))
+	for b.IsValid() && b.nextOffset < len(b.block.data) {
+		b.Next()
+	}
+}
+
+// Key get key for current pos, it's nil if Iter is invalid
 func (b *Iter) Key() []byte {
-	utils.Assert(len(b.key) != 0, "invalid iterator, you should call IsValid to check iter valid")
 	// WARNING: we assumed that return key will not be modified
 	// key := make([]byte, len(b.key))
 	// copy(key, b.key)
@@ -60,9 +89,8 @@ func (b *Iter) Key() []byte {
 	return b.key
 }
 
-// Value get value for current pos
+// Value get value for current pos, it's nil if Iter is invalid
 func (b *Iter) Value() []byte {
-	utils.Assert(len(b.key) != 0, "invalid iterator, you should call IsValid to check iter valid")
 	// WARNING: we assumed that return value will not be modified
 	// value := make([]byte, len(b.value))
 	// copy(value, b.value)
@@ -75,38 +103,70 @@ func (b *Iter) SeekTo(idx uint64) {
 	if b.block == nil {
 		return
 	}
-	if idx >= uint64(len(b.block.offsets)) {
-		b.key = nil
-		b.value = nil
+	if b.block.format == FormatPlain {
+		b.seekToRestart(idx)
 		return
 	}
-	offset := uint64(b.block.offsets[idx])
-	b.seekToOffset(offset)
-	b.idx = idx
+	// keys are delta encoded, so entries are decoded from the first restart point
+	b.seekToRestart(0)
+	for ; idx > 0 && b.IsValid(); idx-- {
+		b.Next()
+	}
 }
 
 // Next make iter turn to next key-value pair
 func (b *Iter) Next() {
-	if b.block == nil {
+	if !b.IsValid() {
 		return
 	}
-	b.idx++
-	b.SeekTo(b.idx)
+	if b.nextOffset >= len(b.block.data) {
+		b.key = nil
+		b.value = nil
+		return
+	}
+	b.decodeEntry(b.nextOffset)
 }
 
-// SeekToKey make iter to find key in dichotomy.
-func (b *Iter) SeekToKey(key []byte) {
+// Prev make iter turn to previous key-value pair,
+// entries are decoded from the last restart point before the current entry.
+func (b *Iter) Prev() {
+	if !b.IsValid() {
+		return
+	}
+	offset := b.offset
+	idx := sort.Search(len(b.block.offsets), func(i int) bool {
+		return int(b.block.offsets[i]) >= offset
+	}) - 1
+	if idx < 0 {
+		b.key = nil
+		b.value = nil
+		return
+	}
+	b.seekToRestart(uint64(idx))
+	for b.IsValid() && b.nextOffset < offset {
+		b.Next()
+	}
+}
+
+// Seek make iter to find key in dichotomy.
+// It searches the last restart point whose key is less than key, then scans entries after it.
+func (b *Iter) Seek(key []byte) {
 	if b.block == nil {
 		return
 	}
+	b.err = nil
 	low := 0
 	high := len(b.block.offsets)
 
 	for low < high {
 		mid := low + (high-low)/2
-		b.SeekTo(uint64(mid))
-
-		utils.Assert(b.IsValid(), "encountered invalid block")
+		b.seekToRestart(uint64(mid))
+		if !b.IsValid() {
+			if b.err == nil {
+				b.setErr(fmt.Errorf("restart point %d has no entry", mid))
+			}
+			return
+		}
 
 		switch bytes.Compare(b.key, key) {
 		case 0:
@@ -118,20 +178,108 @@ func (b *Iter) SeekToKey(key []byte) {
 		}
 	}
 
-	b.SeekTo(uint64(low))
+	if low == 0 {
+		b.seekToRestart(0)
+		return
+	}
+	b.seekToRestart(uint64(low - 1))
+	for b.IsValid() && bytes.Compare(b.key, key) < 0 {
+		b.Next()
+	}
 }
 
-func (b *Iter) seekToOffset(offset uint64) {
-	utils.Assertf(offset < uint64(len(b.block.data)),
-		"offset should be less than block data, offset: %d, len(b.block.data): %d", offset, len(b.block.data))
-	entry := b.block.data[offset:]
+// SeekForPrev seeks to the last key which is less than or equal to key
+func (b *Iter) SeekForPrev(key []byte) {
+	b.Seek(key)
+	if b.IsValid() {
+		if bytes.Compare(b.key, key) > 0 {
+			b.Prev()
+		}
+		return
+	}
+	if b.err == nil {
+		b.SeekToLast()
+	}
+}
 
-	keyLen := binary.BigEndian.Uint16(entry[:2])
-	entry = entry[2:]
-	b.key = append(b.key[:0], entry[:keyLen]...)
-	entry = entry[keyLen:]
+// seekToRestart seeks to the restart point on idx
+func (b *Iter) seekToRestart(idx uint64) {
+	b.err = nil
+	if idx >= uint64(len(b.block.offsets)) {
+		b.key = nil
+		b.value = nil
+		return
+	}
+	b.key = b.key[:0]
+	b.decodeEntry(int(b.block.offsets[idx]))
+}
+
+// setErr makes Iter invalid
+func (b *Iter) setErr(err error) {
+	b.err = fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	b.key = nil
+	b.value = nil
+}
+
+// decodeEntry decodes the entry on offset, key of the previous entry should be in b.key
+func (b *Iter) decodeEntry(offset int) {
+	if offset >= len(b.block.data) {
+		b.setErr(fmt.Errorf("offset %d out of block data %d", offset, len(b.block.data)))
+		return
+	}
+	entry := b.block.data[offset:]
 
-	valueLen := binary.BigEndian.Uint16(entry[:2])
-	entry = entry[2:]
+	var sharedKeyLen, keyLen, valueLen uint64
+	switch b.block.format {
+	case FormatPlain:
+		if len(entry) < 2 {
+			b.setErr(fmt.Errorf("truncated entry on offset %d", offset))
+			return
+		}
+		keyLen = uint64(binary.BigEndian.Uint16(entry))
+		if uint64(len(entry)) < 2+keyLen+2 {
+			b.setErr(fmt.Errorf("truncated entry on offset %d", offset))
+			return
+		}
+		valueLen = uint64(binary.BigEndian.Uint16(entry[2+keyLen:]))
+		b.key = append(b.key[:0], entry[2:2+keyLen]...)
+		entry = entry[2+keyLen+2:]
+	case FormatPrefix:
+		if len(entry) < 6 {
+			b.setErr(fmt.Errorf("truncated entry on offset %d", offset))
+			return
+		}
+		sharedKeyLen = uint64(binary.BigEndian.Uint16(entry))
+		keyLen = uint64(binary.BigEndian.Uint16(entry[2:]))
+		valueLen = uint64(binary.BigEndian.Uint16(entry[4:]))
+		entry = entry[6:]
+	default:
+		var n int
+		for _, length := range []*uint64{&sharedKeyLen, &keyLen, &valueLen} {
+			if *length, n = binary.Uvarint(entry); n <= 0 {
+				b.setErr(fmt.Errorf("invalid length of entry on offset %d", offset))
+				return
+			}
+			entry = entry[n:]
+		}
+	}
+	if b.block.format != FormatPlain {
+		if sharedKeyLen > uint64(len(b.key)) {
+			b.setErr(fmt.Errorf("shared key length %d out of the previous key %d", sharedKeyLen, len(b.key)))
+			return
+		}
+		if keyLen > uint64(len(entry)) {
+			b.setErr(fmt.Errorf("key length %d out of entry on offset %d", keyLen, offset))
+			return
+		}
+		b.key = append(b.key[:sharedKeyLen], entry[:keyLen]...)
+		entry = entry[keyLen:]
+	}
+	if valueLen > uint64(len(entry)) {
+		b.setErr(fmt.Errorf("value length %d out of entry on offset %d", valueLen, offset))
+		return
+	}
 	b.value = append(b.value[:0], entry[:valueLen]...)
+	b.offset = offset
+	b.nextOffset = len(b.block.data) - len(entry) + int(valueLen)
 }
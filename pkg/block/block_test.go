@@ -1,6 +1,9 @@
 package block_test
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,7 +28,7 @@ func generateBlockMeta() []*block.Meta {
 	var res []*block.Meta
 	for i := uint64(0); i < 100; i++ {
 		key := test.KeyOf(i)
-		res = append(res, &block.Meta{Offset: uint32(i), FirstKey: key})
+		res = append(res, &block.Meta{Offset: uint32(i), FirstKey: key, LastKey: test.ValueOf(i)})
 	}
 	return res
 }
@@ -56,9 +59,17 @@ func TestBlockBuilderMisc(t *testing.T) {
 		b := generateBlock(t)
 		be := b.Encode()
 		db := &block.Block{}
-		db.Decode(be)
+		assert.Nil(t, db.Decode(be))
 		assert.Equal(t, *b, *db)
 	})
+
+	t.Run("test-block-decode-truncated", func(t *testing.T) {
+		be := generateBlock(t).Encode()
+		for _, n := range []int{0, 1, len(be) / 2, len(be) - 1} {
+			db := &block.Block{}
+			assert.ErrorIs(t, db.Decode(be[:n]), block.ErrInvalidBlock)
+		}
+	})
 }
 func TestBlockIter(t *testing.T) {
 	b := generateBlock(t)
@@ -82,11 +93,197 @@ func TestBlockIter(t *testing.T) {
 
 	key50 := test.KeyOf(50)
 	value50 := test.ValueOf(50)
-	iter.SeekToKey(key50)
+	iter.Seek(key50)
 	assert.Equal(t, key50, iter.Key())
 	assert.Equal(t, value50, iter.Value())
 }
 
+func TestBlockRestartInterval(t *testing.T) {
+	lastSize := 0
+	for _, interval := range []int{1, 3, block.DefaultRestartInterval} {
+		bb := block.NewBlockBuilderWithRestartInterval(8192, interval)
+		// only even keys are added, odd keys don't exist
+		for i := uint64(0); i < 200; i += 2 {
+			assert.True(t, bb.AddByte(test.KeyOf(i), test.ValueOf(i)))
+		}
+		encoded := bb.Build().Encode()
+		if lastSize != 0 {
+			// keys share longer prefixes with less restart points
+			assert.Less(t, len(encoded), lastSize)
+		}
+		lastSize = len(encoded)
+		db := &block.Block{}
+		assert.Nil(t, db.Decode(encoded))
+
+		iter := block.NewBlockIterAndSeekToFirst(db)
+		for i := uint64(0); i < 200; i += 2 {
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			assert.Equal(t, test.ValueOf(i), iter.Value())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+
+		for i := uint64(0); i < 199; i++ {
+			iter.Seek(test.KeyOf(i))
+			next := (i + 1) / 2 * 2
+			assert.Equalf(t, test.KeyOf(next), iter.Key(), "restart interval %d", interval)
+			assert.Equalf(t, test.ValueOf(next), iter.Value(), "restart interval %d", interval)
+		}
+		iter.Seek(test.KeyOf(199))
+		assert.False(t, iter.IsValid())
+		iter.SeekTo(10)
+		assert.Equal(t, test.KeyOf(20), iter.Key())
+
+		// backward
+		iter.SeekToLast()
+		for i := uint64(198); i < 200; i -= 2 {
+			assert.Equalf(t, test.KeyOf(i), iter.Key(), "restart interval %d", interval)
+			assert.Equalf(t, test.ValueOf(i), iter.Value(), "restart interval %d", interval)
+			iter.Prev()
+		}
+		assert.False(t, iter.IsValid())
+		assert.Nil(t, iter.Err())
+		for i := uint64(0); i < 200; i++ {
+			iter.SeekForPrev(test.KeyOf(i))
+			prev := i / 2 * 2
+			assert.Equalf(t, test.KeyOf(prev), iter.Key(), "restart interval %d", interval)
+		}
+		iter.SeekForPrev([]byte("a"))
+		assert.False(t, iter.IsValid())
+		iter.SeekForPrev([]byte("z"))
+		assert.Equal(t, test.KeyOf(198), iter.Key())
+	}
+}
+
+func TestBlockLegacyFormat(t *testing.T) {
+	// | offsetLen | offsets | dataLen | data |, all of them are uint16
+	encode := func(format block.Format) []byte {
+		var data, offsets []byte
+		for i := uint64(0); i < 10; i++ {
+			offsets = binary.BigEndian.AppendUint16(offsets, uint16(len(data)))
+			if format == block.FormatPrefix {
+				// every entry is a restart point: | sharedKeyLen | unsharedKeyLen | valueLen | key | value |
+				data = binary.BigEndian.AppendUint16(data, 0)
+				data = binary.BigEndian.AppendUint16(data, uint16(len(test.KeyOf(i))))
+				data = binary.BigEndian.AppendUint16(data, uint16(len(test.ValueOf(i))))
+				data = append(data, test.KeyOf(i)...)
+				data = append(data, test.ValueOf(i)...)
+				continue
+			}
+			// | keyLen | key | valueLen | value |
+			data = binary.BigEndian.AppendUint16(data, uint16(len(test.KeyOf(i))))
+			data = append(data, test.KeyOf(i)...)
+			data = binary.BigEndian.AppendUint16(data, uint16(len(test.ValueOf(i))))
+			data = append(data, test.ValueOf(i)...)
+		}
+		encoded := binary.BigEndian.AppendUint16(nil, 10)
+		encoded = append(encoded, offsets...)
+		encoded = binary.BigEndian.AppendUint16(encoded, uint16(len(data)))
+		return append(encoded, data...)
+	}
+
+	for _, format := range []block.Format{block.FormatPlain, block.FormatPrefix} {
+		db := &block.Block{}
+		assert.Nil(t, db.DecodeWithFormat(encode(format), format))
+		iter := block.NewBlockIterAndSeekToFirst(db)
+		for i := uint64(0); i < 10; i++ {
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			assert.Equal(t, test.ValueOf(i), iter.Value())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+		iter.Seek(test.KeyOf(5))
+		assert.Equal(t, test.ValueOf(5), iter.Value())
+		iter.Prev()
+		assert.Equal(t, test.ValueOf(4), iter.Value())
+		iter.SeekToLast()
+		assert.Equal(t, test.ValueOf(9), iter.Value())
+	}
+}
+
+func TestBlockIterCorruptedEntry(t *testing.T) {
+	// one entry whose valueLen is larger than the rest of block data
+	data := binary.BigEndian.AppendUint16(nil, 1)
+	data = append(data, 'a')
+	data = binary.BigEndian.AppendUint16(data, 100)
+	data = append(data, 'x')
+	encoded := binary.BigEndian.AppendUint16(nil, 1)
+	encoded = binary.BigEndian.AppendUint16(encoded, 0)
+	encoded = binary.BigEndian.AppendUint16(encoded, uint16(len(data)))
+	encoded = append(encoded, data...)
+
+	db := &block.Block{}
+	assert.Nil(t, db.DecodeWithFormat(encoded, block.FormatPlain))
+	iter := block.NewBlockIterAndSeekToFirst(db)
+	assert.False(t, iter.IsValid())
+	assert.ErrorIs(t, iter.Err(), block.ErrInvalidBlock)
+	assert.Nil(t, iter.Key())
+	iter.Seek([]byte("a"))
+	assert.False(t, iter.IsValid())
+	assert.ErrorIs(t, iter.Err(), block.ErrInvalidBlock)
+}
+
+func TestBlockLargeEntry(t *testing.T) {
+	bb := block.NewBlockBuilder(4096)
+	key := bytes.Repeat([]byte("k"), 70000)
+	value := bytes.Repeat([]byte("v"), 200000)
+	assert.True(t, bb.AddByte(key, value))
+	assert.False(t, bb.AddByte(test.KeyOf(0), test.ValueOf(0)))
+	assert.Greater(t, bb.EstimatedSize(), 270000)
+
+	db := &block.Block{}
+	assert.Nil(t, db.Decode(bb.Build().Encode()))
+	iter := block.NewBlockIterAndSeekToFirst(db)
+	assert.Equal(t, key, iter.Key())
+	assert.Equal(t, value, iter.Value())
+	iter.Next()
+	assert.False(t, iter.IsValid())
+}
+
+func TestBlockMetaLargeKey(t *testing.T) {
+	bms := []*block.Meta{{Offset: 1 << 20, FirstKey: bytes.Repeat([]byte("f"), 70000), LastKey: bytes.Repeat([]byte("l"), 300)}}
+	bmsN, err := block.DecodeBlockMeta(block.EncodedBlockMeta(bms))
+	assert.Nil(t, err)
+	assert.Equal(t, bms, bmsN)
+}
+
+type reverseCompressor struct{}
+
+func (reverseCompressor) Type() block.CompressionType {
+	return 100
+}
+
+func (reverseCompressor) Compress(dst, src []byte) ([]byte, error) {
+	for i := len(src) - 1; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return dst, nil
+}
+
+func (c reverseCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return c.Compress(dst, src)
+}
+
+func TestBlockCompression(t *testing.T) {
+	encoded := generateBlock(t).Encode()
+	for _, c := range []block.Compressor{block.NewNoneCompressor(), block.NewFlateCompressor(flate.BestSpeed), reverseCompressor{}} {
+		block.RegisterCompressor(c)
+		// compress twice to reuse pooled writers and readers
+		for i := 0; i < 2; i++ {
+			compressed, err := c.Compress([]byte("prefix"), encoded)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("prefix"), compressed[:6])
+			decompressed, err := block.Decompress(c.Type(), nil, compressed[6:])
+			assert.Nil(t, err)
+			assert.Equal(t, encoded, decompressed)
+		}
+	}
+	_, err := block.Decompress(101, nil, encoded)
+	assert.ErrorIs(t, err, block.ErrUnknownCompression)
+	_, err = block.Decompress(block.CompressionFlate, nil, encoded)
+	assert.NotNil(t, err)
+}
+
 func TestBlockMeta(t *testing.T) {
 	t.Run("test-block-meta-encode-and-decode", func(t *testing.T) {
 		bms := generateBlockMeta()
@@ -105,7 +302,7 @@ func newKeyValuePair(keyCount uint64) []struct{ key, value []byte } {
 	return out
 }
 
-func newBlock(blockSize uint16, keyCount uint64) *block.Block {
+func newBlock(blockSize uint32, keyCount uint64) *block.Block {
 	bb := block.NewBlockBuilder(blockSize)
 	pairs := newKeyValuePair(keyCount)
 	for i := range pairs {
@@ -114,7 +311,7 @@ func newBlock(blockSize uint16, keyCount uint64) *block.Block {
 	return bb.Build()
 }
 
-func newBlockIter(blockSize uint16, keyCount uint64) *block.Iter {
+func newBlockIter(blockSize uint32, keyCount uint64) *block.Iter {
 	return block.NewBlockIter(newBlock(blockSize, keyCount))
 }
 
@@ -165,7 +362,7 @@ func BenchmarkBlockIter(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			idx := uint64(i) % count
 			key := test.KeyOf(idx)
-			iter.SeekToKey(key)
+			iter.Seek(key)
 		}
 	})
 
@@ -173,7 +370,7 @@ func BenchmarkBlockIter(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			idx := uint64(i)%count + count
 			keyNotExists := test.KeyOf(idx)
-			iter.SeekToKey(keyNotExists)
+			iter.Seek(keyNotExists)
 		}
 	})
 }
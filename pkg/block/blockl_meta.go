@@ -1,117 +1,90 @@
 package block
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
-	"io"
-
-	"mini-lsm/pkg/utils"
 )
 
 var ErrInvalidBlockMeta = errors.New("invalid block meta")
 
-// Meta is metadata of Block, contains the offset and first key of data
+// Meta is metadata of Block, contains the offset, first key and last key of data
 type Meta struct {
 	// Offset in data
 	Offset uint32
 	// FirstKey of this block
 	FirstKey []byte
+	// LastKey of this block
+	LastKey []byte
 }
 
-// EncodedBlockMeta help append all metaData to bytes buffer
+// EncodedBlockMeta help append all metaData to bytes buffer, metas are encoded for LatestFormat:
+// | offset(4 Byte) | firstKeyLen(uvarint) | firstKey | lastKeyLen(uvarint) | lastKey |
 func EncodedBlockMeta(metaList []*Meta) []byte {
-	estimateMetadataSize := uint16(0)
+	estimateMetadataSize := 0
 	for _, meta := range metaList {
-		estimateMetadataSize += SizeOfUint32
-		estimateMetadataSize += SizeOfUint16
-		estimateMetadataSize += uint16(len(meta.FirstKey))
+		estimateMetadataSize += int(SizeOfUint32)
+		estimateMetadataSize += uvarintLen(len(meta.FirstKey)) + len(meta.FirstKey)
+		estimateMetadataSize += uvarintLen(len(meta.LastKey)) + len(meta.LastKey)
 	}
 
-	var buffer bytes.Buffer
-	var buf [SizeOfUint32]byte
+	buffer := make([]byte, 0, estimateMetadataSize)
 	for _, meta := range metaList {
-		binary.BigEndian.PutUint32(buf[:SizeOfUint32], meta.Offset)
-		buffer.Write(buf[:SizeOfUint32]) // offset in metadata
-
-		binary.BigEndian.PutUint16(buf[:SizeOfUint16], uint16(len(meta.FirstKey)))
-		buffer.Write(buf[:SizeOfUint16]) // first key of len
-		buffer.Write(meta.FirstKey)      // first key
+		buffer = binary.BigEndian.AppendUint32(buffer, meta.Offset) // offset in metadata
+		buffer = binary.AppendUvarint(buffer, uint64(len(meta.FirstKey)))
+		buffer = append(buffer, meta.FirstKey...)
+		buffer = binary.AppendUvarint(buffer, uint64(len(meta.LastKey)))
+		buffer = append(buffer, meta.LastKey...)
 	}
-	utils.Assertf(estimateMetadataSize == uint16(buffer.Len()),
-		"buf size error after encoding, estimateMetadataSize: %d should be equal to buffer.Len(): %d", estimateMetadataSize, buffer.Len())
-
-	return buffer.Bytes()
+	return buffer
 }
 
-// DecodeBlockMeta read []*Meta from byte slice
+// DecodeBlockMeta read []*Meta of LatestFormat from byte slice
 func DecodeBlockMeta(input []byte) ([]*Meta, error) {
-	return DecodeBlockMetaFromReader(bytes.NewReader(input))
+	return DecodeBlockMetaWithFormat(input, LatestFormat)
 }
 
-func readUint32(r io.Reader, buffer []byte) (uint32, error) {
-	if buffer == nil {
-		buffer = make([]byte, SizeOfUint32)
-	}
-	n, err := r.Read(buffer[:SizeOfUint32])
-	if err != nil {
-		if err == io.EOF {
-			return 0, io.EOF
+// DecodeBlockMetaWithFormat read []*Meta of blocks in format from byte slice,
+// key lengths are uint16 before FormatVarint.
+func DecodeBlockMetaWithFormat(input []byte, format Format) ([]*Meta, error) {
+	var metas = make([]*Meta, 0)
+	for len(input) != 0 {
+		if len(input) < int(SizeOfUint32) {
+			return nil, ErrInvalidBlockMeta
 		}
-		return 0, ErrInvalidBlockMeta
-	}
-	if uint16(n) != SizeOfUint32 {
-		return 0, ErrInvalidBlockMeta
-	}
-	return binary.BigEndian.Uint32(buffer[:SizeOfUint32]), nil
-}
-
-func readUint16(r io.Reader, buffer []byte) (uint16, error) {
-	if buffer == nil {
-		buffer = make([]byte, SizeOfUint16)
-	}
-	n, err := r.Read(buffer[:SizeOfUint16])
-	if err != nil {
-		if err == io.EOF {
-			return 0, io.EOF
+		meta := &Meta{Offset: binary.BigEndian.Uint32(input)}
+		input = input[SizeOfUint32:]
+		var ok bool
+		if meta.FirstKey, input, ok = readKey(input, format); !ok {
+			return nil, ErrInvalidBlockMeta
 		}
-		return 0, ErrInvalidBlockMeta
-	}
-	if uint16(n) != SizeOfUint16 {
-		return 0, ErrInvalidBlockMeta
-	}
-	return binary.BigEndian.Uint16(buffer[:SizeOfUint16]), nil
-}
-
-// DecodeBlockMetaFromReader reads []*Meta from reader
-func DecodeBlockMetaFromReader(r io.Reader) ([]*Meta, error) {
-	var metas = make([]*Meta, 0)
-	buffer := make([]byte, SizeOfUint32)
-	for {
-		meta, err := decodeBlock(r, buffer)
-		if err == io.EOF {
-			return metas, nil
+		if meta.LastKey, input, ok = readKey(input, format); !ok {
+			return nil, ErrInvalidBlockMeta
 		}
 		metas = append(metas, meta)
 	}
+	return metas, nil
 }
 
-func decodeBlock(r io.Reader, buffer []byte) (*Meta, error) {
-	offset, err := readUint32(r, buffer)
-	if err != nil {
-		return nil, err
-	}
-	firstKeyLen, err := readUint16(r, buffer)
-	if err != nil {
-		return nil, err
-	}
-	key := make([]byte, firstKeyLen)
-	n, err := r.Read(key)
-	if err != nil {
-		return nil, err
+// readKey reads | keyLen | key | from input
+func readKey(input []byte, format Format) ([]byte, []byte, bool) {
+	var keyLen uint64
+	if format == FormatVarint {
+		var n int
+		if keyLen, n = binary.Uvarint(input); n <= 0 {
+			return nil, nil, false
+		}
+		input = input[n:]
+	} else {
+		if len(input) < int(SizeOfUint16) {
+			return nil, nil, false
+		}
+		keyLen = uint64(binary.BigEndian.Uint16(input))
+		input = input[SizeOfUint16:]
 	}
-	if n != int(firstKeyLen) {
-		return nil, ErrInvalidBlockMeta
+	if keyLen > uint64(len(input)) {
+		return nil, nil, false
 	}
-	return &Meta{Offset: offset, FirstKey: key}, nil
+	key := make([]byte, keyLen)
+	copy(key, input)
+	return key, input[keyLen:], true
 }
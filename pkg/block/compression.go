@@ -0,0 +1,129 @@
+package block
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CompressionType is written after every compressed block in sst, it picks the Compressor to decompress the block
+type CompressionType uint8
+
+const (
+	CompressionNone  CompressionType = 0
+	CompressionFlate CompressionType = 1
+)
+
+var ErrUnknownCompression = errors.New("unknown compression type")
+
+// Compressor compresses encoded blocks, a Compressor should be registered by RegisterCompressor
+// so that blocks compressed by it can be decompressed.
+type Compressor interface {
+	// Type is written with the compressed block, it should be unique among Compressors
+	Type() CompressionType
+	// Compress appends compressed src to dst
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends decompressed src to dst
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[CompressionType]Compressor{
+		CompressionNone:  noneCompressor{},
+		CompressionFlate: NewFlateCompressor(flate.DefaultCompression),
+	}
+)
+
+// RegisterCompressor makes blocks compressed by c readable, it replaces the Compressor of the same type
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Type()] = c
+}
+
+// Decompress appends src decompressed by the Compressor of typ to dst
+func Decompress(typ CompressionType, dst, src []byte) ([]byte, error) {
+	compressorsMu.RLock()
+	c, ok := compressors[typ]
+	compressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCompression, typ)
+	}
+	return c.Decompress(dst, src)
+}
+
+type noneCompressor struct{}
+
+// NewNoneCompressor returns a Compressor which keeps blocks as they are
+func NewNoneCompressor() Compressor {
+	return noneCompressor{}
+}
+
+func (noneCompressor) Type() CompressionType {
+	return CompressionNone
+}
+
+func (noneCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// flateCompressor compresses blocks by DEFLATE, writers and readers are pooled
+type flateCompressor struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewFlateCompressor returns a DEFLATE Compressor of level, see compress/flate for levels.
+// Level only affects compression, so blocks of any level are decompressed by the registered one.
+func NewFlateCompressor(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+func (f *flateCompressor) Type() CompressionType {
+	return CompressionFlate
+}
+
+func (f *flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := f.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(buf, f.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer f.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r, _ := f.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	defer f.readers.Put(r)
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
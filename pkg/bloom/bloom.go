@@ -0,0 +1,95 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Filter is a bloom filter over keys of a sst,
+// encoded as | bits | k(1 byte) |, k is the number of hash functions.
+type Filter []byte
+
+// Hash returns the hash of key used by Filter
+func Hash(key []byte) uint32 {
+	// similar to murmur hash
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+	)
+	h := uint32(seed) ^ uint32(len(key))*m
+	for ; len(key) >= 4; key = key[4:] {
+		h += binary.LittleEndian.Uint32(key)
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(key) {
+	case 3:
+		h += uint32(key[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(key[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(key[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
+
+// Build builds a Filter from hashes of keys, bitsPerKey less than 1 builds an empty Filter
+func Build(hashes []uint32, bitsPerKey int) Filter {
+	if bitsPerKey < 1 || len(hashes) == 0 {
+		return Filter{}
+	}
+	// k = ln2 * bitsPerKey minimizes the false positive rate
+	k := uint8(float64(bitsPerKey) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	nBits := len(hashes) * bitsPerKey
+	// a small filter has a high false positive rate
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+	filter := make(Filter, nBytes+1)
+	for _, h := range hashes {
+		// double hashing, see "Less Hashing, Same Performance: Building a Better Bloom Filter"
+		delta := h>>17 | h<<15
+		for i := uint8(0); i < k; i++ {
+			pos := h % uint32(nBits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	filter[nBytes] = k
+	return filter
+}
+
+// MayContain returns false if the key of hash is definitely not in Filter,
+// an empty or unknown Filter always returns true.
+func (f Filter) MayContain(hash uint32) bool {
+	if len(f) < 2 {
+		return true
+	}
+	nBits := uint32(len(f)-1) * 8
+	k := f[len(f)-1]
+	if k > 30 {
+		// reserved for other encodings
+		return true
+	}
+	delta := hash>>17 | hash<<15
+	for i := uint8(0); i < k; i++ {
+		pos := hash % nBits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		hash += delta
+	}
+	return true
+}
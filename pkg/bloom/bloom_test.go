@@ -0,0 +1,34 @@
+package bloom_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/bloom"
+	"mini-lsm/pkg/test"
+)
+
+func TestBloomFilter(t *testing.T) {
+	hashes := make([]uint32, 0, 1000)
+	for i := uint64(0); i < 1000; i++ {
+		hashes = append(hashes, bloom.Hash(test.KeyOf(i)))
+	}
+	filter := bloom.Build(hashes, 10)
+	for i := uint64(0); i < 1000; i++ {
+		assert.True(t, filter.MayContain(bloom.Hash(test.KeyOf(i))))
+	}
+	falsePositive := 0
+	for i := uint64(1000); i < 11000; i++ {
+		if filter.MayContain(bloom.Hash(test.KeyOf(i))) {
+			falsePositive++
+		}
+	}
+	// the false positive rate of 10 bits per key is about 1%
+	assert.Less(t, falsePositive, 300)
+}
+
+func TestBloomFilterEmpty(t *testing.T) {
+	assert.True(t, bloom.Build(nil, 10).MayContain(bloom.Hash([]byte("key"))))
+	assert.True(t, bloom.Build([]uint32{1}, 0).MayContain(bloom.Hash([]byte("key"))))
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Cache is a sharded LRU cache bounded by the total charge of its entries,
+// every shard has its own lock and evicts the least recently used entries independently.
+type Cache[K comparable, V any] struct {
+	shards []*shard[K, V]
+	hash   func(K) uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// Stats is a snapshot of counters of Cache
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Charge is the total charge of entries in Cache
+	Charge int64
+	// Count is the number of entries in Cache
+	Count int
+}
+
+type entry[K comparable, V any] struct {
+	key    K
+	value  V
+	charge int64
+}
+
+type shard[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int64
+	charge   int64
+	// lru is ordered from the most recently used to the least recently used
+	lru     *list.List
+	entries map[K]*list.Element
+}
+
+// New returns a Cache holding entries up to capacity charge in total, which is split into shardCount shards.
+// hash picks the shard of key.
+func New[K comparable, V any](capacity int64, shardCount int, hash func(K) uint64) *Cache[K, V] {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	c := &Cache[K, V]{
+		shards: make([]*shard[K, V], shardCount),
+		hash:   hash,
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard[K, V]{
+			capacity: (capacity + int64(shardCount) - 1) / int64(shardCount),
+			lru:      list.New(),
+			entries:  make(map[K]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *Cache[K, V]) shard(key K) *shard[K, V] {
+	return c.shards[c.hash(key)%uint64(len(c.shards))]
+}
+
+// Get returns the value of key and marks it as the most recently used
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		var zero V
+		return zero, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*entry[K, V]).value, true
+}
+
+// Insert puts value of key into Cache, the least recently used entries are evicted if the shard is full.
+// value isn't cached if charge is larger than capacity of a shard.
+func (c *Cache[K, V]) Insert(key K, value V, charge int64) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	if charge > s.capacity {
+		return
+	}
+	for s.charge+charge > s.capacity {
+		s.remove(s.lru.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	s.entries[key] = s.lru.PushFront(&entry[K, V]{key: key, value: value, charge: charge})
+	s.charge += charge
+}
+
+// Remove deletes key from Cache, it's used to invalidate entries whose source is gone
+func (c *Cache[K, V]) Remove(key K) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+}
+
+func (s *shard[K, V]) remove(elem *list.Element) {
+	e := s.lru.Remove(elem).(*entry[K, V])
+	delete(s.entries, e.key)
+	s.charge -= e.charge
+}
+
+func (c *Cache[K, V]) Stats() Stats {
+	stats := Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Charge += s.charge
+		stats.Count += len(s.entries)
+		s.mu.Unlock()
+	}
+	return stats
+}
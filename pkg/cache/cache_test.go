@@ -0,0 +1,86 @@
+package cache_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/cache"
+)
+
+func hashInt(key int) uint64 {
+	return uint64(key)
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := cache.New[int, string](3, 1, hashInt)
+	c.Insert(1, "1", 1)
+	c.Insert(2, "2", 1)
+	c.Insert(3, "3", 1)
+	// 1 becomes the most recently used, so 2 is evicted
+	value, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, "1", value)
+	c.Insert(4, "4", 1)
+	_, ok = c.Get(2)
+	assert.False(t, ok)
+	for _, key := range []int{1, 3, 4} {
+		_, ok = c.Get(key)
+		assert.True(t, ok)
+	}
+
+	// a large entry evicts more than one entry
+	c.Insert(5, "5", 2)
+	stats := c.Stats()
+	assert.Equal(t, cache.Stats{Hits: 4, Misses: 1, Evictions: 3, Charge: 3, Count: 2}, stats)
+
+	// an entry larger than capacity isn't cached
+	c.Insert(6, "6", 4)
+	_, ok = c.Get(6)
+	assert.False(t, ok)
+}
+
+func TestCacheRemove(t *testing.T) {
+	c := cache.New[int, string](100, 4, hashInt)
+	for i := 0; i < 10; i++ {
+		c.Insert(i, "value", 10)
+	}
+	// every shard holds 25 at most
+	assert.Equal(t, int64(80), c.Stats().Charge)
+	c.Insert(0, "new value", 5)
+	value, ok := c.Get(0)
+	assert.True(t, ok)
+	assert.Equal(t, "new value", value)
+	assert.Equal(t, int64(85), c.Stats().Charge)
+	c.Remove(0)
+	_, ok = c.Get(0)
+	assert.False(t, ok)
+	assert.Equal(t, int64(80), c.Stats().Charge)
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := cache.New[int, int](1000, 8, hashInt)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := (g*1000 + i) % 2000
+				if value, ok := c.Get(key); ok {
+					assert.Equal(t, key, value)
+				} else {
+					c.Insert(key, key, 1)
+				}
+				if i%10 == 0 {
+					c.Remove(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	stats := c.Stats()
+	assert.LessOrEqual(t, stats.Charge, int64(1000))
+	assert.Equal(t, uint64(8000), stats.Hits+stats.Misses)
+}
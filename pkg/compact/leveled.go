@@ -0,0 +1,149 @@
+package compact
+
+import (
+	"sort"
+
+	"mini-lsm/pkg/sst"
+)
+
+// LeveledOptions configures Leveled
+type LeveledOptions struct {
+	// Level0FileNumCompactionTrigger is the number of L0 ssts which triggers L0->L1 compaction
+	Level0FileNumCompactionTrigger int
+	// MaxLevels is the number of levels below L0
+	MaxLevels int
+	// BaseLevelSizeBytes is the target size of L1
+	BaseLevelSizeBytes uint64
+	// LevelSizeMultiplier is the size ratio between target sizes of Li+1 and Li
+	LevelSizeMultiplier uint64
+	// TargetFileSizeBytes is the size at which compaction output is split into another sst
+	TargetFileSizeBytes uint64
+}
+
+func DefaultLeveledOptions() LeveledOptions {
+	return LeveledOptions{
+		Level0FileNumCompactionTrigger: 4,
+		MaxLevels:                      6,
+		BaseLevelSizeBytes:             10 << 20,
+		LevelSizeMultiplier:            10,
+		TargetFileSizeBytes:            2 << 20,
+	}
+}
+
+// Leveled compacts L0 into L1 when there are too many ssts in L0,
+// and compacts one sst of Li into Li+1 when the size of Li exceeds its target size.
+// Every level below L0 is a sorted run.
+type Leveled struct {
+	opts LeveledOptions
+}
+
+func NewLeveled(opts LeveledOptions) *Leveled {
+	return &Leveled{opts: opts}
+}
+
+var _ Strategy = (*Leveled)(nil)
+
+func (l *Leveled) MaxLevels() int {
+	return l.opts.MaxLevels
+}
+
+func (l *Leveled) TargetFileSizeBytes() uint64 {
+	return l.opts.TargetFileSizeBytes
+}
+
+// EstimatePendingCompactionBytes sums the size of L0 if it reaches the trigger
+// and the size of every level beyond its target size, the last level never needs compaction.
+func (l *Leveled) EstimatePendingCompactionBytes(l0 []*sst.Table, levels [][]*sst.Table) uint64 {
+	pending := uint64(0)
+	if l.opts.Level0FileNumCompactionTrigger > 0 && len(l0) >= l.opts.Level0FileNumCompactionTrigger {
+		pending += TotalSize(l0)
+	}
+	for level := 1; level < len(levels); level++ {
+		if size, target := TotalSize(levels[level-1]), l.levelTargetSize(level); size > target {
+			pending += size - target
+		}
+	}
+	return pending
+}
+
+// levelTargetSize returns the target size of Li, i >= 1
+func (l *Leveled) levelTargetSize(level int) uint64 {
+	size := l.opts.BaseLevelSizeBytes
+	for i := 1; i < level; i++ {
+		size *= l.opts.LevelSizeMultiplier
+	}
+	return size
+}
+
+// GenerateTask picks the level which exceeds its target the most,
+// levels[i] is Li+1. It returns nil if no compaction is needed.
+// A level is skipped for the next best one if its ssts or the overlapping ssts of the next level are being compacted.
+func (l *Leveled) GenerateTask(l0 []*sst.Table, levels [][]*sst.Table, compacting Compacting) *Task {
+	type candidate struct {
+		level int
+		score float64
+	}
+	var candidates []candidate
+	if l.opts.Level0FileNumCompactionTrigger > 0 {
+		score := float64(len(l0)) / float64(l.opts.Level0FileNumCompactionTrigger)
+		if score >= 1.0 {
+			candidates = append(candidates, candidate{level: 0, score: score})
+		}
+	}
+	// the last level can't be compacted to anywhere
+	for level := 1; level < len(levels); level++ {
+		score := float64(TotalSize(levels[level-1])) / float64(l.levelTargetSize(level))
+		if score > 1.0 {
+			candidates = append(candidates, candidate{level: level, score: score})
+		}
+	}
+	// L0 goes first on ties, then upper levels
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	for _, c := range candidates {
+		if task := l.newTask(c.level, l0, levels, compacting); task != nil {
+			return task
+		}
+	}
+	return nil
+}
+
+// newTask compacts level into the next level, it returns nil if the ssts to compact are being compacted
+func (l *Leveled) newTask(level int, l0 []*sst.Table, levels [][]*sst.Table, compacting Compacting) *Task {
+	lowerLevel := level + 1
+	if lowerLevel > len(levels) {
+		return nil
+	}
+	newTask := func(upper []*sst.Table) *Task {
+		lower := OverlappingTables(upper, levels[lowerLevel-1])
+		if compacting.Any(lower) {
+			return nil
+		}
+		return &Task{
+			Inputs: []LevelTables{
+				{Level: level, Tables: upper},
+				{Level: lowerLevel, Tables: lower},
+			},
+			OutputLevel:   lowerLevel,
+			IsBottomLevel: isBottomLevel(levels, lowerLevel),
+		}
+	}
+	if level == 0 {
+		// ssts in L0 overlap each other, they are compacted by one task at a time
+		if compacting.Any(l0) {
+			return nil
+		}
+		return newTask(append([]*sst.Table{}, l0...))
+	}
+	// compact the oldest sst of the level first
+	tables := append([]*sst.Table{}, levels[level-1]...)
+	sort.SliceStable(tables, func(i, j int) bool { return tables[i].SSTID() < tables[j].SSTID() })
+	for _, table := range tables {
+		if compacting.Any([]*sst.Table{table}) {
+			continue
+		}
+		if task := newTask([]*sst.Table{table}); task != nil {
+			return task
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package compact_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/compact"
+	"mini-lsm/pkg/mvcc"
+	"mini-lsm/pkg/sst"
+	"mini-lsm/pkg/test"
+)
+
+func generateSST(t *testing.T, from, to uint64) *sst.Table {
+	pairs := make([]test.Pair, 0, to-from)
+	for i := from; i < to; i++ {
+		pairs = append(pairs, test.Pair{Key: mvcc.MakeKey(test.KeyOf(i), i, mvcc.KindPut), Value: test.ValueOf(i)})
+	}
+	table, _, err := test.GenerateSST(t.TempDir, pairs)
+	assert.Nil(t, err)
+	t.Cleanup(func() { table.Close() })
+	return table
+}
+
+func TestOverlappingTables(t *testing.T) {
+	run := []*sst.Table{generateSST(t, 0, 100), generateSST(t, 100, 200), generateSST(t, 200, 300)}
+	assert.Equal(t, run[1:2], compact.OverlappingTables([]*sst.Table{generateSST(t, 120, 150)}, run))
+	assert.Equal(t, run[0:2], compact.OverlappingTables([]*sst.Table{generateSST(t, 50, 60), generateSST(t, 99, 101)}, run))
+	assert.Equal(t, run, compact.OverlappingTables([]*sst.Table{generateSST(t, 99, 201)}, run))
+	assert.Empty(t, compact.OverlappingTables([]*sst.Table{generateSST(t, 300, 400)}, run))
+}
+
+func TestLeveledGenerateTask(t *testing.T) {
+	opts := compact.LeveledOptions{
+		Level0FileNumCompactionTrigger: 2,
+		MaxLevels:                      3,
+		BaseLevelSizeBytes:             1 << 20,
+		LevelSizeMultiplier:            10,
+		TargetFileSizeBytes:            1 << 20,
+	}
+	leveled := compact.NewLeveled(opts)
+	l1 := []*sst.Table{generateSST(t, 0, 100), generateSST(t, 100, 200), generateSST(t, 200, 300)}
+	levels := [][]*sst.Table{l1, {}, {generateSST(t, 1000, 1100)}}
+
+	assert.Nil(t, leveled.GenerateTask([]*sst.Table{generateSST(t, 0, 10)}, levels, nil))
+
+	l0 := []*sst.Table{generateSST(t, 150, 160), generateSST(t, 10, 20)}
+	task := leveled.GenerateTask(l0, levels, nil)
+	assert.NotNil(t, task)
+	assert.Equal(t, []compact.LevelTables{{Level: 0, Tables: l0}, {Level: 1, Tables: l1[0:2]}}, task.Inputs)
+	assert.Equal(t, 1, task.OutputLevel)
+	assert.False(t, task.IsBottomLevel)
+
+	// L1 exceeds its target size, the oldest sst of L1 is compacted to L2
+	opts.BaseLevelSizeBytes = compact.TotalSize(l1) / 2
+	task = compact.NewLeveled(opts).GenerateTask(nil, levels, nil)
+	assert.NotNil(t, task)
+	assert.Len(t, task.Inputs, 2)
+	assert.Equal(t, compact.LevelTables{Level: 1, Tables: l1[0:1]}, task.Inputs[0])
+	assert.Equal(t, 2, task.Inputs[1].Level)
+	assert.Empty(t, task.Inputs[1].Tables)
+	assert.Equal(t, 2, task.OutputLevel)
+	assert.False(t, task.IsBottomLevel)
+
+	levels[2] = nil
+	task = compact.NewLeveled(opts).GenerateTask(nil, levels, nil)
+	assert.True(t, task.IsBottomLevel)
+}
+
+// compactingOf reports tables as being compacted
+func compactingOf(tables ...*sst.Table) compact.Compacting {
+	return func(table *sst.Table) bool {
+		for _, t := range tables {
+			if t == table {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestLeveledGenerateTaskSkipsCompacting(t *testing.T) {
+	l0 := []*sst.Table{generateSST(t, 150, 160), generateSST(t, 10, 20)}
+	l1 := []*sst.Table{generateSST(t, 0, 100), generateSST(t, 100, 200), generateSST(t, 200, 300)}
+	l2 := []*sst.Table{generateSST(t, 0, 50), generateSST(t, 250, 300)}
+	levels := [][]*sst.Table{l1, l2, {}}
+	// L0 scores the most, L1 exceeds its target size as well
+	leveled := compact.NewLeveled(compact.LeveledOptions{
+		Level0FileNumCompactionTrigger: 1,
+		MaxLevels:                      3,
+		BaseLevelSizeBytes:             compact.TotalSize(l1) * 2 / 3,
+		LevelSizeMultiplier:            10,
+		TargetFileSizeBytes:            1 << 20,
+	})
+	task := leveled.GenerateTask(l0, levels, nil)
+	assert.Equal(t, 0, task.Inputs[0].Level)
+
+	// L0 is being compacted, the oldest sst of L1 goes next
+	task = leveled.GenerateTask(l0, levels, compactingOf(l0[1]))
+	assert.Equal(t, []compact.LevelTables{{Level: 1, Tables: l1[0:1]}, {Level: 2, Tables: l2[0:1]}}, task.Inputs)
+
+	// an sst of L1 overlapping L0 is being compacted into L2
+	task = leveled.GenerateTask(l0, levels, compactingOf(l1[0], l2[0]))
+	assert.Equal(t, []compact.LevelTables{{Level: 1, Tables: l1[1:2]}, {Level: 2, Tables: []*sst.Table{}}}, task.Inputs)
+
+	// the overlapping sst of L2 is being compacted as well
+	task = leveled.GenerateTask(l0, levels, compactingOf(l1[0], l1[1]))
+	assert.Equal(t, []compact.LevelTables{{Level: 1, Tables: l1[2:3]}, {Level: 2, Tables: l2[1:2]}}, task.Inputs)
+	assert.Nil(t, leveled.GenerateTask(l0, levels, compactingOf(l1[0], l1[1], l2[1])))
+}
+
+func TestLeveledEstimatePendingCompactionBytes(t *testing.T) {
+	opts := compact.LeveledOptions{
+		Level0FileNumCompactionTrigger: 2,
+		MaxLevels:                      3,
+		BaseLevelSizeBytes:             1 << 20,
+		LevelSizeMultiplier:            10,
+		TargetFileSizeBytes:            1 << 20,
+	}
+	l0 := []*sst.Table{generateSST(t, 0, 10), generateSST(t, 10, 20)}
+	l1 := []*sst.Table{generateSST(t, 0, 100), generateSST(t, 100, 200)}
+	levels := [][]*sst.Table{l1, {}, {generateSST(t, 1000, 1100)}}
+
+	leveled := compact.NewLeveled(opts)
+	assert.Zero(t, leveled.EstimatePendingCompactionBytes(l0[:1], levels))
+	assert.Equal(t, compact.TotalSize(l0), leveled.EstimatePendingCompactionBytes(l0, levels))
+
+	// L1 exceeds its target size, the last level is never pending
+	opts.BaseLevelSizeBytes = compact.TotalSize(l1) / 2
+	opts.LevelSizeMultiplier = 2
+	leveled = compact.NewLeveled(opts)
+	assert.Equal(t, compact.TotalSize(l1)-opts.BaseLevelSizeBytes, leveled.EstimatePendingCompactionBytes(nil, levels))
+}
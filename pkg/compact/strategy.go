@@ -0,0 +1,98 @@
+package compact
+
+import (
+	"mini-lsm/pkg/mvcc"
+	"mini-lsm/pkg/sst"
+)
+
+// Strategy decides which ssts should be compacted together
+type Strategy interface {
+	// GenerateTask returns nil if there is nothing to compact,
+	// l0 is ordered from the newest to the oldest, levels[i] is Li+1.
+	// Tasks may run concurrently, the returned Task must not conflict with tasks compacting ssts reported by compacting.
+	GenerateTask(l0 []*sst.Table, levels [][]*sst.Table, compacting Compacting) *Task
+	// MaxLevels is the number of levels below L0
+	MaxLevels() int
+	// TargetFileSizeBytes is the size at which compaction output is split into another sst
+	TargetFileSizeBytes() uint64
+	// EstimatePendingCompactionBytes estimates how many bytes should be compacted
+	// to bring the shape of l0 and levels back under the triggers of compaction.
+	EstimatePendingCompactionBytes(l0 []*sst.Table, levels [][]*sst.Table) uint64
+}
+
+// Compacting reports whether an sst is being compacted by a running task, nil Compacting reports none
+type Compacting func(table *sst.Table) bool
+
+// Any returns whether any of tables is being compacted
+func (c Compacting) Any(tables []*sst.Table) bool {
+	if c == nil {
+		return false
+	}
+	for _, table := range tables {
+		if c(table) {
+			return true
+		}
+	}
+	return false
+}
+
+// LevelTables are ssts picked from one level, level 0 is L0
+type LevelTables struct {
+	Level  int
+	Tables []*sst.Table
+}
+
+// Task tells which ssts should be merged together,
+// outputs of Task replace all of them and belong to OutputLevel,
+// outputs to L0 are written as one sst since every sst in L0 is a sorted run.
+type Task struct {
+	// Inputs are ordered from the newest data to the oldest,
+	// ssts in L0 are ordered from the newest to the oldest.
+	Inputs      []LevelTables
+	OutputLevel int
+	// IsBottomLevel is true if there is no data below OutputLevel
+	IsBottomLevel bool
+}
+
+func isBottomLevel(levels [][]*sst.Table, level int) bool {
+	for i := level; i < len(levels); i++ {
+		if len(levels[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// OverlappingTables returns ssts in run whose user key range overlaps any of tables,
+// so that all versions of a user key in run are compacted together.
+func OverlappingTables(tables []*sst.Table, run []*sst.Table) []*sst.Table {
+	if len(tables) == 0 {
+		return nil
+	}
+	first, last := tables[0].FirstKey(), tables[0].LastKey()
+	for _, table := range tables[1:] {
+		if mvcc.CompareUserKey(table.FirstKey(), first) < 0 {
+			first = table.FirstKey()
+		}
+		if mvcc.CompareUserKey(table.LastKey(), last) > 0 {
+			last = table.LastKey()
+		}
+	}
+	out := make([]*sst.Table, 0)
+	for _, table := range run {
+		if mvcc.CompareUserKey(table.LastKey(), first) < 0 || mvcc.CompareUserKey(table.FirstKey(), last) > 0 {
+			continue
+		}
+		out = append(out, table)
+	}
+	return out
+}
+
+// TotalSize returns the sum of size of tables
+func TotalSize(tables []*sst.Table) uint64 {
+	size := uint64(0)
+	for _, table := range tables {
+		size += table.Size()
+	}
+	return size
+}
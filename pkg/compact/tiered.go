@@ -0,0 +1,179 @@
+package compact
+
+import (
+	"mini-lsm/pkg/sst"
+)
+
+// TieredOptions configures Tiered
+type TieredOptions struct {
+	// MaxLevels is the number of levels below L0, every non-empty level holds one sorted run
+	MaxLevels int
+	// NumSortedRunsTrigger is the number of sorted runs which triggers compaction
+	NumSortedRunsTrigger int
+	// MaxSizeAmplificationPercent triggers a full compaction when
+	// size of all sorted runs except the oldest one * 100 >= size of the oldest one * MaxSizeAmplificationPercent
+	MaxSizeAmplificationPercent uint64
+	// SizeRatioPercent: the newest sorted runs are merged together if
+	// the next sorted run is larger than all of them by more than SizeRatioPercent
+	SizeRatioPercent uint64
+	// MinMergeWidth is the minimum number of sorted runs merged by size ratio
+	MinMergeWidth int
+	// TargetFileSizeBytes is the size at which compaction output is split into another sst
+	TargetFileSizeBytes uint64
+}
+
+func DefaultTieredOptions() TieredOptions {
+	return TieredOptions{
+		MaxLevels:                   6,
+		NumSortedRunsTrigger:        8,
+		MaxSizeAmplificationPercent: 200,
+		SizeRatioPercent:            1,
+		MinMergeWidth:               2,
+		TargetFileSizeBytes:         2 << 20,
+	}
+}
+
+// Tiered is size-tiered(universal) compaction, it trades read amplification for write amplification.
+// Every sst in L0 and every non-empty level below L0 is a sorted run,
+// Tiered always merges the newest sorted runs together.
+type Tiered struct {
+	opts TieredOptions
+}
+
+func NewTiered(opts TieredOptions) *Tiered {
+	return &Tiered{opts: opts}
+}
+
+var _ Strategy = (*Tiered)(nil)
+
+func (t *Tiered) MaxLevels() int {
+	return t.opts.MaxLevels
+}
+
+func (t *Tiered) TargetFileSizeBytes() uint64 {
+	return t.opts.TargetFileSizeBytes
+}
+
+type sortedRun struct {
+	level  int
+	tables []*sst.Table
+	size   uint64
+}
+
+// sortedRuns returns all sorted runs from the newest to the oldest
+func sortedRuns(l0 []*sst.Table, levels [][]*sst.Table) []sortedRun {
+	runs := make([]sortedRun, 0, len(l0)+len(levels))
+	for _, table := range l0 {
+		runs = append(runs, sortedRun{level: 0, tables: []*sst.Table{table}, size: table.Size()})
+	}
+	for i, level := range levels {
+		if len(level) != 0 {
+			runs = append(runs, sortedRun{level: i + 1, tables: level, size: TotalSize(level)})
+		}
+	}
+	return runs
+}
+
+// EstimatePendingCompactionBytes sums the size of all sorted runs except the oldest one
+// if the number of sorted runs reaches the trigger, they are merged into the oldest one at most.
+func (t *Tiered) EstimatePendingCompactionBytes(l0 []*sst.Table, levels [][]*sst.Table) uint64 {
+	runs := sortedRuns(l0, levels)
+	if len(runs) < 2 || len(runs) < t.opts.NumSortedRunsTrigger {
+		return 0
+	}
+	pending := uint64(0)
+	for _, run := range runs[:len(runs)-1] {
+		pending += run.size
+	}
+	return pending
+}
+
+// GenerateTask checks size amplification first, then size ratio,
+// at last it merges the newest sorted runs to reduce the number of sorted runs under trigger.
+// Sorted runs being compacted are the newest ones when the running task was picked,
+// only ssts flushed to L0 after them can be merged meanwhile, see newL0Task.
+func (t *Tiered) GenerateTask(l0 []*sst.Table, levels [][]*sst.Table, compacting Compacting) *Task {
+	runs := sortedRuns(l0, levels)
+	if len(runs) < 2 || len(runs) < t.opts.NumSortedRunsTrigger {
+		return nil
+	}
+	for i, run := range runs {
+		if compacting.Any(run.tables) {
+			return t.newL0Task(runs[:i])
+		}
+	}
+
+	oldest := runs[len(runs)-1]
+	newerSize := uint64(0)
+	for _, run := range runs[:len(runs)-1] {
+		newerSize += run.size
+	}
+	if newerSize*100 >= oldest.size*t.opts.MaxSizeAmplificationPercent {
+		return t.newTask(runs, len(runs), l0, levels)
+	}
+
+	size := uint64(0)
+	for i := 0; i < len(runs)-1; i++ {
+		size += runs[i].size
+		if runs[i+1].size*100 > size*(100+t.opts.SizeRatioPercent) && i+1 >= t.opts.MinMergeWidth {
+			return t.newTask(runs, i+1, l0, levels)
+		}
+	}
+
+	width := len(runs) - t.opts.NumSortedRunsTrigger + 2
+	if width > len(runs) {
+		width = len(runs)
+	}
+	return t.newTask(runs, width, l0, levels)
+}
+
+// newL0Task merges sorted runs newer than the ones being compacted into one sst in L0,
+// the output level of the running task may be any level below them.
+// It returns nil if there are less than two such runs or any of them is not in L0.
+func (t *Tiered) newL0Task(runs []sortedRun) *Task {
+	if len(runs) < 2 {
+		return nil
+	}
+	tables := make([]*sst.Table, 0, len(runs))
+	for _, run := range runs {
+		if run.level != 0 {
+			return nil
+		}
+		tables = append(tables, run.tables...)
+	}
+	return &Task{Inputs: []LevelTables{{Level: 0, Tables: tables}}, OutputLevel: 0}
+}
+
+// newTask merges the newest width sorted runs
+func (t *Tiered) newTask(runs []sortedRun, width int, l0 []*sst.Table, levels [][]*sst.Table) *Task {
+	picked := runs[:width]
+	task := &Task{}
+	for _, run := range picked {
+		if n := len(task.Inputs); n != 0 && task.Inputs[n-1].Level == run.level {
+			task.Inputs[n-1].Tables = append(task.Inputs[n-1].Tables, run.tables...)
+			continue
+		}
+		task.Inputs = append(task.Inputs, LevelTables{Level: run.level, Tables: append([]*sst.Table{}, run.tables...)})
+	}
+
+	last := picked[len(picked)-1]
+	switch {
+	case last.level != 0:
+		task.OutputLevel = last.level
+	case len(task.Inputs[0].Tables) == len(l0):
+		// all ssts in L0 are picked, output goes to the deepest empty level above the next sorted run,
+		// it's L0 if L1 is not empty, then output is written as one sst.
+		task.OutputLevel = len(levels)
+		for i, level := range levels {
+			if len(level) != 0 {
+				task.OutputLevel = i
+				break
+			}
+		}
+	default:
+		// output is written as one sst in place of the picked ssts in L0
+		task.OutputLevel = 0
+	}
+	task.IsBottomLevel = width == len(runs)
+	return task
+}
@@ -0,0 +1,98 @@
+package compact_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/compact"
+	"mini-lsm/pkg/sst"
+)
+
+func TestTieredGenerateTask(t *testing.T) {
+	opts := compact.TieredOptions{
+		MaxLevels:                   4,
+		NumSortedRunsTrigger:        3,
+		MaxSizeAmplificationPercent: 200,
+		SizeRatioPercent:            1,
+		MinMergeWidth:               2,
+		TargetFileSizeBytes:         1 << 20,
+	}
+	tiered := compact.NewTiered(opts)
+	small := func() *sst.Table { return generateSST(t, 0, 10) }
+	large := []*sst.Table{generateSST(t, 0, 500), generateSST(t, 500, 1000)}
+
+	// not enough sorted runs
+	assert.Nil(t, tiered.GenerateTask([]*sst.Table{small()}, [][]*sst.Table{{}, {}, {}, large}, nil))
+
+	// size ratio: the newest small runs are merged into the empty level above the large run
+	l0 := []*sst.Table{small(), small()}
+	task := tiered.GenerateTask(l0, [][]*sst.Table{{}, {}, {}, large}, nil)
+	assert.NotNil(t, task)
+	assert.Equal(t, []compact.LevelTables{{Level: 0, Tables: l0}}, task.Inputs)
+	assert.Equal(t, 3, task.OutputLevel)
+	assert.False(t, task.IsBottomLevel)
+
+	// size amplification: all sorted runs are merged into the oldest one
+	l2 := []*sst.Table{generateSST(t, 0, 400)}
+	l4 := []*sst.Table{generateSST(t, 0, 100)}
+	task = tiered.GenerateTask(l0, [][]*sst.Table{{}, l2, {}, l4}, nil)
+	assert.NotNil(t, task)
+	assert.Equal(t, []compact.LevelTables{{Level: 0, Tables: l0}, {Level: 2, Tables: l2}, {Level: 4, Tables: l4}}, task.Inputs)
+	assert.Equal(t, 4, task.OutputLevel)
+	assert.True(t, task.IsBottomLevel)
+
+	// runs of the same size are all merged because of size amplification
+	l0 = []*sst.Table{small(), small(), small(), small()}
+	task = tiered.GenerateTask(l0, [][]*sst.Table{{}, {}, {}, {}}, nil)
+	assert.NotNil(t, task)
+	assert.Equal(t, []compact.LevelTables{{Level: 0, Tables: l0}}, task.Inputs)
+	assert.Equal(t, 4, task.OutputLevel)
+	assert.True(t, task.IsBottomLevel)
+}
+
+func TestTieredGenerateTaskSkipsCompacting(t *testing.T) {
+	tiered := compact.NewTiered(compact.TieredOptions{
+		MaxLevels:                   4,
+		NumSortedRunsTrigger:        3,
+		MaxSizeAmplificationPercent: 200,
+		SizeRatioPercent:            1,
+		MinMergeWidth:               2,
+		TargetFileSizeBytes:         1 << 20,
+	})
+	l0 := []*sst.Table{generateSST(t, 0, 10), generateSST(t, 0, 10), generateSST(t, 0, 10), generateSST(t, 0, 10)}
+	large := []*sst.Table{generateSST(t, 0, 500)}
+	levels := [][]*sst.Table{{}, {}, {}, large}
+
+	// ssts flushed after the running task are merged into one sst in L0
+	task := tiered.GenerateTask(l0, levels, compactingOf(l0[2], l0[3]))
+	assert.NotNil(t, task)
+	assert.Equal(t, []compact.LevelTables{{Level: 0, Tables: l0[:2]}}, task.Inputs)
+	assert.Equal(t, 0, task.OutputLevel)
+	assert.False(t, task.IsBottomLevel)
+	task = tiered.GenerateTask(l0, levels, compactingOf(large...))
+	assert.NotNil(t, task)
+	assert.Equal(t, []compact.LevelTables{{Level: 0, Tables: l0}}, task.Inputs)
+	assert.Equal(t, 0, task.OutputLevel)
+
+	assert.Nil(t, tiered.GenerateTask(l0, levels, compactingOf(l0[1:]...)))
+	// sorted runs below L0 are never newer than the running task
+	l1 := []*sst.Table{generateSST(t, 0, 100)}
+	assert.Nil(t, tiered.GenerateTask(l0[:2], [][]*sst.Table{l1, {}, {}, large}, compactingOf(large...)))
+}
+
+func TestTieredEstimatePendingCompactionBytes(t *testing.T) {
+	tiered := compact.NewTiered(compact.TieredOptions{
+		MaxLevels:                   4,
+		NumSortedRunsTrigger:        3,
+		MaxSizeAmplificationPercent: 200,
+		SizeRatioPercent:            1,
+		MinMergeWidth:               2,
+		TargetFileSizeBytes:         1 << 20,
+	})
+	l0 := []*sst.Table{generateSST(t, 0, 10), generateSST(t, 10, 20)}
+	large := []*sst.Table{generateSST(t, 0, 500)}
+
+	assert.Zero(t, tiered.EstimatePendingCompactionBytes(l0[:1], [][]*sst.Table{{}, {}, {}, large}))
+	assert.Equal(t, compact.TotalSize(l0), tiered.EstimatePendingCompactionBytes(l0, [][]*sst.Table{{}, {}, {}, large}))
+}
@@ -0,0 +1,149 @@
+package iterator
+
+import (
+	"bytes"
+)
+
+// Bounds limit keys of an Iter, nil Lower or Upper is unbounded.
+// Bounds are inclusive unless ExcludeLower or ExcludeUpper is set.
+type Bounds struct {
+	Lower, Upper               []byte
+	ExcludeLower, ExcludeUpper bool
+}
+
+// AboveLower returns whether key is not out of the lower bound
+func (b Bounds) AboveLower(key []byte) bool {
+	if b.Lower == nil {
+		return true
+	}
+	cmp := bytes.Compare(key, b.Lower)
+	return cmp > 0 || cmp == 0 && !b.ExcludeLower
+}
+
+// BelowUpper returns whether key is not out of the upper bound
+func (b Bounds) BelowUpper(key []byte) bool {
+	if b.Upper == nil {
+		return true
+	}
+	cmp := bytes.Compare(key, b.Upper)
+	return cmp < 0 || cmp == 0 && !b.ExcludeUpper
+}
+
+// Contains returns whether key is in Bounds
+func (b Bounds) Contains(key []byte) bool {
+	return b.AboveLower(key) && b.BelowUpper(key)
+}
+
+// BoundedIter limits the Iter it holds to keys in Bounds,
+// it becomes invalid once the Iter moves out of Bounds.
+type BoundedIter struct {
+	iter   Iter
+	bounds Bounds
+	// inBounds is whether the current key of iter is in bounds
+	inBounds bool
+}
+
+var _ Iter = (*BoundedIter)(nil)
+
+// NewBoundedIter returns a BoundedIter on the current key of iter,
+// iter should be on the first key not less than the lower bound, like Seek does.
+func NewBoundedIter(iter Iter, bounds Bounds) *BoundedIter {
+	b := &BoundedIter{iter: iter, bounds: bounds}
+	b.skipExcludedLower()
+	b.checkBounds()
+	return b
+}
+
+func (b *BoundedIter) checkBounds() {
+	b.inBounds = b.iter.IsValid() && b.bounds.Contains(b.iter.Key())
+}
+
+// skipExcludedLower moves iter over keys out of the lower bound, e.g. the lower bound itself if it's excluded
+func (b *BoundedIter) skipExcludedLower() {
+	for b.iter.IsValid() && !b.bounds.AboveLower(b.iter.Key()) {
+		b.iter.Next()
+	}
+}
+
+// skipExcludedUpper moves iter backward over keys out of the upper bound, e.g. the upper bound itself if it's excluded
+func (b *BoundedIter) skipExcludedUpper() {
+	for b.iter.IsValid() && !b.bounds.BelowUpper(b.iter.Key()) {
+		b.iter.Prev()
+	}
+}
+
+func (b *BoundedIter) Key() []byte {
+	if !b.IsValid() {
+		return nil
+	}
+	return b.iter.Key()
+}
+
+func (b *BoundedIter) Value() []byte {
+	if !b.IsValid() {
+		return nil
+	}
+	return b.iter.Value()
+}
+
+func (b *BoundedIter) IsValid() bool {
+	return b.inBounds && b.iter.IsValid()
+}
+
+func (b *BoundedIter) Err() error {
+	return b.iter.Err()
+}
+
+func (b *BoundedIter) Next() {
+	if !b.IsValid() {
+		return
+	}
+	b.iter.Next()
+	b.checkBounds()
+}
+
+func (b *BoundedIter) Prev() {
+	if !b.IsValid() {
+		return
+	}
+	b.iter.Prev()
+	b.checkBounds()
+}
+
+// Seek moves to the first key in Bounds not less than key
+func (b *BoundedIter) Seek(key []byte) {
+	if !b.bounds.AboveLower(key) {
+		key = b.bounds.Lower
+	}
+	b.iter.Seek(key)
+	b.skipExcludedLower()
+	b.checkBounds()
+}
+
+// SeekForPrev moves to the last key in Bounds not greater than key
+func (b *BoundedIter) SeekForPrev(key []byte) {
+	if !b.bounds.BelowUpper(key) {
+		key = b.bounds.Upper
+	}
+	b.iter.SeekForPrev(key)
+	b.skipExcludedUpper()
+	b.checkBounds()
+}
+
+func (b *BoundedIter) SeekToFirst() {
+	if b.bounds.Lower == nil {
+		b.iter.SeekToFirst()
+		b.checkBounds()
+		return
+	}
+	b.Seek(b.bounds.Lower)
+}
+
+func (b *BoundedIter) SeekToLast() {
+	if b.bounds.Upper == nil {
+		b.iter.SeekToLast()
+		b.checkBounds()
+		return
+	}
+	b.SeekForPrev(b.bounds.Upper)
+}
@@ -1,8 +1,20 @@
 package iterator
 
+// Iter iterates key-value pairs ordered by key in both directions.
+// Next and Prev do nothing if Iter is invalid, seek it again to reuse it.
 type Iter interface {
 	Key() []byte
 	Value() []byte
 	IsValid() bool
 	Next()
+	// Prev moves to the previous key
+	Prev()
+	// Seek moves to the first key which is greater than or equal to key
+	Seek(key []byte)
+	// SeekForPrev moves to the last key which is less than or equal to key
+	SeekForPrev(key []byte)
+	SeekToFirst()
+	SeekToLast()
+	// Err returns the error which makes Iter invalid, it's nil if Iter is exhausted normally
+	Err() error
 }
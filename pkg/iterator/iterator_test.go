@@ -1,8 +1,11 @@
 package iterator_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"path/filepath"
-	"sync"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,8 +16,11 @@ import (
 )
 
 type MockIterator struct {
-	Data  []struct{ K, V []byte }
-	Index uint64
+	Data []struct{ K, V []byte }
+	// Index is out of Data when MockIterator is invalid
+	Index int
+	// Error is returned by Err when MockIterator is invalid
+	Error error
 }
 
 func NewMockIterator(data []struct{ K, V []byte }) *MockIterator {
@@ -30,13 +36,36 @@ func (m *MockIterator) Value() []byte {
 	return m.Data[m.Index].V
 }
 func (m *MockIterator) IsValid() bool {
-	return m.Index < uint64(len(m.Data))
+	return m.Index >= 0 && m.Index < len(m.Data)
+}
+func (m *MockIterator) Err() error {
+	if m.IsValid() {
+		return nil
+	}
+	return m.Error
 }
 func (m *MockIterator) Next() {
-	if m.Index < uint64(len(m.Data)) {
-		m.Index += 1
+	if m.IsValid() {
+		m.Index++
 	}
 }
+func (m *MockIterator) Prev() {
+	if m.IsValid() {
+		m.Index--
+	}
+}
+func (m *MockIterator) Seek(key []byte) {
+	m.Index = sort.Search(len(m.Data), func(i int) bool { return bytes.Compare(m.Data[i].K, key) >= 0 })
+}
+func (m *MockIterator) SeekForPrev(key []byte) {
+	m.Index = sort.Search(len(m.Data), func(i int) bool { return bytes.Compare(m.Data[i].K, key) > 0 }) - 1
+}
+func (m *MockIterator) SeekToFirst() {
+	m.Index = 0
+}
+func (m *MockIterator) SeekToLast() {
+	m.Index = len(m.Data) - 1
+}
 
 func CheckIterResult(t *testing.T, iter iterator.Iter, expected []struct{ K, V []byte }) {
 	for i := range expected {
@@ -48,6 +77,18 @@ func CheckIterResult(t *testing.T, iter iterator.Iter, expected []struct{ K, V [
 	assert.False(t, iter.IsValid())
 }
 
+// CheckIterReverse seeks iter to the last key, then checks it moves backward over expected
+func CheckIterReverse(t *testing.T, iter iterator.Iter, expected []struct{ K, V []byte }) {
+	iter.SeekToLast()
+	for i := len(expected) - 1; i >= 0; i-- {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, expected[i].K, iter.Key())
+		assert.Equal(t, expected[i].V, iter.Value())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+}
+
 func TestTwoMerge1(t *testing.T) {
 	i1 := NewMockIterator([]struct{ K, V []byte }{
 		{[]byte("a"), []byte("1.1")},
@@ -60,12 +101,15 @@ func TestTwoMerge1(t *testing.T) {
 		{[]byte("c"), []byte("3.3")},
 		{[]byte("d"), []byte("4.2")},
 	})
-	CheckIterResult(t, iterator.NewTwoMerger(i1, i2), []struct{ K, V []byte }{
+	expected := []struct{ K, V []byte }{
 		{[]byte("a"), []byte("1.1")},
 		{[]byte("b"), []byte("2.1")},
 		{[]byte("c"), []byte("3.1")},
 		{[]byte("d"), []byte("4.2")},
-	})
+	}
+	iter := iterator.NewTwoMerger(i1, i2)
+	CheckIterResult(t, iter, expected)
+	CheckIterReverse(t, iter, expected)
 }
 
 func TestTwoMerge2(t *testing.T) {
@@ -81,13 +125,16 @@ func TestTwoMerge2(t *testing.T) {
 		{[]byte("c"), []byte("3.3")},
 		{[]byte("d"), []byte("4.2")},
 	})
-	CheckIterResult(t, iterator.NewTwoMerger(i2, i1), []struct{ K, V []byte }{
+	expected := []struct{ K, V []byte }{
 		{[]byte("a"), []byte("1.2")},
 		{[]byte("b"), []byte("2.2")},
 		{[]byte("c"), []byte("3.3")},
 		{[]byte("d"), []byte("4.2")},
 		{[]byte("e"), []byte("5.1")},
-	})
+	}
+	iter := iterator.NewTwoMerger(i2, i1)
+	CheckIterResult(t, iter, expected)
+	CheckIterReverse(t, iter, expected)
 }
 
 func newMockIterator() (iterator.Iter, iterator.Iter, iterator.Iter) {
@@ -112,22 +159,28 @@ func newMockIterator() (iterator.Iter, iterator.Iter, iterator.Iter) {
 
 func TestMerge1(t *testing.T) {
 	i1, i2, i3 := newMockIterator()
-	CheckIterResult(t, iterator.NewMergeIterator(i1, i2, i3), []struct{ K, V []byte }{
+	expected := []struct{ K, V []byte }{
 		{[]byte("a"), []byte("1.1")},
 		{[]byte("b"), []byte("2.1")},
 		{[]byte("c"), []byte("3.1")},
 		{[]byte("d"), []byte("4.2")},
-	})
+	}
+	iter := iterator.NewMergeIterator(i1, i2, i3)
+	CheckIterResult(t, iter, expected)
+	CheckIterReverse(t, iter, expected)
 }
 
 func TestMerge2(t *testing.T) {
 	i1, i2, i3 := newMockIterator()
-	CheckIterResult(t, iterator.NewMergeIterator(i3, i2, i1), []struct{ K, V []byte }{
+	expected := []struct{ K, V []byte }{
 		{[]byte("a"), []byte("1.2")},
 		{[]byte("b"), []byte("2.3")},
 		{[]byte("c"), []byte("3.3")},
 		{[]byte("d"), []byte("4.3")},
-	})
+	}
+	iter := iterator.NewMergeIterator(i3, i2, i1)
+	CheckIterResult(t, iter, expected)
+	CheckIterReverse(t, iter, expected)
 }
 
 func TestMergeTwo(t *testing.T) {
@@ -137,7 +190,7 @@ func TestMergeTwo(t *testing.T) {
 	sb.Add("b", "1.2")
 	sb.Add("c", "1.3")
 	sb.Add("f", "1.5")
-	st, err := sb.Build(0, &sync.Map{}, filepath.Join(dir, "1.sst"))
+	st, err := sb.Build(0, nil, filepath.Join(dir, "1.sst"))
 	assert.Nil(t, err)
 	defer st.Close()
 
@@ -176,7 +229,7 @@ func TestMergeTwo(t *testing.T) {
 	defer ssta.Close()
 	sb = sst.NewTableBuilder(4096)
 	sb.AddByte(test.KeyOf(128), test.ValueOf(0))
-	sstb, err := sb.Build(0, &sync.Map{}, filepath.Join(dir, "2.sst"))
+	sstb, err := sb.Build(0, nil, filepath.Join(dir, "2.sst"))
 	assert.Nil(t, err)
 	defer sstb.Close()
 	var result = []struct{ K, V []byte }{}
@@ -199,7 +252,9 @@ func TestMergeTwo(t *testing.T) {
 			})
 		}
 	}
-	CheckIterResult(t, iterator.NewTwoMerger(sst.NewIterAndSeekToFirst(sstb), sst.NewIterAndSeekToFirst(ssta)), result)
+	iter := iterator.NewTwoMerger(sst.NewIterAndSeekToFirst(sstb), sst.NewIterAndSeekToFirst(ssta))
+	CheckIterResult(t, iter, result)
+	CheckIterReverse(t, iter, result)
 }
 
 func TestMergeThree(t *testing.T) {
@@ -208,13 +263,13 @@ func TestMergeThree(t *testing.T) {
 
 	sb := sst.NewTableBuilder(4096)
 	sb.AddByte(test.KeyOf(128), test.ValueOf(0))
-	sstb, err := sb.Build(0, &sync.Map{}, filepath.Join(t.TempDir(), "1.sst"))
+	sstb, err := sb.Build(0, nil, filepath.Join(t.TempDir(), "1.sst"))
 	assert.Nil(t, err)
 	defer sstb.Close()
 
 	sb = sst.NewTableBuilder(4096)
 	sb.AddByte(test.KeyOf(127), test.ValueOf(0))
-	sstc, err := sb.Build(0, &sync.Map{}, filepath.Join(t.TempDir(), "2.sst"))
+	sstc, err := sb.Build(0, nil, filepath.Join(t.TempDir(), "2.sst"))
 	assert.Nil(t, err)
 	defer sstc.Close()
 	var result = []struct{ K, V []byte }{}
@@ -237,8 +292,210 @@ func TestMergeThree(t *testing.T) {
 			})
 		}
 	}
-	CheckIterResult(t, iterator.NewMergeIterator(
+	iter := iterator.NewMergeIterator(
 		sst.NewIterAndSeekToFirst(sstc),
 		sst.NewIterAndSeekToFirst(sstb),
-		sst.NewIterAndSeekToFirst(ssta)), result)
+		sst.NewIterAndSeekToFirst(ssta))
+	CheckIterResult(t, iter, result)
+	CheckIterReverse(t, iter, result)
+}
+
+func TestMergeTombstone(t *testing.T) {
+	newIterators := func() (iterator.Iter, iterator.Iter) {
+		newer := NewMockIterator([]struct{ K, V []byte }{
+			{[]byte("a"), []byte{}},
+			{[]byte("c"), []byte("3.1")},
+			{[]byte("d"), []byte{}},
+		})
+		older := NewMockIterator([]struct{ K, V []byte }{
+			{[]byte("a"), []byte("1.2")},
+			{[]byte("b"), []byte("2.2")},
+			{[]byte("d"), []byte("4.2")},
+		})
+		return newer, older
+	}
+	// merge iterators return tombstones which shadow older versions
+	withTombstones := []struct{ K, V []byte }{
+		{[]byte("a"), []byte{}},
+		{[]byte("b"), []byte("2.2")},
+		{[]byte("c"), []byte("3.1")},
+		{[]byte("d"), []byte{}},
+	}
+	withoutTombstones := []struct{ K, V []byte }{
+		{[]byte("b"), []byte("2.2")},
+		{[]byte("c"), []byte("3.1")},
+	}
+	for _, newIter := range []func(newer, older iterator.Iter) iterator.Iter{
+		func(newer, older iterator.Iter) iterator.Iter { return iterator.NewMergeIterator(newer, older) },
+		func(newer, older iterator.Iter) iterator.Iter { return iterator.NewTwoMerger(newer, older) },
+	} {
+		iter := newIter(newIterators())
+		CheckIterResult(t, iter, withTombstones)
+		CheckIterReverse(t, iter, withTombstones)
+		iter = iterator.NewTombstoneFilter(newIter(newIterators()))
+		CheckIterResult(t, iter, withoutTombstones)
+		CheckIterReverse(t, iter, withoutTombstones)
+	}
+}
+
+func TestMergeSwitchDirection(t *testing.T) {
+	// keys of i1, i2 and i3 are merged to a, b, c and d
+	for _, newIter := range []func() iterator.Iter{
+		func() iterator.Iter { return iterator.NewMergeIterator(newMockIterator()) },
+		func() iterator.Iter {
+			i1, i2, i3 := newMockIterator()
+			return iterator.NewTwoMerger(i3, iterator.NewTwoMerger(i2, i1))
+		},
+	} {
+		iter := newIter()
+		check := func(key string) {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, []byte(key), iter.Key())
+		}
+		iter.Seek([]byte("b"))
+		check("b")
+		iter.Next()
+		check("c")
+		iter.Prev()
+		check("b")
+		iter.Prev()
+		check("a")
+		iter.Next()
+		check("b")
+		iter.Next()
+		check("c")
+		iter.Next()
+		check("d")
+		iter.SeekForPrev([]byte("bb"))
+		check("b")
+		iter.Next()
+		check("c")
+		iter.SeekForPrev([]byte("c"))
+		check("c")
+		iter.Prev()
+		check("b")
+		iter.SeekForPrev([]byte("0"))
+		assert.False(t, iter.IsValid())
+		iter.Seek([]byte("e"))
+		assert.False(t, iter.IsValid())
+		iter.SeekToFirst()
+		check("a")
+	}
+}
+
+func TestBoundedIter(t *testing.T) {
+	// keys of i1, i2 and i3 are merged to a, b, c and d
+	all := []struct{ K, V []byte }{
+		{[]byte("a"), []byte("1.1")},
+		{[]byte("b"), []byte("2.1")},
+		{[]byte("c"), []byte("3.1")},
+		{[]byte("d"), []byte("4.2")},
+	}
+	for _, c := range []struct {
+		bounds     iterator.Bounds
+		start, end int
+	}{
+		{iterator.Bounds{}, 0, 4},
+		{iterator.Bounds{Lower: []byte("b"), Upper: []byte("c")}, 1, 3},
+		{iterator.Bounds{Lower: []byte("b"), Upper: []byte("d"), ExcludeLower: true, ExcludeUpper: true}, 2, 3},
+		{iterator.Bounds{Upper: []byte("b"), ExcludeUpper: true}, 0, 1},
+		{iterator.Bounds{Lower: []byte("bb"), Upper: []byte("z")}, 2, 4},
+		{iterator.Bounds{Lower: []byte("b"), Upper: []byte("b"), ExcludeUpper: true}, 1, 1},
+	} {
+		merged := iterator.NewMergeIterator(newMockIterator())
+		if c.bounds.Lower != nil {
+			merged.Seek(c.bounds.Lower)
+		}
+		iter := iterator.NewBoundedIter(merged, c.bounds)
+		CheckIterResult(t, iter, all[c.start:c.end])
+		CheckIterReverse(t, iter, all[c.start:c.end])
+		iter.Seek([]byte("0"))
+		CheckIterResult(t, iter, all[c.start:c.end])
+		iter.SeekForPrev([]byte("z"))
+		for i := c.end - 1; i >= c.start; i-- {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, all[i].K, iter.Key())
+			iter.Prev()
+		}
+		assert.False(t, iter.IsValid())
+	}
+}
+
+func TestMergeIteratorError(t *testing.T) {
+	errMock := errors.New("mock error")
+	i1 := NewMockIterator([]struct{ K, V []byte }{
+		{[]byte("a"), []byte("1.1")},
+		{[]byte("b"), []byte("2.1")},
+	})
+	i1.Error = errMock
+	i2 := NewMockIterator([]struct{ K, V []byte }{
+		{[]byte("a"), []byte("1.2")},
+		{[]byte("c"), []byte("3.2")},
+		{[]byte("d"), []byte("4.2")},
+	})
+	iter := iterator.NewMergeIterator(i1, i2)
+	CheckIterResult(t, iter, []struct{ K, V []byte }{
+		{[]byte("a"), []byte("1.1")},
+		{[]byte("b"), []byte("2.1")},
+	})
+	assert.ErrorIs(t, iter.Err(), errMock)
+
+	i3 := NewMockIterator(nil)
+	i3.Error = errMock
+	two := iterator.NewTwoMerger(NewMockIterator([]struct{ K, V []byte }{{[]byte("a"), []byte("1")}}), i3)
+	assert.False(t, two.IsValid())
+	assert.ErrorIs(t, two.Err(), errMock)
+}
+
+func TestMergeManyIterators(t *testing.T) {
+	// child c has key k if (k+c)%3 != 0, the value is from the child with the smallest index
+	children := make([]iterator.Iter, 0, 50)
+	for c := uint64(0); c < 50; c++ {
+		data := make([]struct{ K, V []byte }, 0)
+		for k := uint64(0); k < 100; k++ {
+			if (k+c)%3 != 0 {
+				data = append(data, struct{ K, V []byte }{test.KeyOf(k), test.ValueOf(c)})
+			}
+		}
+		children = append(children, NewMockIterator(data))
+	}
+	expected := make([]struct{ K, V []byte }, 0, 100)
+	for k := uint64(0); k < 100; k++ {
+		c := uint64(0)
+		for (k+c)%3 == 0 {
+			c++
+		}
+		expected = append(expected, struct{ K, V []byte }{test.KeyOf(k), test.ValueOf(c)})
+	}
+	iter := iterator.NewMergeIterator(children...)
+	CheckIterResult(t, iter, expected)
+	CheckIterReverse(t, iter, expected)
+}
+
+func BenchmarkMergeIterator(b *testing.B) {
+	const keys = 10000
+	for _, n := range []int{2, 10, 50, 200} {
+		// keys are spread over children one by one
+		children := make([]iterator.Iter, n)
+		for c := range children {
+			data := make([]struct{ K, V []byte }, 0, keys/n)
+			for k := c; k < keys; k += n {
+				data = append(data, struct{ K, V []byte }{test.KeyOf(uint64(k)), test.ValueOf(uint64(k))})
+			}
+			children[c] = NewMockIterator(data)
+		}
+		iter := iterator.NewMergeIterator(children...)
+		b.Run(fmt.Sprintf("children=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for iter.SeekToFirst(); iter.IsValid(); iter.Next() {
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("children=%d/reverse", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for iter.SeekToLast(); iter.IsValid(); iter.Prev() {
+				}
+			}
+		})
+	}
 }
@@ -2,93 +2,195 @@ package iterator
 
 import (
 	"bytes"
-
-	"mini-lsm/pkg/utils"
+	"container/heap"
 )
 
 // MergeIterator can merge many iterators to one
 // all different key will remain
 // if there are same keys, will take iter which index is small
+// MergeIterator becomes invalid once any iterator fails, Err returns the error.
 type MergeIterator struct {
 	iterators []Iter
-	current   int
+	// heap holds valid iterators, its top is the iterator on the current key
+	heap mergeHeap
+	// key is the current key, it's copied before iterators move over it
+	key []byte
+	err error
+}
+
+// mergeHeap is a binary heap of iterators ordered by their keys, the smaller index wins ties,
+// its top is the iterator on the smallest key, or the largest key if reverse.
+type mergeHeap struct {
+	iterators []Iter
+	// indexes are indexes of valid iterators
+	indexes []int
+	reverse bool
+}
+
+var _ heap.Interface = (*mergeHeap)(nil)
+
+func (h *mergeHeap) Len() int {
+	return len(h.indexes)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.indexes[i], h.indexes[j]
+	cmp := bytes.Compare(h.iterators[a].Key(), h.iterators[b].Key())
+	if cmp == 0 {
+		return a < b
+	}
+	return cmp < 0 != h.reverse
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.indexes = append(h.indexes, x.(int))
+}
+
+func (h *mergeHeap) Pop() any {
+	last := h.indexes[len(h.indexes)-1]
+	h.indexes = h.indexes[:len(h.indexes)-1]
+	return last
 }
 
 // NewMergeIterator receives one or more iterators
-// return a MergeIterator
+// return a MergeIterator on the smallest key of them
 func NewMergeIterator(in ...Iter) *MergeIterator {
-	if len(in) == 0 {
-		return &MergeIterator{iterators: in, current: -1}
+	m := &MergeIterator{
+		iterators: in,
+		heap:      mergeHeap{iterators: in, indexes: make([]int, 0, len(in))},
 	}
+	m.rebuild(false)
+	return m
+}
 
-	iterators := make([]Iter, 0)
-	for i := range in {
-		if !in[i].IsValid() {
-			continue
+// rebuild builds the heap after all iterators are moved, in the direction of reverse
+func (m *MergeIterator) rebuild(reverse bool) {
+	m.heap.reverse, m.heap.indexes, m.err = reverse, m.heap.indexes[:0], nil
+	for i, iter := range m.iterators {
+		if iter.IsValid() {
+			m.heap.indexes = append(m.heap.indexes, i)
+		} else if m.err == nil {
+			m.err = iter.Err()
 		}
-		iterators = append(iterators, in[i])
-	}
-	if len(iterators) == 0 {
-		return &MergeIterator{iterators: iterators, current: -1}
 	}
-	return &MergeIterator{iterators: iterators, current: findMinimalIter(iterators)}
+	heap.Init(&m.heap)
 }
 
-func findMinimalIter(iterators []Iter) int {
-	// every iter is valid, we want to find the smallest key
-	min := 0
-	for i := 1; i < len(iterators); i++ {
-		if bytes.Compare(iterators[min].Key(), iterators[i].Key()) == 1 {
-			min = i
+// current returns the iterator on the current key, MergeIterator should be valid
+func (m *MergeIterator) current() Iter {
+	return m.iterators[m.heap.indexes[0]]
+}
+
+// skip moves every iterator on m.key forward, or backward if reverse, the heap is fixed after every move
+func (m *MergeIterator) skip(reverse bool) {
+	for m.err == nil && m.heap.Len() > 0 {
+		iter := m.current()
+		if !bytes.Equal(iter.Key(), m.key) {
+			return
+		}
+		if reverse {
+			iter.Prev()
+		} else {
+			iter.Next()
 		}
+		if iter.IsValid() {
+			heap.Fix(&m.heap, 0)
+			continue
+		}
+		m.err = iter.Err()
+		heap.Pop(&m.heap)
 	}
-	return min
 }
 
 func (m *MergeIterator) Key() []byte {
-	utils.Assertf(m.current < len(m.iterators),
-		"current iterator idx %d should less than length of iterators %d", m.current, len(m.iterators))
-	return m.iterators[m.current].Key()
+	if !m.IsValid() {
+		return nil
+	}
+	return m.current().Key()
 }
 
 func (m *MergeIterator) Value() []byte {
-	utils.Assertf(m.current < len(m.iterators),
-		"current iterator idx %d should less than length of iterators %d", m.current, len(m.iterators))
-	return m.iterators[m.current].Value()
+	if !m.IsValid() {
+		return nil
+	}
+	return m.current().Value()
 }
 
 func (m *MergeIterator) IsValid() bool {
-	return m.current >= 0 &&
-		m.current < len(m.iterators) &&
-		m.iterators[m.current].IsValid()
+	return m.err == nil && m.heap.Len() > 0
+}
+
+// Err returns the first error of iterators
+func (m *MergeIterator) Err() error {
+	return m.err
 }
 
 // Next should skip all same key in every ite
 func (m *MergeIterator) Next() {
-	currentKey := make([]byte, len(m.iterators[m.current].Key()))
-	copy(currentKey, m.iterators[m.current].Key())
-
-	// 1. move current iter to next
-	m.iterators[m.current].Next()
-	if !m.iterators[m.current].IsValid() {
-		m.iterators = append(m.iterators[:m.current], m.iterators[m.current+1:]...)
+	if !m.IsValid() {
+		return
 	}
-
-	// 2. remove all dup keys
-	for i := 0; i < len(m.iterators); i++ {
-		for m.iterators[i].IsValid() && bytes.Equal(m.iterators[i].Key(), currentKey) {
-			m.iterators[i].Next()
+	m.key = append(m.key[:0], m.current().Key()...)
+	if m.heap.reverse {
+		// other iterators are before the current key, move them to the first keys not less than it
+		current := m.heap.indexes[0]
+		for i, iter := range m.iterators {
+			if i != current {
+				iter.Seek(m.key)
+			}
 		}
+		m.rebuild(false)
 	}
+	m.skip(false)
+}
 
-	// 3. remove all invalid iter
-	i := len(m.iterators) - 1
-	for i >= 0 {
-		if !m.iterators[i].IsValid() {
-			m.iterators = append(m.iterators[:i], m.iterators[i+1:]...)
+// Prev should skip all same key in every iter as Next does
+func (m *MergeIterator) Prev() {
+	if !m.IsValid() {
+		return
+	}
+	m.key = append(m.key[:0], m.current().Key()...)
+	if !m.heap.reverse {
+		// other iterators are after the current key, move them to the last keys not greater than it
+		current := m.heap.indexes[0]
+		for i, iter := range m.iterators {
+			if i != current {
+				iter.SeekForPrev(m.key)
+			}
 		}
-		i--
+		m.rebuild(true)
 	}
+	m.skip(true)
+}
 
-	m.current = findMinimalIter(m.iterators)
+func (m *MergeIterator) Seek(key []byte) {
+	for _, iter := range m.iterators {
+		iter.Seek(key)
+	}
+	m.rebuild(false)
+}
+
+func (m *MergeIterator) SeekForPrev(key []byte) {
+	for _, iter := range m.iterators {
+		iter.SeekForPrev(key)
+	}
+	m.rebuild(true)
+}
+
+func (m *MergeIterator) SeekToFirst() {
+	for _, iter := range m.iterators {
+		iter.SeekToFirst()
+	}
+	m.rebuild(false)
+}
+
+func (m *MergeIterator) SeekToLast() {
+	for _, iter := range m.iterators {
+		iter.SeekToLast()
+	}
+	m.rebuild(true)
 }
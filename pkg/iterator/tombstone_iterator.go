@@ -0,0 +1,80 @@
+package iterator
+
+// IsTombstone checks whether value is a tombstone written by Delete.
+// Empty value is never accepted by Put, so it always stands for a deletion,
+// and it is kept as is when memtable is flushed to sst.
+func IsTombstone(value []byte) bool {
+	return len(value) == 0
+}
+
+// TombstoneFilter hides deleted keys from the Iter it holds.
+// The Iter should only return the newest version of every key, like MergeIterator does,
+// so that a tombstone shadows all older versions of its key.
+type TombstoneFilter struct {
+	iter Iter
+}
+
+func NewTombstoneFilter(iter Iter) *TombstoneFilter {
+	t := &TombstoneFilter{iter: iter}
+	t.skipTombstones(false)
+	return t
+}
+
+var _ Iter = (*TombstoneFilter)(nil)
+
+// skipTombstones skips deleted keys forward, or backward if reverse
+func (t *TombstoneFilter) skipTombstones(reverse bool) {
+	for t.iter.IsValid() && IsTombstone(t.iter.Value()) {
+		if reverse {
+			t.iter.Prev()
+		} else {
+			t.iter.Next()
+		}
+	}
+}
+
+func (t *TombstoneFilter) Key() []byte {
+	return t.iter.Key()
+}
+
+func (t *TombstoneFilter) Value() []byte {
+	return t.iter.Value()
+}
+
+func (t *TombstoneFilter) IsValid() bool {
+	return t.iter.IsValid()
+}
+
+func (t *TombstoneFilter) Err() error {
+	return t.iter.Err()
+}
+
+func (t *TombstoneFilter) Next() {
+	t.iter.Next()
+	t.skipTombstones(false)
+}
+
+func (t *TombstoneFilter) Prev() {
+	t.iter.Prev()
+	t.skipTombstones(true)
+}
+
+func (t *TombstoneFilter) Seek(key []byte) {
+	t.iter.Seek(key)
+	t.skipTombstones(false)
+}
+
+func (t *TombstoneFilter) SeekForPrev(key []byte) {
+	t.iter.SeekForPrev(key)
+	t.skipTombstones(true)
+}
+
+func (t *TombstoneFilter) SeekToFirst() {
+	t.iter.SeekToFirst()
+	t.skipTombstones(false)
+}
+
+func (t *TombstoneFilter) SeekToLast() {
+	t.iter.SeekToLast()
+	t.skipTombstones(true)
+}
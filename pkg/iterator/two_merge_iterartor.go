@@ -10,6 +10,8 @@ type TwoMergeIterator struct {
 	A       Iter
 	B       Iter
 	chooseA bool
+	// reverse is set when TwoMergeIterator moves backward, B is before A's key then
+	reverse bool
 }
 
 func NewTwoMerger(a, b Iter) *TwoMergeIterator {
@@ -26,13 +28,21 @@ func (t *TwoMergeIterator) ChooseA() bool {
 	if !t.B.IsValid() {
 		return true
 	}
+	if t.reverse {
+		return bytes.Compare(t.A.Key(), t.B.Key()) == 1
+	}
 	return bytes.Compare(t.A.Key(), t.B.Key()) == -1
 }
 
+// SkipB moves B over A's key, forward or backward as TwoMergeIterator moves
 func (t *TwoMergeIterator) SkipB() {
 	if t.A.IsValid() {
 		for t.B.IsValid() && bytes.Equal(t.B.Key(), t.A.Key()) {
-			t.B.Next()
+			if t.reverse {
+				t.B.Prev()
+			} else {
+				t.B.Next()
+			}
 		}
 	}
 }
@@ -54,13 +64,38 @@ func (t *TwoMergeIterator) Value() []byte {
 }
 
 func (t *TwoMergeIterator) IsValid() bool {
+	if t.Err() != nil {
+		return false
+	}
 	if t.chooseA {
 		return t.A.IsValid()
 	}
 	return t.B.IsValid()
 }
 
+// Err returns the error of A or B, TwoMergeIterator is invalid if any of them failed
+func (t *TwoMergeIterator) Err() error {
+	if err := t.A.Err(); err != nil {
+		return err
+	}
+	return t.B.Err()
+}
+
 func (t *TwoMergeIterator) Next() {
+	if !t.IsValid() {
+		return
+	}
+	if t.reverse {
+		// the other Iter is before the current key, move it to the first key after it
+		key := append([]byte{}, t.Key()...)
+		t.reverse = false
+		if t.chooseA {
+			t.B.Seek(key)
+			t.SkipB()
+		} else {
+			t.A.Seek(key)
+		}
+	}
 	if t.chooseA {
 		t.A.Next()
 	} else {
@@ -69,3 +104,58 @@ func (t *TwoMergeIterator) Next() {
 	t.SkipB()
 	t.chooseA = t.ChooseA()
 }
+
+func (t *TwoMergeIterator) Prev() {
+	if !t.IsValid() {
+		return
+	}
+	if !t.reverse {
+		// the other Iter is after the current key, move it to the last key before it
+		key := append([]byte{}, t.Key()...)
+		t.reverse = true
+		if t.chooseA {
+			t.B.SeekForPrev(key)
+			t.SkipB()
+		} else {
+			t.A.SeekForPrev(key)
+		}
+	}
+	if t.chooseA {
+		t.A.Prev()
+	} else {
+		t.B.Prev()
+	}
+	t.SkipB()
+	t.chooseA = t.ChooseA()
+}
+
+func (t *TwoMergeIterator) Seek(key []byte) {
+	t.A.Seek(key)
+	t.B.Seek(key)
+	t.reposition(false)
+}
+
+func (t *TwoMergeIterator) SeekForPrev(key []byte) {
+	t.A.SeekForPrev(key)
+	t.B.SeekForPrev(key)
+	t.reposition(true)
+}
+
+func (t *TwoMergeIterator) SeekToFirst() {
+	t.A.SeekToFirst()
+	t.B.SeekToFirst()
+	t.reposition(false)
+}
+
+func (t *TwoMergeIterator) SeekToLast() {
+	t.A.SeekToLast()
+	t.B.SeekToLast()
+	t.reposition(true)
+}
+
+// reposition chooses the current Iter after A and B are both seeked
+func (t *TwoMergeIterator) reposition(reverse bool) {
+	t.reverse = reverse
+	t.SkipB()
+	t.chooseA = t.ChooseA()
+}
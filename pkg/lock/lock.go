@@ -0,0 +1,102 @@
+package lock
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned by Lock if the lock is not released by its owner before timeout
+	ErrTimeout = errors.New("lock timeout")
+	// ErrDeadlock is returned by Lock if waiting for the lock would form a cycle of transactions
+	ErrDeadlock = errors.New("deadlock")
+)
+
+// Manager holds exclusive locks of keys for transactions identified by ids.
+// A transaction waits for a lock held by another one until it's released or timeout,
+// it fails at once with ErrDeadlock if the owner is waiting for it directly or indirectly.
+// Every transaction should wait for at most one lock at a time.
+type Manager struct {
+	mu    sync.Mutex
+	locks map[string]*entry
+	// waitFor is the wait-for graph, it maps a waiting transaction to the owner of the lock it waits for.
+	// An edge is added only if it doesn't form a cycle, so the graph is always acyclic.
+	waitFor map[uint64]uint64
+}
+
+type entry struct {
+	owner uint64
+	// released is closed when the lock is released, waiters wake up and try again
+	released chan struct{}
+}
+
+func NewManager() *Manager {
+	return &Manager{locks: make(map[string]*entry), waitFor: make(map[uint64]uint64)}
+}
+
+// Lock takes the lock of key for txnID, it returns at once if txnID holds it already.
+// If the lock is held by another transaction, Lock waits for it up to timeout,
+// non-positive timeout fails at once.
+func (m *Manager) Lock(txnID uint64, key []byte, timeout time.Duration) error {
+	var deadline <-chan time.Time
+	for {
+		m.mu.Lock()
+		e, ok := m.locks[string(key)]
+		if !ok {
+			m.locks[string(key)] = &entry{owner: txnID, released: make(chan struct{})}
+		}
+		if !ok || e.owner == txnID {
+			delete(m.waitFor, txnID)
+			m.mu.Unlock()
+			return nil
+		}
+		if timeout <= 0 {
+			m.mu.Unlock()
+			return ErrTimeout
+		}
+		if m.waitsFor(e.owner, txnID) {
+			delete(m.waitFor, txnID)
+			m.mu.Unlock()
+			return ErrDeadlock
+		}
+		m.waitFor[txnID] = e.owner
+		m.mu.Unlock()
+
+		if deadline == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-e.released:
+		case <-deadline:
+			m.mu.Lock()
+			delete(m.waitFor, txnID)
+			m.mu.Unlock()
+			return ErrTimeout
+		}
+	}
+}
+
+// waitsFor returns whether from waits for to directly or indirectly, it should be called with mu locked
+func (m *Manager) waitsFor(from, to uint64) bool {
+	for id, ok := from, true; ok; id, ok = m.waitFor[id] {
+		if id == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Unlock releases the lock of key if it's held by txnID
+func (m *Manager) Unlock(txnID uint64, key []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.locks[string(key)]
+	if !ok || e.owner != txnID {
+		return
+	}
+	delete(m.locks, string(key))
+	close(e.released)
+}
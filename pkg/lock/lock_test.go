@@ -0,0 +1,66 @@
+package lock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/lock"
+)
+
+func TestLock(t *testing.T) {
+	m := lock.NewManager()
+	a, b := []byte("a"), []byte("b")
+	assert.Nil(t, m.Lock(1, a, 0))
+	// locks are reentrant
+	assert.Nil(t, m.Lock(1, a, 0))
+	assert.Nil(t, m.Lock(2, b, 0))
+	assert.ErrorIs(t, m.Lock(2, a, 0), lock.ErrTimeout)
+	start := time.Now()
+	assert.ErrorIs(t, m.Lock(2, a, 20*time.Millisecond), lock.ErrTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// unlocking by others is ignored
+	m.Unlock(2, a)
+	assert.ErrorIs(t, m.Lock(2, a, 0), lock.ErrTimeout)
+
+	// waiter takes the lock once it's released
+	done := make(chan error)
+	go func() {
+		done <- m.Lock(2, a, time.Minute)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.Unlock(1, a)
+	assert.Nil(t, <-done)
+	assert.ErrorIs(t, m.Lock(1, a, 0), lock.ErrTimeout)
+	m.Unlock(2, a)
+	m.Unlock(2, b)
+	assert.Nil(t, m.Lock(1, a, 0))
+	assert.Nil(t, m.Lock(1, b, 0))
+}
+
+func TestDeadlock(t *testing.T) {
+	m := lock.NewManager()
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	for i, key := range keys {
+		assert.Nil(t, m.Lock(uint64(i), key, 0))
+	}
+	// 0 waits for 1, 1 waits for 2, then 2 waiting for 0 forms a cycle
+	errs := make([]chan error, 2)
+	for i := range errs {
+		errs[i] = make(chan error, 1)
+		go func(i int) {
+			errs[i] <- m.Lock(uint64(i), keys[i+1], time.Minute)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.ErrorIs(t, m.Lock(2, keys[0], time.Minute), lock.ErrDeadlock)
+
+	// the cycle is broken once 2 releases its lock
+	m.Unlock(2, keys[2])
+	assert.Nil(t, <-errs[1])
+	m.Unlock(1, keys[1])
+	m.Unlock(1, keys[2])
+	assert.Nil(t, <-errs[0])
+}
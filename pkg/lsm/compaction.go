@@ -0,0 +1,300 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"mini-lsm/pkg/compact"
+	"mini-lsm/pkg/iterator"
+	"mini-lsm/pkg/manifest"
+	"mini-lsm/pkg/mvcc"
+	"mini-lsm/pkg/sst"
+)
+
+func sortByFirstKey(tables []*sst.Table) {
+	sort.Slice(tables, func(i, j int) bool {
+		return bytes.Compare(tables[i].FirstKey(), tables[j].FirstKey()) < 0
+	})
+}
+
+// compactSSTs runs one task generated by compaction strategy,
+// it returns false if there is nothing to compact.
+func (si *StorageInner) compactSSTs() (bool, error) {
+	task := si.pickCompactionTask()
+	if task == nil {
+		return false, nil
+	}
+	defer si.finishCompactionTask(task)
+	logrus.WithField("inputs", len(task.Inputs)).
+		WithField("outputLevel", task.OutputLevel).
+		Infoln("start to compact ssts")
+
+	outputs, err := si.runCompactionTask(task)
+	if err != nil {
+		return false, err
+	}
+	if err = si.applyCompactionResult(task, outputs); err != nil {
+		for _, table := range outputs {
+			table.Close()
+			os.Remove(si.sstPath(table.SSTID()))
+		}
+		return false, err
+	}
+
+	for _, input := range task.Inputs {
+		for _, table := range input.Tables {
+			si.removeCompactedTable(table)
+		}
+	}
+	return true, nil
+}
+
+// pickCompactionTask returns the task generated by compaction strategy and marks its ssts as compacting,
+// the strategy skips ssts being compacted by running tasks, it returns nil if there is no other task.
+func (si *StorageInner) pickCompactionTask() *compact.Task {
+	si.compactionMu.Lock()
+	defer si.compactionMu.Unlock()
+	compacting := func(table *sst.Table) bool {
+		_, ok := si.compacting[table.SSTID()]
+		return ok
+	}
+	si.mu.RLock()
+	task := si.compactionStrategy.GenerateTask(si.l0SSTables, si.levels, compacting)
+	si.mu.RUnlock()
+	if task == nil {
+		return nil
+	}
+	for _, input := range task.Inputs {
+		for _, table := range input.Tables {
+			si.compacting[table.SSTID()] = struct{}{}
+		}
+	}
+	return task
+}
+
+func (si *StorageInner) finishCompactionTask(task *compact.Task) {
+	si.compactionMu.Lock()
+	defer si.compactionMu.Unlock()
+	for _, input := range task.Inputs {
+		for _, table := range input.Tables {
+			delete(si.compacting, table.SSTID())
+		}
+	}
+}
+
+// runCompactionTask merges all ssts in task, outputs are split by target file size unless they go to L0,
+// where every sst is a sorted run.
+// Only the newest version of every user key visible to each live snapshot and to the latest state is kept,
+// versions of a user key never span two outputs.
+// Tombstones are dropped only when there is no older data below the output level and no snapshot older than them,
+// otherwise they are still needed to shadow older versions.
+// Versions deleted by range tombstones in task are dropped unless a snapshot sees them,
+// range tombstones are clipped to the key range of every output, see keptRangeTombstones.
+func (si *StorageInner) runCompactionTask(task *compact.Task) ([]*sst.Table, error) {
+	// snapshots taken later see the newest versions in task only, like the latest state
+	snapshots := si.snapshotSeqs()
+	// stripe returns the index of the oldest snapshot seeing a version at seq, len(snapshots) if there is none,
+	// versions of a user key in the same stripe are seen by the same snapshots, only the newest one is needed.
+	stripe := func(seq uint64) int {
+		return sort.Search(len(snapshots), func(i int) bool { return snapshots[i] >= seq })
+	}
+
+	var rangeTombstones mvcc.RangeTombstones
+	for _, input := range task.Inputs {
+		for _, table := range input.Tables {
+			rangeTombstones = append(rangeTombstones, table.RangeTombstones()...)
+		}
+	}
+	kept := si.keptRangeTombstones(task, rangeTombstones, stripe)
+	// deletedByRange returns whether a range tombstone deletes the version at seq and no snapshot sees the version
+	deletedByRange := func(userKey []byte, seq uint64) bool {
+		for _, t := range rangeTombstones {
+			if t.Seq > seq && stripe(t.Seq) == stripe(seq) && t.Contains(userKey) {
+				return true
+			}
+		}
+		return false
+	}
+
+	iterators := make([]iterator.Iter, 0)
+	for _, input := range task.Inputs {
+		if input.Level != 0 {
+			iterators = append(iterators, sst.NewConcatIterAndSeekToFirst(input.Tables))
+			continue
+		}
+		for _, table := range input.Tables {
+			iterators = append(iterators, sst.NewIterAndSeekToFirst(table))
+		}
+	}
+	iter := iterator.NewMergeIterator(iterators...)
+
+	targetFileSize := int64(si.compactionStrategy.TargetFileSizeBytes())
+	outputs := make([]*sst.Table, 0)
+	builder := si.newTableBuilder(task.OutputLevel)
+	// splitKey is the user key where the current output starts, nil for the first output
+	var splitKey []byte
+	// build builds the current output, which ends before user key end, nil end is unbounded
+	build := func(end []byte) error {
+		for _, t := range kept {
+			if splitKey != nil && bytes.Compare(t.Start, splitKey) < 0 {
+				t.Start = splitKey
+			}
+			if end != nil && bytes.Compare(t.End, end) > 0 {
+				t.End = end
+			}
+			if bytes.Compare(t.Start, t.End) < 0 {
+				builder.AddRangeTombstone(t)
+			}
+		}
+		splitKey = end
+		if builder.IsEmpty() {
+			return nil
+		}
+		sstID := si.allocateSSTID()
+		table, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, table)
+		builder = si.newTableBuilder(task.OutputLevel)
+		return nil
+	}
+	// outputs are removed if compaction fails, a corrupted sst should fail the compaction instead of losing data
+	fail := func(err error) ([]*sst.Table, error) {
+		for _, table := range outputs {
+			table.Close()
+			os.Remove(si.sstPath(table.SSTID()))
+		}
+		return nil, err
+	}
+	// lastKey is the internal key of the last version visited, lastStripe is its stripe
+	var lastKey []byte
+	var lastStripe int
+	for iter.IsValid() {
+		key := iter.Key()
+		userKey, seq, _, err := mvcc.ParseKey(key)
+		if err != nil {
+			return fail(err)
+		}
+		newUserKey := lastKey == nil || !mvcc.SameUserKey(key, lastKey)
+		if !newUserKey && stripe(seq) == lastStripe {
+			iter.Next()
+			continue
+		}
+		lastKey, lastStripe = append(lastKey[:0], key...), stripe(seq)
+		if task.IsBottomLevel && lastStripe == 0 && iterator.IsTombstone(iter.Value()) || deletedByRange(userKey, seq) {
+			iter.Next()
+			continue
+		}
+		if newUserKey && task.OutputLevel != 0 && builder.EstimatedSize() >= targetFileSize {
+			if err := build(append([]byte{}, userKey...)); err != nil {
+				return fail(err)
+			}
+		}
+		builder.AddByte(key, iter.Value())
+		iter.Next()
+	}
+	if err := iter.Err(); err != nil {
+		return fail(err)
+	}
+	if err := build(nil); err != nil {
+		return fail(err)
+	}
+	return outputs, nil
+}
+
+// keptRangeTombstones returns range tombstones which should be written to outputs of task,
+// a range tombstone is dropped if no snapshot is older than it and no sst out of task may have keys it deletes,
+// versions deleted by it in task are dropped by compaction. Memtables only have newer versions than ssts.
+func (si *StorageInner) keptRangeTombstones(task *compact.Task, tombstones mvcc.RangeTombstones, stripe func(uint64) int) mvcc.RangeTombstones {
+	if len(tombstones) == 0 {
+		return nil
+	}
+	inTask := make(map[uint32]struct{})
+	for _, input := range task.Inputs {
+		for _, table := range input.Tables {
+			inTask[table.SSTID()] = struct{}{}
+		}
+	}
+	si.mu.RLock()
+	others := make([]*sst.Table, 0)
+	for _, table := range si.currentView().tables() {
+		if _, ok := inTask[table.SSTID()]; !ok {
+			others = append(others, table)
+		}
+	}
+	si.mu.RUnlock()
+
+	kept := make(mvcc.RangeTombstones, 0, len(tombstones))
+	for _, t := range tombstones {
+		droppable := stripe(t.Seq) == 0
+		for _, table := range others {
+			if !droppable {
+				break
+			}
+			droppable = !t.Overlaps(mvcc.UserKey(table.FirstKey()), mvcc.UserKey(table.LastKey()))
+		}
+		if !droppable {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// applyCompactionResult replaces ssts in task with outputs, the change is recorded in manifest first
+func (si *StorageInner) applyCompactionResult(task *compact.Task, outputs []*sst.Table) error {
+	record := manifest.Record{}
+	removed := make(map[uint32]struct{})
+	for _, input := range task.Inputs {
+		for _, table := range input.Tables {
+			record.Removed = append(record.Removed, manifest.TableRecord{Level: input.Level, ID: table.SSTID()})
+			removed[table.SSTID()] = struct{}{}
+		}
+	}
+	for _, table := range outputs {
+		record.Added = append(record.Added, manifest.TableRecord{Level: task.OutputLevel, ID: table.SSTID()})
+	}
+	record.NextSSTID = atomic.LoadUint32(&si.nextSSTID)
+	record.LastSeq = si.LastSeq()
+
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	defer si.updateWriteStall()
+	if err := si.manifest.AddRecord(record); err != nil {
+		return err
+	}
+	// replaceRemoved removes compacted ssts from tables, outputs take the place of the first removed one
+	replaceRemoved := func(tables []*sst.Table, outputs []*sst.Table) []*sst.Table {
+		remain := make([]*sst.Table, 0, len(tables)+len(outputs))
+		for _, table := range tables {
+			if _, ok := removed[table.SSTID()]; !ok {
+				remain = append(remain, table)
+			} else if outputs != nil {
+				remain = append(remain, outputs...)
+				outputs = nil
+			}
+		}
+		return append(remain, outputs...)
+	}
+	for _, input := range task.Inputs {
+		switch input.Level {
+		case task.OutputLevel:
+		case 0:
+			si.l0SSTables = replaceRemoved(si.l0SSTables, nil)
+		default:
+			si.levels[input.Level-1] = replaceRemoved(si.levels[input.Level-1], nil)
+		}
+	}
+	if task.OutputLevel == 0 {
+		si.l0SSTables = replaceRemoved(si.l0SSTables, outputs)
+		return nil
+	}
+	lower := replaceRemoved(si.levels[task.OutputLevel-1], outputs)
+	sortByFirstKey(lower)
+	si.levels[task.OutputLevel-1] = lower
+	return nil
+}
@@ -0,0 +1,45 @@
+package lsm
+
+import (
+	"errors"
+
+	"mini-lsm/pkg/lock"
+	"mini-lsm/pkg/sst"
+	"mini-lsm/pkg/wal"
+)
+
+const (
+	// MaxKeySize is the max size of a key, a key-value pair of max sizes still fits in a block and a wal record
+	MaxKeySize = 1 << 28
+	// MaxValueSize is the max size of a value
+	MaxValueSize = 1 << 31
+)
+
+var (
+	// ErrEmptyKey is returned if key is empty
+	ErrEmptyKey = errors.New("key cannot be empty")
+	// ErrEmptyValue is returned by Put if value is empty, empty value is the tombstone of Delete
+	ErrEmptyValue = errors.New("value cannot be empty")
+	// ErrKeyTooLarge is returned if key is larger than MaxKeySize
+	ErrKeyTooLarge = errors.New("key is too large")
+	// ErrValueTooLarge is returned by Put if value is larger than MaxValueSize
+	ErrValueTooLarge = errors.New("value is too large")
+	// ErrBatchTooLarge is returned by Write if the encoded batch can't be logged as one wal record
+	ErrBatchTooLarge = wal.ErrRecordTooLarge
+	// ErrCorruption matches every error caused by corrupted data, check it by errors.Is
+	ErrCorruption = sst.ErrCorruption
+	// ErrClosed is returned by operations on a closed Storage
+	ErrClosed = errors.New("storage is closed")
+	// ErrInvalidRange is returned by DeleteRange if start is not less than end
+	ErrInvalidRange = errors.New("start of range should be less than end")
+	// ErrSnapshotReleased is returned by reads at a released Snapshot
+	ErrSnapshotReleased = errors.New("snapshot is released")
+	// ErrConflict is returned by Commit of Txn if a key read by Txn was written by others after Txn began
+	ErrConflict = errors.New("transaction conflict")
+	// ErrTxnDone is returned by operations on a committed or rolled back Txn
+	ErrTxnDone = errors.New("transaction is done")
+	// ErrLockTimeout is returned by pessimistic Txn if a key is locked by another Txn until timeout
+	ErrLockTimeout = lock.ErrTimeout
+	// ErrDeadlock is returned by pessimistic Txn if waiting for a lock would form a cycle of Txns
+	ErrDeadlock = lock.ErrDeadlock
+)
@@ -0,0 +1,205 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"mini-lsm/pkg/block"
+	"mini-lsm/pkg/compact"
+)
+
+// ErrInvalidOptions is returned by NewStorage if Options can't be used
+var ErrInvalidOptions = errors.New("invalid options")
+
+// Options configures Storage, zero value of every field means its default in DefaultOptions
+type Options struct {
+	// MemTableSize is the estimated size at which the active memtable is frozen and a new one is created
+	MemTableSize int64
+	// BlockSize is the max size of blocks in ssts
+	BlockSize uint32
+	// BloomBitsPerKey is bits per key of bloom filters in ssts, negative value disables bloom filters
+	BloomBitsPerKey int
+	// BlockCacheSize is the capacity of block cache in bytes
+	BlockCacheSize int64
+	// CompressionPerLevel compresses ssts written to every level, see SetCompressionPerLevel
+	CompressionPerLevel []block.Compressor
+
+	// Level0FileNumCompactionTrigger is the number of L0 ssts which triggers L0->L1 compaction
+	Level0FileNumCompactionTrigger int
+	// MaxLevels is the number of levels below L0
+	MaxLevels int
+	// BaseLevelSizeBytes is the target size of L1
+	BaseLevelSizeBytes uint64
+	// LevelSizeMultiplier is the size ratio between target sizes of Li+1 and Li
+	LevelSizeMultiplier uint64
+	// TargetFileSizeBytes is the size at which compaction output is split into another sst
+	TargetFileSizeBytes uint64
+	// CompactionStrategy overrides the leveled strategy configured by the options above
+	CompactionStrategy compact.Strategy
+
+	// BackgroundRetryInterval is the interval to retry background flush and compaction after they failed
+	BackgroundRetryInterval time.Duration
+	// MaxBackgroundCompactions is the number of compactions running concurrently
+	MaxBackgroundCompactions int
+	// DisableAutoCompactions stops compacting in background, ssts are only compacted when it's called explicitly,
+	// writes are never stalled by L0 ssts or pending compaction bytes then.
+	DisableAutoCompactions bool
+
+	// writes are delayed by WriteSlowdownDelay once any slowdown trigger is reached,
+	// and blocked until flushes or compactions catch up once any stop trigger is reached.
+
+	// MemTableSlowdownWritesTrigger is the number of immutable memtables which slows down writes
+	MemTableSlowdownWritesTrigger int
+	// MemTableStopWritesTrigger is the number of immutable memtables which stops writes
+	MemTableStopWritesTrigger int
+	// Level0SlowdownWritesTrigger is the number of L0 ssts which slows down writes
+	Level0SlowdownWritesTrigger int
+	// Level0StopWritesTrigger is the number of L0 ssts which stops writes
+	Level0StopWritesTrigger int
+	// SoftPendingCompactionBytesLimit is the estimated pending compaction bytes which slows down writes
+	SoftPendingCompactionBytesLimit uint64
+	// HardPendingCompactionBytesLimit is the estimated pending compaction bytes which stops writes
+	HardPendingCompactionBytesLimit uint64
+	// WriteSlowdownDelay is the delay of every write when writes are slowed down
+	WriteSlowdownDelay time.Duration
+}
+
+// DefaultOptions returns Options whose fields are used as defaults of zero fields
+func DefaultOptions() Options {
+	leveled := compact.DefaultLeveledOptions()
+	return Options{
+		MemTableSize:                    4 << 20,
+		BlockSize:                       4096,
+		BloomBitsPerKey:                 10,
+		BlockCacheSize:                  64 << 20,
+		Level0FileNumCompactionTrigger:  leveled.Level0FileNumCompactionTrigger,
+		MaxLevels:                       leveled.MaxLevels,
+		BaseLevelSizeBytes:              leveled.BaseLevelSizeBytes,
+		LevelSizeMultiplier:             leveled.LevelSizeMultiplier,
+		TargetFileSizeBytes:             leveled.TargetFileSizeBytes,
+		BackgroundRetryInterval:         time.Second,
+		MaxBackgroundCompactions:        1,
+		MemTableSlowdownWritesTrigger:   3,
+		MemTableStopWritesTrigger:       5,
+		Level0SlowdownWritesTrigger:     20,
+		Level0StopWritesTrigger:         36,
+		SoftPendingCompactionBytesLimit: 64 << 30,
+		HardPendingCompactionBytesLimit: 256 << 30,
+		WriteSlowdownDelay:              time.Millisecond,
+	}
+}
+
+// sanitize fills zero fields with defaults, then validates opts
+func (opts Options) sanitize() (Options, error) {
+	defaults := DefaultOptions()
+	if opts.MemTableSize == 0 {
+		opts.MemTableSize = defaults.MemTableSize
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = defaults.BlockSize
+	}
+	if opts.BloomBitsPerKey == 0 {
+		opts.BloomBitsPerKey = defaults.BloomBitsPerKey
+	}
+	if opts.BlockCacheSize == 0 {
+		opts.BlockCacheSize = defaults.BlockCacheSize
+	}
+	if opts.Level0FileNumCompactionTrigger == 0 {
+		opts.Level0FileNumCompactionTrigger = defaults.Level0FileNumCompactionTrigger
+	}
+	if opts.MaxLevels == 0 {
+		opts.MaxLevels = defaults.MaxLevels
+	}
+	if opts.BaseLevelSizeBytes == 0 {
+		opts.BaseLevelSizeBytes = defaults.BaseLevelSizeBytes
+	}
+	if opts.LevelSizeMultiplier == 0 {
+		opts.LevelSizeMultiplier = defaults.LevelSizeMultiplier
+	}
+	if opts.TargetFileSizeBytes == 0 {
+		opts.TargetFileSizeBytes = defaults.TargetFileSizeBytes
+	}
+	if opts.BackgroundRetryInterval == 0 {
+		opts.BackgroundRetryInterval = defaults.BackgroundRetryInterval
+	}
+	if opts.MaxBackgroundCompactions == 0 {
+		opts.MaxBackgroundCompactions = defaults.MaxBackgroundCompactions
+	}
+	if opts.MemTableSlowdownWritesTrigger == 0 {
+		opts.MemTableSlowdownWritesTrigger = defaults.MemTableSlowdownWritesTrigger
+	}
+	if opts.MemTableStopWritesTrigger == 0 {
+		opts.MemTableStopWritesTrigger = defaults.MemTableStopWritesTrigger
+	}
+	if opts.Level0SlowdownWritesTrigger == 0 {
+		opts.Level0SlowdownWritesTrigger = defaults.Level0SlowdownWritesTrigger
+	}
+	if opts.Level0StopWritesTrigger == 0 {
+		opts.Level0StopWritesTrigger = defaults.Level0StopWritesTrigger
+	}
+	if opts.SoftPendingCompactionBytesLimit == 0 {
+		opts.SoftPendingCompactionBytesLimit = defaults.SoftPendingCompactionBytesLimit
+	}
+	if opts.HardPendingCompactionBytesLimit == 0 {
+		opts.HardPendingCompactionBytesLimit = defaults.HardPendingCompactionBytesLimit
+	}
+	if opts.WriteSlowdownDelay == 0 {
+		opts.WriteSlowdownDelay = defaults.WriteSlowdownDelay
+	}
+	if err := opts.Validate(); err != nil {
+		return Options{}, err
+	}
+	if opts.CompactionStrategy == nil {
+		opts.CompactionStrategy = compact.NewLeveled(compact.LeveledOptions{
+			Level0FileNumCompactionTrigger: opts.Level0FileNumCompactionTrigger,
+			MaxLevels:                      opts.MaxLevels,
+			BaseLevelSizeBytes:             opts.BaseLevelSizeBytes,
+			LevelSizeMultiplier:            opts.LevelSizeMultiplier,
+			TargetFileSizeBytes:            opts.TargetFileSizeBytes,
+		})
+	}
+	return opts, nil
+}
+
+// Validate returns an error matching ErrInvalidOptions if any field is out of range,
+// zero fields are valid since they are replaced by defaults.
+func (opts Options) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case opts.MemTableSize < 0:
+		return invalid("MemTableSize %d should be positive", opts.MemTableSize)
+	case opts.BlockCacheSize < 0:
+		return invalid("BlockCacheSize %d should be positive", opts.BlockCacheSize)
+	case opts.Level0FileNumCompactionTrigger < 0:
+		return invalid("Level0FileNumCompactionTrigger %d should be positive", opts.Level0FileNumCompactionTrigger)
+	case opts.MaxLevels < 0:
+		return invalid("MaxLevels %d should be positive", opts.MaxLevels)
+	case opts.LevelSizeMultiplier == 1:
+		return invalid("LevelSizeMultiplier should be greater than 1")
+	case opts.BackgroundRetryInterval < 0:
+		return invalid("BackgroundRetryInterval %s should be positive", opts.BackgroundRetryInterval)
+	case opts.MaxBackgroundCompactions < 0:
+		return invalid("MaxBackgroundCompactions %d should be positive", opts.MaxBackgroundCompactions)
+	case opts.MemTableSlowdownWritesTrigger < 0 || opts.MemTableStopWritesTrigger < 0:
+		return invalid("MemTableSlowdownWritesTrigger and MemTableStopWritesTrigger should be positive")
+	case opts.Level0SlowdownWritesTrigger < 0 || opts.Level0StopWritesTrigger < 0:
+		return invalid("Level0SlowdownWritesTrigger and Level0StopWritesTrigger should be positive")
+	case opts.MemTableStopWritesTrigger != 0 && opts.MemTableSlowdownWritesTrigger > opts.MemTableStopWritesTrigger:
+		return invalid("MemTableSlowdownWritesTrigger %d should not be greater than MemTableStopWritesTrigger %d",
+			opts.MemTableSlowdownWritesTrigger, opts.MemTableStopWritesTrigger)
+	case opts.Level0StopWritesTrigger != 0 && opts.Level0SlowdownWritesTrigger > opts.Level0StopWritesTrigger:
+		return invalid("Level0SlowdownWritesTrigger %d should not be greater than Level0StopWritesTrigger %d",
+			opts.Level0SlowdownWritesTrigger, opts.Level0StopWritesTrigger)
+	case opts.HardPendingCompactionBytesLimit != 0 && opts.SoftPendingCompactionBytesLimit > opts.HardPendingCompactionBytesLimit:
+		return invalid("SoftPendingCompactionBytesLimit %d should not be greater than HardPendingCompactionBytesLimit %d",
+			opts.SoftPendingCompactionBytesLimit, opts.HardPendingCompactionBytesLimit)
+	case opts.WriteSlowdownDelay < 0:
+		return invalid("WriteSlowdownDelay %s should be positive", opts.WriteSlowdownDelay)
+	case opts.CompactionStrategy != nil && opts.CompactionStrategy.MaxLevels() < 1:
+		return invalid("MaxLevels of CompactionStrategy %d should be positive", opts.CompactionStrategy.MaxLevels())
+	}
+	return nil
+}
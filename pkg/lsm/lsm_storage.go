@@ -2,22 +2,30 @@ package lsm
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
-	"mini-lsm/pkg/utils"
-
 	"mini-lsm/pkg/block"
+	"mini-lsm/pkg/cache"
+	"mini-lsm/pkg/compact"
 	"mini-lsm/pkg/iterator"
+	"mini-lsm/pkg/lock"
+	"mini-lsm/pkg/manifest"
 	"mini-lsm/pkg/memtable"
+	"mini-lsm/pkg/mvcc"
 	"mini-lsm/pkg/sst"
+	"mini-lsm/pkg/wal"
 )
 
 type StorageInner struct {
@@ -25,102 +33,851 @@ type StorageInner struct {
 	// wLocker should be lock on every action modified the following struct
 	mu sync.RWMutex
 
-	memtKeyCount int64
-	memtSize     int64
-	memt         *memtable.Table
+	memtSize int64
+	memt     *memtable.Table
+
+	// lastSeq is the sequence number of the latest write visible to readers,
+	// writeMu serializes writes so that lastSeq is published in order after a write is applied.
+	lastSeq uint64
+	writeMu sync.Mutex
 
+	// immMemt is ordered from the newest to the oldest
 	immMemt    []*memtable.Table
 	l0SSTables []*sst.Table
-	levels     [][]*sst.Table
+	// levels[i] is Li+1, every level is sorted by key and has no overlapping key range
+	levels [][]*sst.Table
 
 	nextSSTID  uint32
 	path       string
-	blockCache *sync.Map
+	blockCache *cache.Cache[sst.BlockCacheKey, *block.Block]
+
+	// manifest records every change of l0SSTables and levels
+	manifest *manifest.Manifest
+
+	opts Options
+	// compactionStrategy is called by compactSSTs to pick ssts to compact
+	compactionStrategy compact.Strategy
+	// compacting holds ids of ssts being compacted, compactionMu guards it,
+	// compaction strategy doesn't pick them for another task.
+	compactionMu sync.Mutex
+	compacting   map[uint32]struct{}
+
+	// snapshots are live snapshots, pinned counts snapshots pinning every sst,
+	// obsolete holds compacted ssts which are removed once they are unpinned, snapshotMu guards them.
+	snapshotMu sync.Mutex
+	snapshots  map[*Snapshot]struct{}
+	pinned     map[uint32]int
+	obsolete   map[uint32]*sst.Table
+
+	// locks holds keys locked by pessimistic Txns, nextTxnID allocates ids of Txns
+	locks     *lock.Manager
+	nextTxnID uint64
+
+	// compressionPerLevel is a []block.Compressor, see SetCompressionPerLevel
+	compressionPerLevel atomic.Value
+
+	// bloomFilterHits counts ssts skipped on Get because their bloom filter rules out the key,
+	// bloomFilterMisses counts ssts read on Get because their bloom filter may contain the key
+	bloomFilterHits   uint64
+	bloomFilterMisses uint64
+
+	// writeStall is guarded by stallMu, writes blocked by WriteStallStop wait on stallCond
+	stallMu    sync.Mutex
+	stallCond  *sync.Cond
+	writeStall WriteStall
+	// pendingCompactionBytes is estimated by compaction strategy when write stall is updated
+	pendingCompactionBytes uint64
+	// delayedWrites and stoppedWrites count writes slowed down and stopped by write stall
+	delayedWrites uint64
+	stoppedWrites uint64
+
+	// closed is set by Close under the write lock of mu, operations check it under the read lock
+	closed bool
+	// flushCh wakes up the flush task, compactCh wakes up compaction tasks
+	flushCh   chan struct{}
+	compactCh chan struct{}
+	// closeCh stops background tasks, loopDone is closed after all of them return
+	closeCh  chan struct{}
+	loopDone chan struct{}
 }
 
-func (si *StorageInner) Get(key []byte) []byte {
+// SetCompressionPerLevel sets compressors of ssts written later, compressors[i] compresses ssts written to Li,
+// the last one is used by levels deeper than len(compressors), nil compressor means no compression.
+// e.g. []block.Compressor{nil, block.NewFlateCompressor(flate.BestCompression)} compresses ssts except L0.
+func (si *StorageInner) SetCompressionPerLevel(compressors []block.Compressor) {
+	si.compressionPerLevel.Store(append([]block.Compressor{}, compressors...))
+}
+
+// newTableBuilder returns a TableBuilder for ssts written to level
+func (si *StorageInner) newTableBuilder(level int) *sst.TableBuilder {
+	opts := sst.TableBuilderOptions{BlockSize: si.opts.BlockSize, BloomBitsPerKey: si.opts.BloomBitsPerKey}
+	if compressors, _ := si.compressionPerLevel.Load().([]block.Compressor); len(compressors) != 0 {
+		if level >= len(compressors) {
+			level = len(compressors) - 1
+		}
+		opts.Compressor = compressors[level]
+	}
+	return sst.NewTableBuilderWithOptions(opts)
+}
+
+// Stats is a snapshot of counters of StorageInner
+type Stats struct {
+	BloomFilterHits   uint64
+	BloomFilterMisses uint64
+	BlockCache        cache.Stats
+
+	// WriteStall is the current write stall condition
+	WriteStall             WriteStall
+	PendingCompactionBytes uint64
+	DelayedWrites          uint64
+	StoppedWrites          uint64
+}
+
+func (si *StorageInner) Stats() Stats {
+	si.stallMu.Lock()
+	writeStall := si.writeStall
+	si.stallMu.Unlock()
+	return Stats{
+		BloomFilterHits:        atomic.LoadUint64(&si.bloomFilterHits),
+		BloomFilterMisses:      atomic.LoadUint64(&si.bloomFilterMisses),
+		BlockCache:             si.blockCache.Stats(),
+		WriteStall:             writeStall,
+		PendingCompactionBytes: atomic.LoadUint64(&si.pendingCompactionBytes),
+		DelayedWrites:          atomic.LoadUint64(&si.delayedWrites),
+		StoppedWrites:          atomic.LoadUint64(&si.stoppedWrites),
+	}
+}
+
+const (
+	manifestFileName = "MANIFEST"
+
+	blockCacheShards = 16
+)
+
+// LastSeq returns the sequence number of the latest write
+func (si *StorageInner) LastSeq() uint64 {
+	return atomic.LoadUint64(&si.lastSeq)
+}
+
+// ReadOptions configures Get and Scan
+type ReadOptions struct {
+	// Snapshot reads the state when Snapshot was taken, nil reads the latest state
+	Snapshot *Snapshot
+	// Bounds limit user keys read by ScanWithOptions, nil bound is unbounded, Get ignores them.
+	// ssts out of Bounds are not read.
+	iterator.Bounds
+}
+
+// view is the memtables and ssts a read goes through
+type view struct {
+	memt       *memtable.Table
+	immMemt    []*memtable.Table
+	l0SSTables []*sst.Table
+	levels     [][]*sst.Table
+}
+
+// currentView returns the memtables and ssts of si, it should be called with mu locked
+func (si *StorageInner) currentView() view {
+	return view{memt: si.memt, immMemt: si.immMemt, l0SSTables: si.l0SSTables, levels: si.levels}
+}
+
+// coveringSeq returns the largest seq of range tombstones in v visible at seq which contain key, 0 if there is none
+func (v view) coveringSeq(key []byte, seq uint64) uint64 {
+	covering := v.memt.RangeTombstones().CoveringSeq(key, seq)
+	for _, mt := range v.immMemt {
+		if s := mt.RangeTombstones().CoveringSeq(key, seq); s > covering {
+			covering = s
+		}
+	}
+	for _, table := range v.tables() {
+		if s := table.RangeTombstones().CoveringSeq(key, seq); s > covering {
+			covering = s
+		}
+	}
+	return covering
+}
+
+// rangeTombstones returns range tombstones in v which overlap [lower, upper], nil upper is unbounded
+func (v view) rangeTombstones(lower, upper []byte) mvcc.RangeTombstones {
+	var tombstones mvcc.RangeTombstones
+	add := func(ts mvcc.RangeTombstones) {
+		for _, t := range ts {
+			if t.Overlaps(lower, upper) {
+				tombstones = append(tombstones, t)
+			}
+		}
+	}
+	add(v.memt.RangeTombstones())
+	for _, mt := range v.immMemt {
+		add(mt.RangeTombstones())
+	}
+	for _, table := range v.tables() {
+		add(table.RangeTombstones())
+	}
+	return tombstones
+}
+
+// readView returns the view and seq to read at by opts, it should be called with mu locked
+func (si *StorageInner) readView(opts ReadOptions) (view, uint64, error) {
+	if si.closed {
+		return view{}, 0, ErrClosed
+	}
+	if opts.Snapshot == nil {
+		return si.currentView(), si.LastSeq(), nil
+	}
+	if opts.Snapshot.isReleased() {
+		return view{}, 0, ErrSnapshotReleased
+	}
+	return opts.Snapshot.view, opts.Snapshot.seq, nil
+}
+
+// Get reads key at the latest state, see GetWithOptions
+func (si *StorageInner) Get(key []byte) ([]byte, error) {
+	return si.GetWithOptions(key, ReadOptions{})
+}
+
+// GetWithOptions returns nil value and nil error if key is not found or has been deleted,
+// an error matching ErrCorruption is returned if an sst is corrupted.
+func (si *StorageInner) GetWithOptions(key []byte, opts ReadOptions) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	ver, found, err := si.get(key, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !found || iterator.IsTombstone(ver.value) {
+		return nil, nil
+	}
+	return ver.value, nil
+}
+
+// version is the version of a key found by get, its value may be a tombstone
+type version struct {
+	value []byte
+	seq   uint64
+}
+
+// get returns the newest version of key visible to opts
+func (si *StorageInner) get(key []byte, opts ReadOptions) (version, bool, error) {
 	si.mu.RLock()
 	defer si.mu.RUnlock()
-	val := si.memt.Get(key)
-	if val != nil {
-		return val
+	v, seq, err := si.readView(opts)
+	if err != nil {
+		return version{}, false, err
+	}
+	return si.getFromView(v, key, seq)
+}
+
+// getFromView returns the newest version of key visible at seq in v, it may be a tombstone,
+// a version deleted by a range tombstone is returned as a tombstone at the seq of the range tombstone.
+// It should be called with mu locked.
+func (si *StorageInner) getFromView(v view, key []byte, seq uint64) (version, bool, error) {
+	ver, found, err := si.findVersion(v, key, seq)
+	if err != nil {
+		return version{}, false, err
+	}
+	if covering := v.coveringSeq(key, seq); covering > 0 && (!found || ver.seq < covering) {
+		return version{value: []byte{}, seq: covering}, true, nil
 	}
-	for _, mt := range si.immMemt {
-		if val := mt.Get(key); val != nil {
-			return val
+	return ver, found, nil
+}
+
+// findVersion returns the newest version of key visible at seq in v regardless of range tombstones,
+// so it stops at the first memtable or sst which contains key.
+func (si *StorageInner) findVersion(v view, key []byte, seq uint64) (version, bool, error) {
+	if val, verSeq, found := v.memt.GetVersion(key, seq); found {
+		return version{value: val, seq: verSeq}, true, nil
+	}
+	for _, mt := range v.immMemt {
+		if val, verSeq, found := mt.GetVersion(key, seq); found {
+			return version{value: val, seq: verSeq}, true, nil
+		}
+	}
+	seekKey := mvcc.SeekKey(key, seq)
+	// ssts in L0 are ordered from the newest to the oldest
+	for _, table := range v.l0SSTables {
+		if ver, found, err := si.getFromTable(table, key, seekKey); err != nil || found {
+			return ver, found, err
 		}
 	}
-	iterators := make([]iterator.Iter, 0, len(si.l0SSTables))
-	for t := range si.l0SSTables {
-		iterators = append(iterators, sst.NewIterAndSeekToKey(si.l0SSTables[t], key))
+	for _, level := range v.levels {
+		// the first table which may contain seekKey
+		idx := sort.Search(len(level), func(i int) bool {
+			return !level[i].EndsBefore(seekKey)
+		})
+		if idx == len(level) || mvcc.CompareUserKey(level[idx].FirstKey(), seekKey) > 0 {
+			continue
+		}
+		if ver, found, err := si.getFromTable(level[idx], key, seekKey); err != nil || found {
+			return ver, found, err
+		}
+	}
+	return version{}, false, nil
+}
+
+// getFromTable returns the first version of key not less than seekKey in table
+func (si *StorageInner) getFromTable(table *sst.Table, key, seekKey []byte) (version, bool, error) {
+	if !table.MayContain(key) {
+		atomic.AddUint64(&si.bloomFilterHits, 1)
+		return version{}, false, nil
+	}
+	atomic.AddUint64(&si.bloomFilterMisses, 1)
+	iter := sst.NewIterAndSeekToKey(table, seekKey)
+	if err := iter.Err(); err != nil {
+		return version{}, false, err
+	}
+	if !iter.IsValid() || !mvcc.SameUserKey(iter.Key(), seekKey) {
+		return version{}, false, nil
+	}
+	_, seq, _, err := mvcc.ParseKey(iter.Key())
+	if err != nil {
+		return version{}, false, err
 	}
-	iter := iterator.NewMergeIterator(iterators...)
-	if iter.IsValid() && bytes.Equal(iter.Key(), key) {
-		return iter.Value()
+	return version{value: iter.Value(), seq: seq}, true, nil
+}
+
+// checkKey returns ErrEmptyKey or ErrKeyTooLarge if key can't be written
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
 	}
 	return nil
 }
 
-func (si *StorageInner) Put(key, value []byte) {
-	utils.Assert(len(value) != 0, "value cannot be empty")
-	utils.Assert(len(key) != 0, "key cannot be empty")
+// checkValue returns ErrEmptyValue or ErrValueTooLarge if value can't be put
+func checkValue(value []byte) error {
+	if len(value) == 0 {
+		return ErrEmptyValue
+	}
+	if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
 
-	estimateSize := block.SizeOfUint16*2 + uint16(len(key)) + uint16(len(value)) + block.SizeOfUint16
-	si.mu.RLock()
-	si.memt.Put(key, value)
-	atomic.AddInt64(&si.memtKeyCount, 1)
-	atomic.AddInt64(&si.memtSize, int64(estimateSize))
-	si.mu.RUnlock()
+func (si *StorageInner) Put(key, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := checkValue(value); err != nil {
+		return err
+	}
+	b := NewWriteBatch()
+	b.Put(key, value)
+	return si.write(b, WriteOptions{}, nil)
 }
 
-func (si *StorageInner) Delete(key []byte) {
-	utils.Assert(len(key) != 0, "key cannot be empty")
-	si.mu.RLock()
-	si.memt.Put(key, nil)
-	si.mu.RUnlock()
+// Delete writes a tombstone of key, which shadows all older versions of key
+func (si *StorageInner) Delete(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	b := NewWriteBatch()
+	b.Delete(key)
+	return si.write(b, WriteOptions{}, nil)
 }
 
-func (si *StorageInner) Scan(lower, upper []byte) iterator.Iter {
+// DeleteRange deletes all keys in [start, end) by a range tombstone,
+// ErrInvalidRange is returned if start is not less than end.
+func (si *StorageInner) DeleteRange(start, end []byte) error {
+	if err := checkKey(start); err != nil {
+		return err
+	}
+	if len(end) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	b := NewWriteBatch()
+	b.DeleteRange(start, end)
+	return si.write(b, WriteOptions{}, nil)
+}
+
+// Scan reads keys in [lower, upper] at the latest state, see ScanWithOptions
+func (si *StorageInner) Scan(lower, upper []byte) (*Iterator, error) {
+	return si.ScanWithOptions(ReadOptions{Bounds: iterator.Bounds{Lower: lower, Upper: upper}})
+}
+
+// Iterator is returned by Scan, it pins ssts it reads so they are not removed by compaction until Close
+type Iterator struct {
+	iterator.Iter
+	si *StorageInner
+	// tables are pinned by Iterator, they are nil if Iterator reads at a Snapshot, which pins them instead
+	tables []*sst.Table
+	closed bool
+}
+
+// Close unpins ssts read by Iterator, Iterator should not be used after Close.
+// Every Iterator should be closed once it's not needed, Close can be called more than once.
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	if len(it.tables) == 0 {
+		return
+	}
+	it.si.snapshotMu.Lock()
+	defer it.si.snapshotMu.Unlock()
+	it.si.unpinTables(it.tables)
+}
+
+// ScanWithOptions returns an Iterator of keys in the Bounds of opts visible to opts, deleted keys are skipped.
+// Iterator is on the first key, it moves in both directions and seeks in the bounds.
+// Errors met during iterating make Iterator invalid, check them by Err of Iterator.
+// Iterator should not be used after Close of Storage, reading ssts of a closed Storage fails.
+func (si *StorageInner) ScanWithOptions(opts ReadOptions) (*Iterator, error) {
 	si.mu.RLock()
 	defer si.mu.RUnlock()
-	var iterators = make([]iterator.Iter, 0, 1+len(si.immMemt)+len(si.l0SSTables))
-	iterators = append(iterators, si.memt.Scan(lower, upper))
-	for _, mt := range si.immMemt {
-		iterators = append(iterators, mt.Scan(lower, upper))
+	v, seq, err := si.readView(opts)
+	if err != nil {
+		return nil, err
+	}
+	bounds := mvcc.InternalBounds(opts.Bounds)
+	var tables []*sst.Table
+	var iterators = make([]iterator.Iter, 0, 1+len(v.immMemt)+len(v.l0SSTables)+len(v.levels))
+	iterators = append(iterators, v.memt.Scan(opts.Lower, opts.Upper))
+	for _, mt := range v.immMemt {
+		iterators = append(iterators, mt.Scan(opts.Lower, opts.Upper))
+	}
+	for _, table := range v.l0SSTables {
+		if !tableInBounds(table, bounds) {
+			continue
+		}
+		tables = append(tables, table)
+		if bounds.Lower == nil {
+			iterators = append(iterators, sst.NewIterAndSeekToFirst(table))
+		} else {
+			iterators = append(iterators, sst.NewIterAndSeekToKey(table, bounds.Lower))
+		}
+	}
+	for _, level := range v.levels {
+		level = levelInBounds(level, bounds)
+		if len(level) == 0 {
+			continue
+		}
+		tables = append(tables, level...)
+		if bounds.Lower == nil {
+			iterators = append(iterators, sst.NewConcatIterAndSeekToFirst(level))
+		} else {
+			iterators = append(iterators, sst.NewConcatIterAndSeekToKey(level, bounds.Lower))
+		}
 	}
-	for t := range si.l0SSTables {
-		iterators = append(iterators, sst.NewIterAndSeekToKey(si.l0SSTables[t], lower))
+	// versions out of bounds are never read by mvcc.Iterator
+	merged := iterator.NewBoundedIter(iterator.NewMergeIterator(iterators...), bounds)
+	iter := mvcc.NewIteratorWithRangeTombstones(merged, seq, v.rangeTombstones(opts.Lower, opts.Upper))
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	it := &Iterator{Iter: iter, si: si}
+	if opts.Snapshot == nil {
+		// compaction replaces ssts with mu locked, so tables are still live here
+		it.tables = tables
+		si.snapshotMu.Lock()
+		si.pinTables(tables)
+		si.snapshotMu.Unlock()
+	}
+	return it, nil
+}
+
+// tableInBounds returns whether the key range of table overlaps bounds of internal keys
+func tableInBounds(table *sst.Table, bounds iterator.Bounds) bool {
+	return bounds.BelowUpper(table.FirstKey()) && bounds.AboveLower(table.LastKey())
+}
+
+// levelInBounds returns tables of level whose key ranges overlap bounds of internal keys
+func levelInBounds(level []*sst.Table, bounds iterator.Bounds) []*sst.Table {
+	lo := sort.Search(len(level), func(i int) bool { return bounds.AboveLower(level[i].LastKey()) })
+	hi := sort.Search(len(level), func(i int) bool { return !bounds.BelowUpper(level[i].FirstKey()) })
+	if lo >= hi {
+		return nil
+	}
+	return level[lo:hi]
+}
+
+// ReverseScan reads keys in [lower, upper] at the latest state backward, see ReverseScanWithOptions
+func (si *StorageInner) ReverseScan(lower, upper []byte) (*Iterator, error) {
+	return si.ReverseScanWithOptions(ReadOptions{Bounds: iterator.Bounds{Lower: lower, Upper: upper}})
+}
+
+// ReverseScanWithOptions is like ScanWithOptions, but Iterator is on the last key, move it by Prev to read keys in descending order
+func (si *StorageInner) ReverseScanWithOptions(opts ReadOptions) (*Iterator, error) {
+	iter, err := si.ScanWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	iter.SeekToLast()
+	if err := iter.Err(); err != nil {
+		iter.Close()
+		return nil, err
+	}
+	return iter, nil
+}
+
+// addMemtSize adds size written to the active memtable, the flush task is notified once it's full
+func (si *StorageInner) addMemtSize(size int64) {
+	if atomic.AddInt64(&si.memtSize, size) > si.opts.MemTableSize {
+		notify(si.flushCh)
 	}
-	return iterator.NewMergeIterator(iterators...)
 }
 
 func (si *StorageInner) checkIfNewMemTableShouldBeCreate() bool {
-	return atomic.LoadInt64(&si.memtKeyCount) > 1000 || atomic.LoadInt64(&si.memtSize) > 4096*10
+	return atomic.LoadInt64(&si.memtSize) > si.opts.MemTableSize
 }
 
-func (si *StorageInner) newMemTable() {
+func (si *StorageInner) newMemTable() error {
+	id := si.allocateSSTID()
+	memt, err := memtable.NewTableWithWal(id, si.walPath(id))
+	if err != nil {
+		return err
+	}
 	si.mu.Lock()
-	si.memt, si.immMemt = memtable.NewTable(), append(si.immMemt, si.memt)
-	atomic.SwapInt64(&si.memtKeyCount, 0)
+	si.memt, si.immMemt = memt, append([]*memtable.Table{si.memt}, si.immMemt...)
 	atomic.SwapInt64(&si.memtSize, 0)
+	si.updateWriteStall()
 	si.mu.Unlock()
+	return nil
+}
+
+// allocateSSTID returns an unused id, memtable shares id with the sst it will be flushed to
+func (si *StorageInner) allocateSSTID() uint32 {
+	return atomic.AddUint32(&si.nextSSTID, 1) - 1
 }
 
 func (si *StorageInner) sstPath(id uint32) string {
 	return filepath.Join(si.path, fmt.Sprintf("%d.sst", id))
 }
 
+func (si *StorageInner) walPath(id uint32) string {
+	return filepath.Join(si.path, fmt.Sprintf("%d.wal", id))
+}
+
+func (si *StorageInner) manifestPath() string {
+	return filepath.Join(si.path, manifestFileName)
+}
+
+// listFileIDs returns ids of all files named like "<id><suffix>" in path
+func (si *StorageInner) listFileIDs(suffix string) ([]uint32, error) {
+	entries, err := os.ReadDir(si.path)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint32, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// recoverSSTables replays the manifest and opens every sst recorded in it,
+// ssts which are not recorded in manifest are left by an unfinished flush or compaction, they are removed.
+// If manifest has no record, ssts in path were written before manifest was introduced, they are adopted instead.
+func (si *StorageInner) recoverSSTables() error {
+	m, records, err := manifest.Recover(si.manifestPath())
+	if os.IsNotExist(err) {
+		m, err = manifest.Create(si.manifestPath())
+	}
+	if err != nil {
+		return err
+	}
+	si.manifest = m
+	if len(records) == 0 {
+		return si.adoptSSTables()
+	}
+
+	levels := make([][]uint32, 1)
+	for _, record := range records {
+		levels = record.Apply(levels)
+		if record.NextSSTID > si.nextSSTID {
+			si.nextSSTID = record.NextSSTID
+		}
+		if record.LastSeq > si.lastSeq {
+			si.lastSeq = record.LastSeq
+		}
+	}
+
+	live := make(map[uint32]struct{})
+	openLevel := func(ids []uint32) ([]*sst.Table, error) {
+		tables := make([]*sst.Table, 0, len(ids))
+		for _, id := range ids {
+			fd, err := os.Open(si.sstPath(id))
+			if err != nil {
+				return nil, err
+			}
+			table, err := sst.OpenTableFromFile(id, si.blockCache, fd)
+			if err != nil {
+				fd.Close()
+				return nil, err
+			}
+			tables = append(tables, table)
+			live[id] = struct{}{}
+		}
+		return tables, nil
+	}
+	if si.l0SSTables, err = openLevel(levels[0]); err != nil {
+		return err
+	}
+	for i, ids := range levels[1:] {
+		tables, err := openLevel(ids)
+		if err != nil {
+			return err
+		}
+		sortByFirstKey(tables)
+		if i < len(si.levels) {
+			si.levels[i] = tables
+		} else {
+			si.levels = append(si.levels, tables)
+		}
+	}
+
+	ids, err := si.listFileIDs(".sst")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id >= si.nextSSTID {
+			si.nextSSTID = id + 1
+		}
+		if _, ok := live[id]; ok {
+			continue
+		}
+		logrus.WithField("sstID", id).Warnln("remove sst which is not recorded in manifest")
+		if err = os.Remove(si.sstPath(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adoptSSTables opens every sst in path into L0 from the newest to the oldest by id, and records them in manifest.
+// It's called when manifest has no record, nothing is removed then.
+func (si *StorageInner) adoptSSTables() error {
+	ids, err := si.listFileIDs(".sst")
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	record := manifest.Record{NextSSTID: ids[0] + 1}
+	for _, id := range ids {
+		fd, err := os.Open(si.sstPath(id))
+		if err != nil {
+			return err
+		}
+		table, err := sst.OpenTableFromFile(id, si.blockCache, fd)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+		si.l0SSTables = append(si.l0SSTables, table)
+		record.Added = append(record.Added, manifest.TableRecord{Level: 0, ID: id})
+		seq, err := maxSeqOf(table)
+		if err != nil {
+			return err
+		}
+		if seq > record.LastSeq {
+			record.LastSeq = seq
+		}
+	}
+	if record.NextSSTID > si.nextSSTID {
+		si.nextSSTID = record.NextSSTID
+	}
+	if record.LastSeq > si.lastSeq {
+		si.lastSeq = record.LastSeq
+	}
+	logrus.WithField("count", len(ids)).Warnln("adopt ssts which are not recorded in manifest into L0")
+	return si.manifest.AddRecord(record)
+}
+
+// maxSeqOf returns the largest seq of versions and range tombstones in table, ssts don't record it
+func maxSeqOf(table *sst.Table) (uint64, error) {
+	var maxSeq uint64
+	for _, t := range table.RangeTombstones() {
+		if t.Seq > maxSeq {
+			maxSeq = t.Seq
+		}
+	}
+	iter := sst.NewIterAndSeekToFirst(table)
+	for ; iter.IsValid(); iter.Next() {
+		_, seq, _, err := mvcc.ParseKey(iter.Key())
+		if err != nil {
+			return 0, err
+		}
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	return maxSeq, iter.Err()
+}
+
+// rewriteLegacySSTables rewrites ssts storing user keys into internal keys, from the oldest to the newest.
+// Versions in such an sst are all read at seq 0, so a deletion in a newer one can't shadow a put in an older one,
+// every rewritten sst takes the next seq, which orders it by age as writes would.
+// Every sst is replaced by one manifest record, a crash leaves older ones rewritten and the rest legacy,
+// which are rewritten on the next open with larger seqs.
+func (si *StorageInner) rewriteLegacySSTables() error {
+	type legacyTable struct {
+		level int
+		idx   int
+	}
+	// deeper levels are older, ssts in L0 are ordered from the newest to the oldest
+	var legacy []legacyTable
+	for level := len(si.levels); level > 0; level-- {
+		for idx, table := range si.levels[level-1] {
+			if !table.HasInternalKeys() {
+				legacy = append(legacy, legacyTable{level: level, idx: idx})
+			}
+		}
+	}
+	for idx := len(si.l0SSTables) - 1; idx >= 0; idx-- {
+		if !si.l0SSTables[idx].HasInternalKeys() {
+			legacy = append(legacy, legacyTable{level: 0, idx: idx})
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	// ids of wal segments are not recorded in manifest, new ssts must not take them
+	ids, err := si.listFileIDs(".wal")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id >= si.nextSSTID {
+			si.nextSSTID = id + 1
+		}
+	}
+	for _, l := range legacy {
+		tables := si.l0SSTables
+		if l.level > 0 {
+			tables = si.levels[l.level-1]
+		}
+		old := tables[l.idx]
+		seq := si.lastSeq + 1
+		builder := si.newTableBuilder(l.level)
+		iter := sst.NewIterAndSeekToFirst(old)
+		for ; iter.IsValid(); iter.Next() {
+			userKey, _, kind, err := mvcc.ParseKey(iter.Key())
+			if err != nil {
+				return err
+			}
+			builder.AddByte(mvcc.MakeKey(userKey, seq, kind), iter.Value())
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		id := si.allocateSSTID()
+		table, err := builder.Build(id, si.blockCache, si.sstPath(id))
+		if err != nil {
+			return err
+		}
+		err = si.manifest.AddRecord(manifest.Record{
+			Removed:   []manifest.TableRecord{{Level: l.level, ID: old.SSTID()}},
+			Added:     []manifest.TableRecord{{Level: l.level, ID: id}},
+			NextSSTID: atomic.LoadUint32(&si.nextSSTID),
+			LastSeq:   seq,
+		})
+		if err != nil {
+			table.Close()
+			return err
+		}
+		tables[l.idx] = table
+		si.lastSeq = seq
+		if err = old.Close(); err != nil {
+			return err
+		}
+		if err = os.Remove(si.sstPath(old.SSTID())); err != nil {
+			return err
+		}
+	}
+	logrus.WithField("count", len(legacy)).Warnln("rewrite ssts storing user keys into internal keys")
+	return nil
+}
+
+// recoverMemTables replays every wal segment left in path,
+// recovered memtables are added to immMemt and flushed later.
+// Wal segment whose memtable has been flushed to sst is removed.
+func (si *StorageInner) recoverMemTables() error {
+	ids, err := si.listFileIDs(".wal")
+	if err != nil {
+		return err
+	}
+	flushed := make(map[uint32]struct{})
+	for _, table := range si.l0SSTables {
+		flushed[table.SSTID()] = struct{}{}
+	}
+	for _, level := range si.levels {
+		for _, table := range level {
+			flushed[table.SSTID()] = struct{}{}
+		}
+	}
+	// from the oldest to the newest, so that writes without seqs in older segments take smaller seqs
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if id >= si.nextSSTID {
+			si.nextSSTID = id + 1
+		}
+		if _, ok := flushed[id]; ok {
+			if err = os.Remove(si.walPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		memt, err := memtable.RecoverFromWal(id, si.walPath(id), si.lastSeq)
+		if errors.Is(err, wal.ErrCorruption) {
+			return fmt.Errorf("%w: wal %d: %s", ErrCorruption, id, err)
+		}
+		if err != nil {
+			return err
+		}
+		if seq := memt.MaxSeq(); seq > si.lastSeq {
+			si.lastSeq = seq
+		}
+		// immMemt is ordered from the newest to the oldest
+		si.immMemt = append([]*memtable.Table{memt}, si.immMemt...)
+	}
+	return nil
+}
+
 func (si *StorageInner) checkIfImMemTableShouldFlushToSST() bool {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
 	return len(si.immMemt) > 0
 }
 
+// sinkImMemTableToSST flushes the oldest immutable memtable to sst,
+// its wal segment is removed once the sst is durable.
 func (si *StorageInner) sinkImMemTableToSST() error {
-	sstID := si.nextSSTID
 	si.mu.Lock()
 	defer si.mu.Unlock()
+	defer si.updateWriteStall()
 
+	if len(si.immMemt) == 0 {
+		return nil
+	}
 	flushMemTable := si.immMemt[len(si.immMemt)-1]
-	builder := sst.NewTableBuilder(4096)
+	sstID := flushMemTable.ID()
+	if flushMemTable.IsEmpty() {
+		// nothing to flush, just drop the memtable with its wal segment
+		si.immMemt = si.immMemt[:len(si.immMemt)-1]
+		if err := flushMemTable.CloseWal(); err != nil {
+			return err
+		}
+		return os.Remove(si.walPath(sstID))
+	}
+	builder := si.newTableBuilder(0)
 	flushMemTable.Flush(builder)
 
 	sstTable, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
@@ -128,91 +885,243 @@ func (si *StorageInner) sinkImMemTableToSST() error {
 		return err
 	}
 
+	err = si.manifest.AddRecord(manifest.Record{
+		Added:     []manifest.TableRecord{{Level: 0, ID: sstID}},
+		NextSSTID: atomic.LoadUint32(&si.nextSSTID),
+		LastSeq:   si.LastSeq(),
+	})
+	if err != nil {
+		return err
+	}
 	si.immMemt = si.immMemt[:len(si.immMemt)-1]
 	si.l0SSTables = append([]*sst.Table{sstTable}, si.l0SSTables...)
-	si.nextSSTID += 1
-	return nil
+
+	if err = flushMemTable.CloseWal(); err != nil {
+		return err
+	}
+	return os.Remove(si.walPath(sstID))
 }
 
-func (si *StorageInner) checkIfSSTShouldBeCompact() bool {
-	return len(si.l0SSTables) >= 2
-}
-func (si *StorageInner) compactSSTs() {
-	log.Printf("compact with l0SSTables: %d", len(si.l0SSTables))
-	if len(si.l0SSTables) >= 2 {
-		si.mu.RLock()
-		l0SSTableLength := len(si.l0SSTables)
-		sn := si.l0SSTables[l0SSTableLength-1]
-		snID := sn.SSTID()
-		snm1 := si.l0SSTables[l0SSTableLength-2]
-		snm1ID := snm1.SSTID()
-		si.mu.RUnlock()
-
-		snIter := sst.NewIterAndSeekToFirst(sn)
-		snm1Iter := sst.NewIterAndSeekToFirst(snm1)
-		mergeIter := iterator.NewTwoMerger(snm1Iter, snIter)
-		builder := sst.NewTableBuilder(4096)
-		for mergeIter.IsValid() {
-			builder.AddByte(mergeIter.Key(), mergeIter.Value())
-			mergeIter.Next()
-		}
-		sstID := si.nextSSTID
-		sstTable, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
-		if err != nil {
-			log.Printf("sstable build fail: %s", err)
-			return
-		}
-		si.nextSSTID += 1
-		defer func() {
-			snm1.Close()
-			sn.Close()
-			os.Remove(si.sstPath(snID))
-			os.Remove(si.sstPath(snm1ID))
+// notify wakes up the background task waiting on ch, it never blocks
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// startBackgroundTasks starts the flush task and MaxBackgroundCompactions compaction tasks unless DisableAutoCompactions,
+// they run when they are notified by flushCh and compactCh until closeCh is closed.
+// A failed task is retried after BackgroundRetryInterval.
+func (si *StorageInner) startBackgroundTasks() {
+	var wg sync.WaitGroup
+	run := func(wake <-chan struct{}, task func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var retry <-chan time.Time
+			for {
+				select {
+				case <-si.closeCh:
+					return
+				case <-wake:
+				case <-retry:
+				}
+				retry = nil
+				if err := task(); err != nil {
+					retry = time.After(si.opts.BackgroundRetryInterval)
+				}
+			}
 		}()
-		si.mu.Lock()
-		if si.l0SSTables[l0SSTableLength-1].SSTID() == snID &&
-			si.l0SSTables[l0SSTableLength-2].SSTID() == snm1ID {
-			si.l0SSTables = append(si.l0SSTables[:l0SSTableLength-2], sstTable)
+	}
+	run(si.flushCh, si.flushTask)
+	for i := 0; i < si.opts.MaxBackgroundCompactions && !si.opts.DisableAutoCompactions; i++ {
+		run(si.compactCh, si.compactionTask)
+	}
+	go func() {
+		wg.Wait()
+		close(si.loopDone)
+	}()
+	// memtables recovered from wal and ssts left by the last run may be waiting
+	notify(si.flushCh)
+	notify(si.compactCh)
+}
+
+// flushTask freezes the active memtable if it's full, then flushes all immutable memtables,
+// compaction tasks are notified after every flush.
+func (si *StorageInner) flushTask() error {
+	if si.checkIfNewMemTableShouldBeCreate() {
+		logrus.Infoln("create new memtable")
+		if err := si.newMemTable(); err != nil {
+			logrus.WithError(err).Errorln("newMemTable error")
+			return err
 		}
-		si.mu.Unlock()
 	}
+
+	for si.checkIfImMemTableShouldFlushToSST() {
+		logrus.Infoln("start to sink immutable memtable to sst")
+		if err := si.sinkImMemTableToSST(); err != nil {
+			logrus.WithError(err).Errorln("sinkImMemTableToSST error")
+			return err
+		}
+		notify(si.compactCh)
+	}
+	return nil
 }
 
-func (si *StorageInner) internalLoopTask() {
-	ticker := time.NewTicker(5 * time.Second)
-	for range ticker.C {
-		if si.checkIfNewMemTableShouldBeCreate() {
-			logrus.Infoln("create new memtable")
-			si.newMemTable()
+// compactionTask compacts until there is nothing to compact,
+// other compaction tasks are notified after every compaction to pick tasks which can run in parallel.
+func (si *StorageInner) compactionTask() error {
+	for {
+		compacted, err := si.compactSSTs()
+		if err != nil {
+			logrus.WithError(err).Errorln("compactSSTs error")
+			return err
+		}
+		if !compacted {
+			return nil
 		}
+		notify(si.compactCh)
+	}
+}
 
-		if si.checkIfImMemTableShouldFlushToSST() {
-			logrus.Infoln("start to sink immutable memtable to sst")
-			err := si.sinkImMemTableToSST()
-			if err != nil {
-				logrus.WithError(err).Errorln("sinkImMemTableToSST error")
+// CloseOptions configures CloseWithOptions
+type CloseOptions struct {
+	// FlushMemTables flushes all memtables to ssts before closing,
+	// otherwise they are recovered from their wal segments on the next open.
+	FlushMemTables bool
+}
+
+// Close closes storage without flushing memtables, see CloseWithOptions
+func (si *StorageInner) Close(ctx context.Context) error {
+	return si.CloseWithOptions(ctx, CloseOptions{})
+}
+
+// CloseWithOptions stops background work, syncs wal segments and closes all files,
+// operations after Close return ErrClosed.
+// If ctx is done before background work stops, ctx.Err() is returned and files are closed once it stops.
+func (si *StorageInner) CloseWithOptions(ctx context.Context, opts CloseOptions) error {
+	si.mu.Lock()
+	if si.closed {
+		si.mu.Unlock()
+		return ErrClosed
+	}
+	si.closed = true
+	// writes blocked by write stall are woken up to return ErrClosed
+	si.updateWriteStall()
+	si.mu.Unlock()
+
+	close(si.closeCh)
+	select {
+	case <-si.loopDone:
+	case <-ctx.Done():
+		go func() {
+			<-si.loopDone
+			if err := si.release(); err != nil {
+				logrus.WithError(err).Errorln("release storage error")
 			}
+		}()
+		return ctx.Err()
+	}
+
+	var flushErr error
+	if opts.FlushMemTables {
+		flushErr = si.flushMemTables(ctx)
+	}
+	return errors.Join(flushErr, si.release())
+}
+
+// flushMemTables flushes the active memtable and all immutable memtables to ssts,
+// it stops when ctx is done, memtables left are recovered from wal on the next open.
+func (si *StorageInner) flushMemTables(ctx context.Context) error {
+	si.mu.Lock()
+	si.memt, si.immMemt = memtable.NewTable(), append([]*memtable.Table{si.memt}, si.immMemt...)
+	si.mu.Unlock()
+	for si.checkIfImMemTableShouldFlushToSST() {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		if err := si.sinkImMemTableToSST(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		if si.checkIfSSTShouldBeCompact() {
-			// now compact has problem
-			si.compactSSTs()
+// release syncs and closes wal segments, then closes ssts and manifest
+func (si *StorageInner) release() error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	errs := make([]error, 0)
+	for _, memt := range append([]*memtable.Table{si.memt}, si.immMemt...) {
+		errs = append(errs, memt.SyncWal(), memt.CloseWal())
+	}
+	for _, table := range si.l0SSTables {
+		errs = append(errs, table.Close())
+	}
+	for _, level := range si.levels {
+		for _, table := range level {
+			errs = append(errs, table.Close())
 		}
 	}
+	si.closeObsoleteTables()
+	errs = append(errs, si.manifest.Close())
+	return errors.Join(errs...)
 }
 
-func NewStorageInner(path string) *StorageInner {
+// NewStorageInner opens storage on path, ssts are reopened as the manifest recorded,
+// memtables which were not flushed before last exit are recovered from their wal segments.
+func NewStorageInner(path string, opts Options) (*StorageInner, error) {
+	opts, err := opts.sanitize()
+	if err != nil {
+		return nil, err
+	}
+	strategy := opts.CompactionStrategy
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
 	si := &StorageInner{
-		memt:       memtable.NewTable(),
-		immMemt:    make([]*memtable.Table, 0),
-		l0SSTables: make([]*sst.Table, 0),
-		levels:     make([][]*sst.Table, 0),
-		nextSSTID:  1,
-		path:       path,
-		blockCache: &sync.Map{},
+		immMemt:            make([]*memtable.Table, 0),
+		l0SSTables:         make([]*sst.Table, 0),
+		levels:             make([][]*sst.Table, strategy.MaxLevels()),
+		nextSSTID:          1,
+		path:               path,
+		blockCache:         cache.New[sst.BlockCacheKey, *block.Block](opts.BlockCacheSize, blockCacheShards, sst.BlockCacheKey.Hash),
+		opts:               opts,
+		compactionStrategy: strategy,
+		compacting:         make(map[uint32]struct{}),
+		snapshots:          make(map[*Snapshot]struct{}),
+		pinned:             make(map[uint32]int),
+		obsolete:           make(map[uint32]*sst.Table),
+		locks:              lock.NewManager(),
+		flushCh:            make(chan struct{}, 1),
+		compactCh:          make(chan struct{}, 1),
+		closeCh:            make(chan struct{}),
+		loopDone:           make(chan struct{}),
+	}
+	si.stallCond = sync.NewCond(&si.stallMu)
+	if opts.CompressionPerLevel != nil {
+		si.SetCompressionPerLevel(opts.CompressionPerLevel)
+	}
+	if err := si.recoverSSTables(); err != nil {
+		return nil, err
+	}
+	// legacy ssts take seqs before writes recovered from wal
+	if err := si.rewriteLegacySSTables(); err != nil {
+		return nil, err
+	}
+	if err := si.recoverMemTables(); err != nil {
+		return nil, err
 	}
-	go si.internalLoopTask()
-	return si
+	id := si.allocateSSTID()
+	memt, err := memtable.NewTableWithWal(id, si.walPath(id))
+	if err != nil {
+		return nil, err
+	}
+	si.memt = memt
+	si.updateWriteStall()
+	si.startBackgroundTasks()
+	return si, nil
 }
 
 type Storage struct {
@@ -220,8 +1129,14 @@ type Storage struct {
 	*StorageInner
 }
 
-func NewStorage(path string) *Storage {
-	return &Storage{
-		StorageInner: NewStorageInner(path),
+// NewStorage opens storage on path configured by opts,
+// zero fields of opts are filled by DefaultOptions, an error matching ErrInvalidOptions is returned if opts is invalid.
+func NewStorage(path string, opts Options) (*Storage, error) {
+	inner, err := NewStorageInner(path, opts)
+	if err != nil {
+		return nil, err
 	}
+	return &Storage{
+		StorageInner: inner,
+	}, nil
 }
@@ -2,226 +2,1761 @@ package lsm
 
 import (
 	"bytes"
-	"fmt"
-	"log"
+	"compress/flate"
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"testing"
 	"time"
 
-	"github.com/sirupsen/logrus"
-
-	"mini-lsm/pkg/utils"
+	"github.com/stretchr/testify/assert"
 
 	"mini-lsm/pkg/block"
+	"mini-lsm/pkg/compact"
 	"mini-lsm/pkg/iterator"
-	"mini-lsm/pkg/memtable"
+	"mini-lsm/pkg/mvcc"
 	"mini-lsm/pkg/sst"
+	"mini-lsm/pkg/test"
+	"mini-lsm/pkg/wal"
 )
 
-type StorageInner struct {
-	// mu is rw lock, rLocker should be lock on every action not modified the following struct
-	// wLocker should be lock on every action modified the following struct
-	mu sync.RWMutex
+// closeOnCleanup closes storage when t finishes, it's fine if t has closed storage
+func closeOnCleanup(t *testing.T, storage *Storage) {
+	if storage == nil {
+		return
+	}
+	t.Cleanup(func() { storage.Close(context.Background()) })
+}
 
-	memtKeyCount int64
-	memtSize     int64
-	memt         *memtable.Table
+// mustGet returns the value of key, it fails t if Get returns an error
+func mustGet(t *testing.T, storage *Storage, key []byte) []byte {
+	value, err := storage.Get(key)
+	assert.Nil(t, err)
+	return value
+}
 
-	immMemt    []*memtable.Table
-	l0SSTables []*sst.Table
-	levels     [][]*sst.Table
+func TestStorageGetPutDelete(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	for i := uint64(0); i < 100; i++ {
+		assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
+	}
+	assert.Nil(t, storage.Delete(test.KeyOf(0)))
+	assert.Nil(t, mustGet(t, storage, test.KeyOf(0)))
+}
 
-	nextSSTID  uint32
-	path       string
-	blockCache *sync.Map
+func TestStorageLargeValue(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	largeValue := bytes.Repeat([]byte("v"), 1<<17)
+	for i := uint64(0); i < 10; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), largeValue))
+	}
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	assert.Len(t, storage.l0SSTables, 1)
+	for i := uint64(0); i < 10; i++ {
+		assert.Equal(t, largeValue, mustGet(t, storage, test.KeyOf(i)))
+	}
 }
 
-func (si *StorageInner) Get(key []byte) []byte {
-	si.mu.RLock()
-	defer si.mu.RUnlock()
-	val := si.memt.Get(key)
-	if val != nil {
-		return val
+func TestStorageRecoverFromWal(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for i := uint64(0); i < 50; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
 	}
-	for _, mt := range si.immMemt {
-		if val := mt.Get(key); val != nil {
-			return val
+	assert.Nil(t, storage.newMemTable())
+	for i := uint64(50); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, storage.Put(test.KeyOf(0), test.ValueOf(1000)))
+	assert.Nil(t, storage.Close(context.Background()))
+
+	// reopen without flushing, memtables are recovered from wal
+	recovered, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, recovered)
+	check := func() {
+		assert.Equal(t, test.ValueOf(1000), mustGet(t, recovered, test.KeyOf(0)))
+		for i := uint64(1); i < 100; i++ {
+			assert.Equal(t, test.ValueOf(i), mustGet(t, recovered, test.KeyOf(i)))
 		}
 	}
-	iterators := make([]iterator.Iter, 0, len(si.l0SSTables))
-	for t := range si.l0SSTables {
-		iterators = append(iterators, sst.NewIterAndSeekToKey(si.l0SSTables[t], key))
+	check()
+	// recovered memtables are flushed by the flush task
+	waitFlushed(t, recovered, 2)
+	check()
+}
+
+// waitFlushed waits until all immutable memtables of storage are flushed and there are l0 ssts in L0
+func waitFlushed(t *testing.T, storage *Storage, l0 int) {
+	assert.Eventually(t, func() bool {
+		storage.mu.RLock()
+		defer storage.mu.RUnlock()
+		return len(storage.immMemt) == 0 && len(storage.l0SSTables) == l0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStorageRemoveWalAfterFlush(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
 	}
-	iter := iterator.NewMergeIterator(iterators...)
-	if iter.IsValid() && bytes.Equal(iter.Key(), key) {
-		return iter.Value()
+	flushID := storage.memt.ID()
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+
+	_, err = os.Stat(storage.walPath(flushID))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(storage.sstPath(flushID))
+	assert.Nil(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
 	}
-	return nil
 }
 
-func (si *StorageInner) Put(key, value []byte) {
-	utils.Assert(len(value) != 0, "value cannot be empty")
-	utils.Assert(len(key) != 0, "key cannot be empty")
+func TestStorageBloomFilter(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for i := uint64(0); i < 3; i++ {
+		for j := i * 100; j < i*100+100; j++ {
+			assert.Nil(t, storage.Put(test.KeyOf(j), test.ValueOf(j)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	assert.Len(t, storage.l0SSTables, 3)
 
-	estimateSize := block.SizeOfUint16*2 + uint16(len(key)) + uint16(len(value)) + block.SizeOfUint16
-	si.mu.RLock()
-	si.memt.Put(key, value)
-	atomic.AddInt64(&si.memtKeyCount, 1)
-	atomic.AddInt64(&si.memtSize, int64(estimateSize))
-	si.mu.RUnlock()
+	for i := uint64(0); i < 300; i++ {
+		assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
+	}
+	stats := storage.Stats()
+	assert.GreaterOrEqual(t, stats.BloomFilterMisses, uint64(300))
+	// keys in the oldest sst are ruled out by 2 newer ssts, keys in the middle one by the newest one
+	assert.Greater(t, stats.BloomFilterHits, uint64(250))
+
+	for i := uint64(300); i < 400; i++ {
+		assert.Nil(t, mustGet(t, storage, test.KeyOf(i)))
+	}
+	assert.Greater(t, storage.Stats().BloomFilterHits-stats.BloomFilterHits, uint64(250))
 }
 
-func (si *StorageInner) Delete(key []byte) {
-	utils.Assert(len(key) != 0, "key cannot be empty")
-	si.mu.RLock()
-	si.memt.Put(key, nil)
-	si.mu.RUnlock()
+func TestStorageReopen(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for round := uint64(0); round < 3; round++ {
+		for i := round * 100; i < (round+1)*100; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	assert.Empty(t, storage.l0SSTables)
+	assert.NotEmpty(t, storage.levels[0])
+	assert.Nil(t, storage.Put(test.KeyOf(300), test.ValueOf(300)))
+	assert.Nil(t, storage.Close(context.Background()))
+
+	reopened, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, reopened)
+	assert.Len(t, reopened.levels, len(storage.levels))
+	for i := range storage.levels {
+		assert.Len(t, reopened.levels[i], len(storage.levels[i]))
+		for j := range storage.levels[i] {
+			assert.Equal(t, storage.levels[i][j].SSTID(), reopened.levels[i][j].SSTID())
+		}
+	}
+	assert.Greater(t, reopened.nextSSTID, storage.memt.ID())
+	for i := uint64(0); i <= 300; i++ {
+		assert.Equal(t, test.ValueOf(i), mustGet(t, reopened, test.KeyOf(i)))
+	}
+
+	// flush after reopen should not conflict with existing ssts
+	assert.Nil(t, reopened.newMemTable())
+	assert.Nil(t, reopened.sinkImMemTableToSST())
+	assert.Nil(t, reopened.sinkImMemTableToSST())
+	// the empty memtable created on reopen is dropped instead of flushed
+	assert.Len(t, reopened.l0SSTables, 1)
+	assert.Empty(t, reopened.immMemt)
+	for i := uint64(0); i <= 300; i++ {
+		assert.Equal(t, test.ValueOf(i), mustGet(t, reopened, test.KeyOf(i)))
+	}
 }
 
-func (si *StorageInner) Scan(lower, upper []byte) iterator.Iter {
-	si.mu.RLock()
-	defer si.mu.RUnlock()
-	var iterators = make([]iterator.Iter, 0, 1+len(si.immMemt)+len(si.l0SSTables))
-	iterators = append(iterators, si.memt.Scan(lower, upper))
-	for _, mt := range si.immMemt {
-		iterators = append(iterators, mt.Scan(lower, upper))
+func TestStorageAdoptSSTsWithoutManifest(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	// newer ssts overwrite keys of older ones, the newest one deletes key 2
+	for round := uint64(0); round < 3; round++ {
+		for i := uint64(0); i < 100; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i+round*100)))
+		}
+		assert.Nil(t, storage.Delete(test.KeyOf(round)))
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	ids := []uint32{storage.l0SSTables[0].SSTID(), storage.l0SSTables[1].SSTID(), storage.l0SSTables[2].SSTID()}
+	lastSeq := storage.LastSeq()
+	assert.Nil(t, storage.Close(context.Background()))
+	// ssts written before manifest was introduced have no manifest
+	assert.Nil(t, os.Remove(storage.manifestPath()))
+
+	reopened, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, reopened)
+	assert.Len(t, reopened.l0SSTables, 3)
+	for i, id := range ids {
+		assert.Equal(t, id, reopened.l0SSTables[i].SSTID())
+		assert.Greater(t, reopened.nextSSTID, id)
 	}
-	for t := range si.l0SSTables {
-		iterators = append(iterators, sst.NewIterAndSeekToKey(si.l0SSTables[t], lower))
+	assert.Equal(t, lastSeq, reopened.LastSeq())
+	check := func(storage *Storage) {
+		for i := uint64(0); i < 100; i++ {
+			if i == 2 {
+				assert.Nil(t, mustGet(t, storage, test.KeyOf(i)))
+			} else {
+				assert.Equal(t, test.ValueOf(i+200), mustGet(t, storage, test.KeyOf(i)))
+			}
+		}
 	}
-	return iterator.NewMergeIterator(iterators...)
+	check(reopened)
+	// adopted ssts are recorded in manifest
+	assert.Nil(t, reopened.Put(test.KeyOf(1), test.ValueOf(1)))
+	assert.Nil(t, reopened.newMemTable())
+	// the empty memtable recovered from wal is dropped instead of flushed
+	assert.Nil(t, reopened.sinkImMemTableToSST())
+	assert.Nil(t, reopened.sinkImMemTableToSST())
+	assert.Nil(t, reopened.Close(context.Background()))
+	again, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, again)
+	assert.Len(t, again.l0SSTables, 4)
+	assert.Equal(t, test.ValueOf(1), mustGet(t, again, test.KeyOf(1)))
+	assert.Nil(t, again.Put(test.KeyOf(1), test.ValueOf(201)))
+	check(again)
 }
 
-func (si *StorageInner) checkIfNewMemTableShouldBeCreate() bool {
-	return atomic.LoadInt64(&si.memtKeyCount) > 1000 || atomic.LoadInt64(&si.memtSize) > 4096*10
+func testCompactOptions() compact.LeveledOptions {
+	return compact.LeveledOptions{
+		Level0FileNumCompactionTrigger: 2,
+		MaxLevels:                      3,
+		BaseLevelSizeBytes:             16 << 10,
+		LevelSizeMultiplier:            2,
+		TargetFileSizeBytes:            4 << 10,
+	}
 }
 
-func (si *StorageInner) newMemTable() {
-	si.mu.Lock()
-	si.memt, si.immMemt = memtable.NewTable(), append(si.immMemt, si.memt)
-	atomic.SwapInt64(&si.memtKeyCount, 0)
-	atomic.SwapInt64(&si.memtSize, 0)
-	si.mu.Unlock()
+func TestStorageCompressionPerLevel(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{
+		CompactionStrategy:     compact.NewLeveled(testCompactOptions()),
+		DisableAutoCompactions: true,
+		CompressionPerLevel:    []block.Compressor{nil, block.NewFlateCompressor(flate.BestCompression)},
+	})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for round := uint64(0); round < 2; round++ {
+		for i := round * 1000; i < round*1000+1000; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	l0Size := compact.TotalSize(storage.l0SSTables)
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	assert.Empty(t, storage.l0SSTables)
+	assert.Less(t, compact.TotalSize(storage.levels[0])*2, l0Size)
+	for i := uint64(0); i < 2000; i++ {
+		assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
+	}
 }
 
-func (si *StorageInner) sstPath(id uint32) string {
-	return filepath.Join(si.path, fmt.Sprintf("%d.sst", id))
+func TestStorageLeveledCompaction(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	// overwrite the same key range in every round
+	for round := uint64(0); round < 20; round++ {
+		for i := uint64(0); i < 500; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i*20+round), test.ValueOf(i+round)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+		for {
+			compacted, err := storage.compactSSTs()
+			assert.Nil(t, err)
+			if !compacted {
+				break
+			}
+		}
+	}
+	assert.Less(t, len(storage.l0SSTables), 2)
+	opts := testCompactOptions()
+	target := opts.BaseLevelSizeBytes
+	for i, level := range storage.levels {
+		for j := 1; j < len(level); j++ {
+			// sorted and no overlapping
+			assert.Negative(t, bytes.Compare(level[j-1].LastKey(), level[j].FirstKey()))
+		}
+		if i < len(storage.levels)-1 {
+			assert.LessOrEqual(t, compact.TotalSize(level), target)
+		}
+		target *= opts.LevelSizeMultiplier
+	}
+	assert.NotEmpty(t, storage.levels[len(storage.levels)-1])
+
+	for round := uint64(0); round < 20; round++ {
+		for i := uint64(0); i < 500; i++ {
+			assert.Equal(t, test.ValueOf(i+round), mustGet(t, storage, test.KeyOf(i*20+round)))
+		}
+	}
+	iter, err := storage.Scan(test.KeyOf(0), test.KeyOf(10000))
+	assert.Nil(t, err)
+	for i := uint64(0); i < 10000; i++ {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, test.KeyOf(i), iter.Key())
+		iter.Next()
+	}
+
+	// blocks of compacted ssts are removed from block cache
+	liveBlocks := 0
+	for _, table := range storage.l0SSTables {
+		liveBlocks += int(table.Len())
+	}
+	for _, level := range storage.levels {
+		for _, table := range level {
+			liveBlocks += int(table.Len())
+		}
+	}
+	stats := storage.Stats().BlockCache
+	assert.Positive(t, stats.Count)
+	assert.LessOrEqual(t, stats.Count, liveBlocks)
 }
 
-func (si *StorageInner) checkIfImMemTableShouldFlushToSST() bool {
-	return len(si.immMemt) > 0
+func TestStorageTieredCompaction(t *testing.T) {
+	opts := compact.TieredOptions{
+		MaxLevels:                   4,
+		NumSortedRunsTrigger:        3,
+		MaxSizeAmplificationPercent: 200,
+		SizeRatioPercent:            1,
+		MinMergeWidth:               2,
+		TargetFileSizeBytes:         4 << 10,
+	}
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewTiered(opts), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for round := uint64(0); round < 20; round++ {
+		for i := uint64(0); i < 100; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i*20+round), test.ValueOf(i+round)))
+		}
+		assert.Nil(t, storage.Put(test.KeyOf(0), test.ValueOf(round)))
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+		for {
+			compacted, err := storage.compactSSTs()
+			assert.Nil(t, err)
+			if !compacted {
+				break
+			}
+		}
+		sortedRuns := len(storage.l0SSTables)
+		for _, level := range storage.levels {
+			if len(level) != 0 {
+				sortedRuns++
+			}
+		}
+		assert.Less(t, sortedRuns, opts.NumSortedRunsTrigger)
+	}
+
+	check := func(storage *Storage) {
+		assert.Equal(t, test.ValueOf(19), mustGet(t, storage, test.KeyOf(0)))
+		for round := uint64(0); round < 20; round++ {
+			for i := uint64(1); i < 100; i++ {
+				assert.Equal(t, test.ValueOf(i+round), mustGet(t, storage, test.KeyOf(i*20+round)))
+			}
+		}
+	}
+	check(storage)
+	assert.Nil(t, storage.Close(context.Background()))
+	reopened, err := NewStorage(dir, Options{CompactionStrategy: compact.NewTiered(opts), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, reopened)
+	check(reopened)
 }
 
-func (si *StorageInner) sinkImMemTableToSST() error {
-	sstID := si.nextSSTID
-	si.mu.Lock()
-	defer si.mu.Unlock()
+func TestStorageTieredCompactionIntoL0(t *testing.T) {
+	opts := compact.TieredOptions{
+		MaxLevels:                   4,
+		NumSortedRunsTrigger:        3,
+		MaxSizeAmplificationPercent: 10000,
+		SizeRatioPercent:            1,
+		MinMergeWidth:               2,
+		TargetFileSizeBytes:         1 << 10,
+	}
+	storage, err := NewStorage(t.TempDir(), Options{BlockSize: 256, CompactionStrategy: compact.NewTiered(opts), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	sortedRuns := func() int {
+		runs := len(storage.l0SSTables)
+		for _, level := range storage.levels {
+			if len(level) != 0 {
+				runs++
+			}
+		}
+		return runs
+	}
+	// a large sorted run in L1 and two small ones in L0
+	for i := uint64(0); i < 1000; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	storage.levels[0], storage.l0SSTables = storage.l0SSTables, nil
+	for round := uint64(1); round <= 2; round++ {
+		for i := uint64(0); i < 100; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i*10), test.ValueOf(i*10+round)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	assert.Equal(t, 3, sortedRuns())
 
-	flushMemTable := si.immMemt[len(si.immMemt)-1]
-	builder := sst.NewTableBuilder(4096)
-	flushMemTable.Flush(builder)
+	// ssts in L0 are merged above L1, output is not split by target file size
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	assert.Len(t, storage.l0SSTables, 1)
+	assert.Equal(t, 2, sortedRuns())
+	for i := uint64(0); i < 1000; i++ {
+		if i%10 == 0 {
+			assert.Equal(t, test.ValueOf(i+2), mustGet(t, storage, test.KeyOf(i)))
+		} else {
+			assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
+		}
+	}
+}
 
-	sstTable, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
-	if err != nil {
-		return err
+func TestStorageConcurrentCompactionTasks(t *testing.T) {
+	opts := compact.TieredOptions{
+		MaxLevels:                   4,
+		NumSortedRunsTrigger:        3,
+		MaxSizeAmplificationPercent: 200,
+		SizeRatioPercent:            1,
+		MinMergeWidth:               2,
+		TargetFileSizeBytes:         1 << 20,
 	}
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewTiered(opts), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	flush := func(round uint64) {
+		for i := uint64(0); i < 100; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i+round)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	for round := uint64(0); round < 3; round++ {
+		flush(round)
+	}
+	running := storage.pickCompactionTask()
+	assert.NotNil(t, running)
+
+	// ssts flushed during the running task are compacted by another one
+	flush(3)
+	flush(4)
+	task := storage.pickCompactionTask()
+	assert.NotNil(t, task)
+	assert.Equal(t, []compact.LevelTables{{Level: 0, Tables: storage.l0SSTables[:2]}}, task.Inputs)
+	assert.Nil(t, storage.pickCompactionTask())
 
-	si.immMemt = si.immMemt[:len(si.immMemt)-1]
-	si.l0SSTables = append([]*sst.Table{sstTable}, si.l0SSTables...)
-	si.nextSSTID += 1
-	return nil
+	for _, task := range []*compact.Task{task, running} {
+		outputs, err := storage.runCompactionTask(task)
+		assert.Nil(t, err)
+		assert.Nil(t, storage.applyCompactionResult(task, outputs))
+		storage.finishCompactionTask(task)
+	}
+	assert.Len(t, storage.l0SSTables, 1)
+	assert.Len(t, storage.levels[3], 1)
+	for i := uint64(0); i < 100; i++ {
+		assert.Equal(t, test.ValueOf(i+4), mustGet(t, storage, test.KeyOf(i)))
+	}
 }
 
-func (si *StorageInner) checkIfSSTShouldBeCompact() bool {
-	return len(si.l0SSTables) >= 2
+func countTombstones(tables []*sst.Table) int {
+	count := 0
+	for _, table := range tables {
+		for iter := sst.NewIterAndSeekToFirst(table); iter.IsValid(); iter.Next() {
+			if iterator.IsTombstone(iter.Value()) {
+				count++
+			}
+		}
+	}
+	return count
 }
-func (si *StorageInner) compactSSTs() {
-	log.Printf("compact with l0SSTables: %d", len(si.l0SSTables))
-	if len(si.l0SSTables) >= 2 {
-		si.mu.RLock()
-		l0SSTableLength := len(si.l0SSTables)
-		sn := si.l0SSTables[l0SSTableLength-1]
-		snID := sn.SSTID()
-		snm1 := si.l0SSTables[l0SSTableLength-2]
-		snm1ID := snm1.SSTID()
-		si.mu.RUnlock()
 
-		snIter := sst.NewIterAndSeekToFirst(sn)
-		snm1Iter := sst.NewIterAndSeekToFirst(snm1)
-		mergeIter := iterator.NewTwoMerger(snm1Iter, snIter)
-		builder := sst.NewTableBuilder(4096)
-		for mergeIter.IsValid() {
-			builder.AddByte(mergeIter.Key(), mergeIter.Value())
-			mergeIter.Next()
+func TestStorageDeleteShadowsOlderVersions(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{
+		Level0FileNumCompactionTrigger: 1,
+		MaxLevels:                      3,
+		BaseLevelSizeBytes:             1,
+		LevelSizeMultiplier:            2,
+		TargetFileSizeBytes:            4 << 10,
+		DisableAutoCompactions:         true,
+	})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	compactAll := func() {
+		for {
+			compacted, err := storage.compactSSTs()
+			assert.Nil(t, err)
+			if !compacted {
+				return
+			}
 		}
-		sstID := si.nextSSTID
-		sstTable, err := builder.Build(sstID, si.blockCache, si.sstPath(sstID))
-		if err != nil {
-			log.Printf("sstable build fail: %s", err)
-			return
-		}
-		si.nextSSTID += 1
-		defer func() {
-			snm1.Close()
-			sn.Close()
-			os.Remove(si.sstPath(snID))
-			os.Remove(si.sstPath(snm1ID))
-		}()
-		si.mu.Lock()
-		if si.l0SSTables[l0SSTableLength-1].SSTID() == snID &&
-			si.l0SSTables[l0SSTableLength-2].SSTID() == snm1ID {
-			si.l0SSTables = append(si.l0SSTables[:l0SSTableLength-2], sstTable)
+	}
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	compactAll()
+	assert.NotEmpty(t, storage.levels[2])
+
+	for i := uint64(0); i < 100; i += 2 {
+		assert.Nil(t, storage.Delete(test.KeyOf(i)))
+	}
+	check := func() {
+		for i := uint64(0); i < 100; i++ {
+			if i%2 == 0 {
+				assert.Nil(t, mustGet(t, storage, test.KeyOf(i)))
+			} else {
+				assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
+			}
+		}
+		iter, err := storage.Scan(test.KeyOf(0), test.KeyOf(99))
+		assert.Nil(t, err)
+		for i := uint64(1); i < 100; i += 2 {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			iter.Next()
 		}
-		si.mu.Unlock()
+		assert.False(t, iter.IsValid())
 	}
+	check()
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	check()
+
+	// tombstones are kept when there is older data below
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	assert.Equal(t, 50, countTombstones(storage.levels[0]))
+	check()
+
+	// and dropped at the bottom level
+	compactAll()
+	for _, level := range storage.levels {
+		assert.Zero(t, countTombstones(level))
+	}
+	check()
 }
 
-func (si *StorageInner) internalLoopTask() {
-	ticker := time.NewTicker(5 * time.Second)
-	for range ticker.C {
-		if si.checkIfNewMemTableShouldBeCreate() {
-			logrus.Infoln("create new memtable")
-			si.newMemTable()
+func TestStorageDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		Level0FileNumCompactionTrigger: 1,
+		MaxLevels:                      3,
+		BaseLevelSizeBytes:             1,
+		LevelSizeMultiplier:            2,
+		TargetFileSizeBytes:            4 << 10,
+		DisableAutoCompactions:         true,
+	}
+	storage, err := NewStorage(dir, opts)
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	compactAll := func() {
+		for {
+			compacted, err := storage.compactSSTs()
+			assert.Nil(t, err)
+			if !compacted {
+				return
+			}
 		}
+	}
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	compactAll()
+	snapshot, err := storage.GetSnapshot()
+	assert.Nil(t, err)
 
-		if si.checkIfImMemTableShouldFlushToSST() {
-			logrus.Infoln("start to sink immutable memtable to sst")
-			err := si.sinkImMemTableToSST()
-			if err != nil {
-				logrus.WithError(err).Errorln("sinkImMemTableToSST error")
+	// keys in [20, 80) are deleted except 50, which is written again later
+	assert.Nil(t, storage.DeleteRange(test.KeyOf(20), test.KeyOf(80)))
+	assert.Nil(t, storage.Put(test.KeyOf(50), test.ValueOf(150)))
+	check := func() {
+		expected := make([]uint64, 0)
+		for i := uint64(0); i < 100; i++ {
+			switch {
+			case i == 50:
+				assert.Equal(t, test.ValueOf(150), mustGet(t, storage, test.KeyOf(i)))
+			case i >= 20 && i < 80:
+				assert.Nil(t, mustGet(t, storage, test.KeyOf(i)))
+				continue
+			default:
+				assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
 			}
+			expected = append(expected, i)
+		}
+		iter, err := storage.Scan(test.KeyOf(0), test.KeyOf(99))
+		assert.Nil(t, err)
+		for _, i := range expected {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			iter.Next()
 		}
+		assert.False(t, iter.IsValid())
+		assert.Nil(t, iter.Err())
+	}
+	checkSnapshot := func() {
+		for i := uint64(0); i < 100; i++ {
+			value, err := storage.GetWithOptions(test.KeyOf(i), ReadOptions{Snapshot: snapshot})
+			assert.Nil(t, err)
+			assert.Equal(t, test.ValueOf(i), value)
+		}
+	}
+	check()
+	checkSnapshot()
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	check()
+	checkSnapshot()
+
+	// covered versions visible to snapshot are kept by compaction
+	compactAll()
+	check()
+	checkSnapshot()
+	snapshot.Release()
 
-		if si.checkIfSSTShouldBeCompact() {
-			// now compact has problem
-			si.compactSSTs()
+	// and dropped with the range tombstone after snapshot is released
+	assert.Nil(t, storage.DeleteRange(test.KeyOf(90), test.KeyOf(95)))
+	assert.Nil(t, storage.Delete(test.KeyOf(90)))
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	assert.Nil(t, storage.Put(test.KeyOf(90), test.ValueOf(90)))
+	assert.Nil(t, storage.Put(test.KeyOf(95), test.ValueOf(95)))
+	assert.Nil(t, storage.Close(context.Background()))
+
+	storage, err = NewStorage(dir, opts)
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	compactAll()
+	assert.Nil(t, storage.DeleteRange(test.KeyOf(91), test.KeyOf(95)))
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	compactAll()
+	iter, err := storage.Scan(test.KeyOf(0), test.KeyOf(99))
+	assert.Nil(t, err)
+	for i := uint64(0); i < 100; i++ {
+		if i >= 20 && i < 80 && i != 50 || i > 90 && i < 95 {
+			assert.Nil(t, mustGet(t, storage, test.KeyOf(i)))
+			continue
+		}
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, test.KeyOf(i), iter.Key())
+		assert.Equal(t, iter.Value(), mustGet(t, storage, test.KeyOf(i)))
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	entries := 0
+	for _, level := range storage.levels {
+		for _, table := range level {
+			assert.Empty(t, table.RangeTombstones())
+			for iter := sst.NewIterAndSeekToFirst(table); iter.IsValid(); iter.Next() {
+				entries++
+			}
+		}
+	}
+	// keys in [0, 20), 50, [80, 91) and [95, 100)
+	assert.Equal(t, 20+1+11+5, entries)
+
+	assert.ErrorIs(t, storage.DeleteRange(nil, test.KeyOf(0)), ErrEmptyKey)
+	assert.ErrorIs(t, storage.DeleteRange(test.KeyOf(1), test.KeyOf(1)), ErrInvalidRange)
+	assert.ErrorIs(t, storage.DeleteRange(test.KeyOf(1), test.KeyOf(0)), ErrInvalidRange)
+	b := NewWriteBatch()
+	b.DeleteRange(test.KeyOf(1), test.KeyOf(0))
+	assert.ErrorIs(t, storage.Write(b, WriteOptions{}), ErrInvalidRange)
+}
+
+func TestStorageReverseScan(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	// keys in levels, L0 and memtable
+	for i := uint64(0); i < 300; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		if i == 49 || i == 99 || i == 199 {
+			assert.Nil(t, storage.newMemTable())
+			assert.Nil(t, storage.sinkImMemTableToSST())
 		}
+		if i == 99 {
+			compacted, err := storage.compactSSTs()
+			assert.Nil(t, err)
+			assert.True(t, compacted)
+		}
+	}
+	assert.NotEmpty(t, storage.levels[0])
+	assert.NotEmpty(t, storage.l0SSTables)
+	snapshot, err := storage.GetSnapshot()
+	assert.Nil(t, err)
+	defer snapshot.Release()
+	assert.Nil(t, storage.Put(test.KeyOf(5), test.ValueOf(1005)))
+	for i := uint64(0); i < 300; i += 10 {
+		assert.Nil(t, storage.Delete(test.KeyOf(i)))
+	}
+	assert.Nil(t, storage.DeleteRange(test.KeyOf(150), test.KeyOf(160)))
+	value := func(i uint64) []byte {
+		switch {
+		case i%10 == 0 || i >= 150 && i < 160:
+			return nil
+		case i == 5:
+			return test.ValueOf(1005)
+		}
+		return test.ValueOf(i)
+	}
+	checkPrev := func(iter iterator.Iter, from, to uint64, value func(uint64) []byte) {
+		for i := from; i >= to && i <= from; i-- {
+			if value(i) == nil {
+				continue
+			}
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			assert.Equal(t, value(i), iter.Value())
+			iter.Prev()
+		}
+		assert.False(t, iter.IsValid())
+		assert.Nil(t, iter.Err())
+	}
+	iter, err := storage.ReverseScan(test.KeyOf(0), test.KeyOf(299))
+	assert.Nil(t, err)
+	checkPrev(iter, 299, 0, value)
+	iter, err = storage.ReverseScan(test.KeyOf(20), test.KeyOf(30))
+	assert.Nil(t, err)
+	checkPrev(iter, 30, 20, value)
+	iter, err = storage.ReverseScanWithOptions(ReadOptions{
+		Snapshot: snapshot,
+		Bounds:   iterator.Bounds{Lower: test.KeyOf(0), Upper: test.KeyOf(299)},
+	})
+	assert.Nil(t, err)
+	checkPrev(iter, 299, 0, test.ValueOf)
+
+	// the latest 50 keys not after 250
+	iter, err = storage.ReverseScan(test.KeyOf(0), test.KeyOf(250))
+	assert.Nil(t, err)
+	latest := make([][]byte, 0, 50)
+	for ; iter.IsValid() && len(latest) < 50; iter.Prev() {
+		latest = append(latest, iter.Key())
+	}
+	assert.Len(t, latest, 50)
+	assert.Equal(t, test.KeyOf(249), latest[0])
+	assert.Equal(t, test.KeyOf(195), latest[49])
+
+	// switch direction and seek in the bounds
+	iter, err = storage.Scan(test.KeyOf(100), test.KeyOf(200))
+	assert.Nil(t, err)
+	check := func(i uint64) {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, test.KeyOf(i), iter.Key())
 	}
+	iter.Seek(test.KeyOf(150))
+	check(161)
+	iter.Prev()
+	check(149)
+	iter.Next()
+	check(161)
+	iter.SeekForPrev(test.KeyOf(160))
+	check(149)
+	iter.SeekToLast()
+	check(199)
+	iter.SeekForPrev(test.KeyOf(299))
+	check(199)
+	iter.SeekToFirst()
+	check(101)
+	iter.Seek(test.KeyOf(0))
+	check(101)
+	iter.Prev()
+	assert.False(t, iter.IsValid())
+
+	// Txn reads its own writes backward
+	txn, err := storage.BeginTxn()
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Put(test.KeyOf(10), test.ValueOf(10)))
+	assert.Nil(t, txn.Delete(test.KeyOf(11)))
+	iter, err = txn.Scan(test.KeyOf(0), test.KeyOf(20))
+	assert.Nil(t, err)
+	iter.SeekToLast()
+	checkPrev(iter, 20, 0, func(i uint64) []byte {
+		switch i {
+		case 10:
+			return test.ValueOf(10)
+		case 11:
+			return nil
+		}
+		return value(i)
+	})
+	txn.Rollback()
 }
 
-func NewStorageInner(path string) *StorageInner {
-	si := &StorageInner{
-		memt:       memtable.NewTable(),
-		immMemt:    make([]*memtable.Table, 0),
-		l0SSTables: make([]*sst.Table, 0),
-		levels:     make([][]*sst.Table, 0),
-		nextSSTID:  1,
-		path:       path,
-		blockCache: &sync.Map{},
+func TestStorageScanBounds(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	// keys 0-99 in levels, 100-199 in L0 and 200-299 in memtable
+	for i := uint64(0); i < 300; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		if i == 49 || i == 99 || i == 199 {
+			assert.Nil(t, storage.newMemTable())
+			assert.Nil(t, storage.sinkImMemTableToSST())
+		}
+		if i == 99 {
+			compacted, err := storage.compactSSTs()
+			assert.Nil(t, err)
+			assert.True(t, compacted)
+		}
+	}
+	assert.NotEmpty(t, storage.levels[0])
+	assert.Len(t, storage.l0SSTables, 1)
+	check := func(bounds iterator.Bounds, from, to uint64) {
+		iter, err := storage.ScanWithOptions(ReadOptions{Bounds: bounds})
+		assert.Nil(t, err)
+		for i := from; i <= to; i++ {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+		iter, err = storage.ReverseScanWithOptions(ReadOptions{Bounds: bounds})
+		assert.Nil(t, err)
+		for i := to; i >= from && i <= to; i-- {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			iter.Prev()
+		}
+		assert.False(t, iter.IsValid())
+		assert.Nil(t, iter.Err())
+	}
+	// keys after upper in ssts are not returned
+	check(iterator.Bounds{Lower: test.KeyOf(10), Upper: test.KeyOf(50)}, 10, 50)
+	check(iterator.Bounds{Lower: test.KeyOf(120), Upper: test.KeyOf(150)}, 120, 150)
+	check(iterator.Bounds{Lower: test.KeyOf(50), Upper: test.KeyOf(250)}, 50, 250)
+	check(iterator.Bounds{Lower: test.KeyOf(99), Upper: test.KeyOf(200), ExcludeLower: true, ExcludeUpper: true}, 100, 199)
+	check(iterator.Bounds{Lower: test.KeyOf(0), Upper: test.KeyOf(100), ExcludeUpper: true}, 0, 99)
+	check(iterator.Bounds{Upper: test.KeyOf(20)}, 0, 20)
+	check(iterator.Bounds{Lower: test.KeyOf(280)}, 280, 299)
+	check(iterator.Bounds{}, 0, 299)
+
+	// ssts out of bounds are pruned
+	bounds := func(lower, upper []byte, excludeUpper bool) iterator.Bounds {
+		return mvcc.InternalBounds(iterator.Bounds{Lower: lower, Upper: upper, ExcludeUpper: excludeUpper})
+	}
+	l0 := storage.l0SSTables[0]
+	assert.True(t, tableInBounds(l0, bounds(nil, nil, false)))
+	assert.True(t, tableInBounds(l0, bounds(test.KeyOf(199), nil, false)))
+	assert.True(t, tableInBounds(l0, bounds(nil, test.KeyOf(100), false)))
+	assert.False(t, tableInBounds(l0, bounds(nil, test.KeyOf(100), true)))
+	assert.False(t, tableInBounds(l0, bounds(test.KeyOf(200), nil, false)))
+	assert.False(t, tableInBounds(l0, bounds(test.KeyOf(20), test.KeyOf(50), false)))
+	level := storage.levels[0]
+	assert.Equal(t, level, levelInBounds(level, bounds(nil, nil, false)))
+	assert.Equal(t, level, levelInBounds(level, bounds(test.KeyOf(0), test.KeyOf(99), false)))
+	assert.Empty(t, levelInBounds(level, bounds(test.KeyOf(100), nil, false)))
+	assert.Empty(t, levelInBounds(level, bounds(nil, test.KeyOf(0), true)))
+	for i := uint64(0); i < 100; i += 7 {
+		selected := levelInBounds(level, bounds(test.KeyOf(i), test.KeyOf(i), false))
+		assert.Len(t, selected, 1)
+		assert.True(t, tableInBounds(selected[0], bounds(test.KeyOf(i), test.KeyOf(i), false)))
 	}
-	go si.internalLoopTask()
-	return si
 }
 
-type Storage struct {
-	// inner StorageInner implement a lsm storage
-	*StorageInner
+func TestStorageScanBoundsOverLegacySST(t *testing.T) {
+	dir := t.TempDir()
+	// keys 0-99 in an adopted legacy sst and 100-149 in memtable
+	assert.Nil(t, test.WriteLegacySST(filepath.Join(dir, "1.sst"), test.NewKeyValuePair(100)))
+	storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	assert.Len(t, storage.l0SSTables, 1)
+	for i := uint64(100); i < 150; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	check := func(bounds iterator.Bounds, from, to uint64) {
+		iter, err := storage.ScanWithOptions(ReadOptions{Bounds: bounds})
+		assert.Nil(t, err)
+		for i := from; i <= to; i++ {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			assert.Equal(t, test.ValueOf(i), iter.Value())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+		iter, err = storage.ReverseScanWithOptions(ReadOptions{Bounds: bounds})
+		assert.Nil(t, err)
+		for i := to; i >= from && i <= to; i-- {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			iter.Prev()
+		}
+		assert.False(t, iter.IsValid())
+		assert.Nil(t, iter.Err())
+	}
+	// the excluded bound is the only version of a user key in the legacy sst
+	check(iterator.Bounds{Lower: test.KeyOf(10), ExcludeLower: true}, 11, 149)
+	check(iterator.Bounds{Lower: test.KeyOf(10), Upper: test.KeyOf(120), ExcludeLower: true, ExcludeUpper: true}, 11, 119)
+	check(iterator.Bounds{Lower: test.KeyOf(50), Upper: test.KeyOf(99), ExcludeUpper: true}, 50, 98)
+	check(iterator.Bounds{Lower: test.KeyOf(99), ExcludeLower: true}, 100, 149)
 }
 
-func NewStorage(path string) *Storage {
-	return &Storage{
-		StorageInner: NewStorageInner(path),
+func TestStorageLegacyOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	// 2.sst is newer than 1.sst, it deletes key 3 and overwrites key 5
+	assert.Nil(t, test.WriteLegacySST(filepath.Join(dir, "1.sst"), test.NewKeyValuePair(10)))
+	assert.Nil(t, test.WriteLegacySST(filepath.Join(dir, "2.sst"), []test.Pair{
+		{Key: test.KeyOf(3)},
+		{Key: test.KeyOf(5), Value: test.ValueOf(500)},
+	}))
+	// the wal segment is newer than both ssts, it overwrites key 7 and then deletes it
+	w, err := wal.Create(filepath.Join(dir, "3.wal"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Put(test.KeyOf(7), test.ValueOf(700)))
+	assert.Nil(t, w.Put(test.KeyOf(7), nil))
+	assert.Nil(t, w.Put(test.KeyOf(8), test.ValueOf(800)))
+	assert.Nil(t, w.Close())
+
+	open := func() *Storage {
+		storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+		assert.Nil(t, err)
+		closeOnCleanup(t, storage)
+		return storage
+	}
+	expected := map[uint64][]byte{3: nil, 5: test.ValueOf(500), 7: nil, 8: test.ValueOf(800)}
+	check := func(storage *Storage) {
+		iter, err := storage.Scan(nil, nil)
+		assert.Nil(t, err)
+		for i := uint64(0); i < 10; i++ {
+			value, ok := expected[i]
+			if !ok {
+				value = test.ValueOf(i)
+			}
+			assert.Equal(t, value, mustGet(t, storage, test.KeyOf(i)))
+			if value == nil {
+				continue
+			}
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			assert.Equal(t, value, iter.Value())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+	}
+	storage := open()
+	check(storage)
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	check(storage)
+	assert.Nil(t, storage.Close(context.Background()))
+	check(open())
+}
+
+func TestStorageInvalidArgument(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	assert.ErrorIs(t, storage.Put(nil, test.ValueOf(0)), ErrEmptyKey)
+	assert.ErrorIs(t, storage.Put(test.KeyOf(0), nil), ErrEmptyValue)
+	assert.ErrorIs(t, storage.Delete(nil), ErrEmptyKey)
+	_, err = storage.Get(nil)
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	// a key-value pair too large for an sst block is rejected instead of breaking flush
+	assert.ErrorIs(t, storage.Put(make([]byte, MaxKeySize+1), test.ValueOf(0)), ErrKeyTooLarge)
+	assert.ErrorIs(t, storage.Put(test.KeyOf(0), make([]byte, MaxValueSize+1)), ErrValueTooLarge)
+	assert.ErrorIs(t, storage.Delete(make([]byte, MaxKeySize+1)), ErrKeyTooLarge)
+}
+
+func TestStorageCorruption(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+
+	// corrupt the first block of the flushed sst
+	fd, err := os.OpenFile(storage.sstPath(storage.l0SSTables[0].SSTID()), os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = fd.WriteAt([]byte{0xff, 0xff}, 8)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	_, err = storage.Get(test.KeyOf(0))
+	assert.ErrorIs(t, err, ErrCorruption)
+	iter, err := storage.Scan(test.KeyOf(0), test.KeyOf(99))
+	if err == nil {
+		for iter.IsValid() {
+			iter.Next()
+		}
+		err = iter.Err()
+	}
+	assert.ErrorIs(t, err, ErrCorruption)
+}
+
+func TestStorageWalCorruption(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.Nil(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	walPath := storage.walPath(storage.memt.ID())
+	assert.Nil(t, storage.Close(context.Background()))
+
+	// corrupt the first record of the wal segment
+	fd, err := os.OpenFile(walPath, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	_, err = fd.WriteAt([]byte{0xff, 0xff}, 12)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	_, err = NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+	assert.ErrorIs(t, err, ErrCorruption)
+}
+
+func TestStorageClose(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		dir := t.TempDir()
+		storage, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+		assert.Nil(t, err)
+		closeOnCleanup(t, storage)
+		for i := uint64(0); i < 100; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+		for i := uint64(100); i < 200; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		}
+		assert.Nil(t, storage.CloseWithOptions(context.Background(), CloseOptions{FlushMemTables: flush}))
+
+		assert.ErrorIs(t, storage.Put(test.KeyOf(0), test.ValueOf(0)), ErrClosed)
+		assert.ErrorIs(t, storage.Delete(test.KeyOf(0)), ErrClosed)
+		_, err = storage.Get(test.KeyOf(0))
+		assert.ErrorIs(t, err, ErrClosed)
+		_, err = storage.Scan(test.KeyOf(0), test.KeyOf(1))
+		assert.ErrorIs(t, err, ErrClosed)
+		assert.ErrorIs(t, storage.Close(context.Background()), ErrClosed)
+		wals, err := storage.listFileIDs(".wal")
+		assert.Nil(t, err)
+		if flush {
+			assert.Empty(t, wals)
+		} else {
+			assert.Len(t, wals, 1)
+		}
+
+		reopened, err := NewStorage(dir, Options{CompactionStrategy: compact.NewLeveled(compact.DefaultLeveledOptions())})
+		assert.Nil(t, err)
+		closeOnCleanup(t, reopened)
+		waitFlushed(t, reopened, 2)
+		for i := uint64(0); i < 200; i++ {
+			assert.Equal(t, test.ValueOf(i), mustGet(t, reopened, test.KeyOf(i)))
+		}
+		assert.Nil(t, reopened.Close(context.Background()))
+	}
+}
+
+func TestStorageOptions(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{BlockSize: 1024, MaxLevels: 3, MaxBackgroundCompactions: 2})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	defaults := DefaultOptions()
+	assert.Equal(t, uint32(1024), storage.opts.BlockSize)
+	assert.Equal(t, defaults.MemTableSize, storage.opts.MemTableSize)
+	assert.Equal(t, defaults.BlockCacheSize, storage.opts.BlockCacheSize)
+	assert.Len(t, storage.levels, 3)
+	for i := uint64(0); i < 1000; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	blk, err := storage.l0SSTables[0].ReadBlock(0)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, blk.Size(), 1024)
+	assert.Nil(t, storage.Close(context.Background()))
+
+	for _, opts := range []Options{
+		{MemTableSize: -1},
+		{BlockCacheSize: -1},
+		{LevelSizeMultiplier: 1},
+		{MaxBackgroundCompactions: -1},
+		{CompactionStrategy: compact.NewLeveled(compact.LeveledOptions{})},
+	} {
+		_, err = NewStorage(t.TempDir(), opts)
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+	}
+}
+
+func TestStorageFlushOnMemTableFull(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{
+		MemTableSize:                   4 << 10,
+		Level0FileNumCompactionTrigger: 2,
+		MaxLevels:                      3,
+		BaseLevelSizeBytes:             16 << 10,
+		LevelSizeMultiplier:            2,
+		TargetFileSizeBytes:            4 << 10,
+	})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	condition := func(cond func() bool) func() bool {
+		return func() bool {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			return cond()
+		}
+	}
+	for round := uint64(0); round < 4; round++ {
+		for i := round * 500; i < (round+1)*500; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		}
+		// the full memtable is frozen and flushed without waiting for a timer
+		assert.Eventually(t, condition(func() bool {
+			return len(storage.immMemt) == 0 && atomic.LoadInt64(&storage.memtSize) <= storage.opts.MemTableSize
+		}), 5*time.Second, time.Millisecond)
+	}
+	// flushes wake up compaction
+	assert.Eventually(t, condition(func() bool {
+		return len(storage.l0SSTables) < 2 && len(storage.levels[0]) != 0
+	}), 5*time.Second, time.Millisecond)
+	for i := uint64(0); i < 2000; i++ {
+		assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
+	}
+	assert.Nil(t, storage.Close(context.Background()))
+}
+
+// pausedStrategy generates no task until it's resumed
+type pausedStrategy struct {
+	compact.Strategy
+	resumed int32
+}
+
+func (p *pausedStrategy) GenerateTask(l0 []*sst.Table, levels [][]*sst.Table, compacting compact.Compacting) *compact.Task {
+	if atomic.LoadInt32(&p.resumed) == 0 {
+		return nil
+	}
+	return p.Strategy.GenerateTask(l0, levels, compacting)
+}
+
+func TestStorageWriteStall(t *testing.T) {
+	strategy := &pausedStrategy{Strategy: compact.NewLeveled(testCompactOptions())}
+	storage, err := NewStorage(t.TempDir(), Options{
+		CompactionStrategy:          strategy,
+		Level0SlowdownWritesTrigger: 1,
+		Level0StopWritesTrigger:     2,
+	})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	flush := func(round uint64) {
+		for i := round * 100; i < (round+1)*100; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	assert.Equal(t, WriteStallNone, storage.Stats().WriteStall)
+	flush(0)
+	assert.Equal(t, WriteStallSlowdown, storage.Stats().WriteStall)
+	assert.Zero(t, storage.Stats().PendingCompactionBytes)
+	flush(1)
+	assert.Equal(t, uint64(100), storage.Stats().DelayedWrites)
+	assert.Equal(t, WriteStallStop, storage.Stats().WriteStall)
+	assert.Positive(t, storage.Stats().PendingCompactionBytes)
+
+	// writes are blocked until compaction catches up
+	done := make(chan error)
+	go func() {
+		done <- storage.Put(test.KeyOf(200), test.ValueOf(200))
+	}()
+	select {
+	case <-done:
+		assert.Fail(t, "write should be stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, uint64(1), storage.Stats().StoppedWrites)
+	atomic.StoreInt32(&strategy.resumed, 1)
+	_, err = storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	assert.Equal(t, WriteStallNone, storage.Stats().WriteStall)
+	assert.Equal(t, test.ValueOf(200), mustGet(t, storage, test.KeyOf(200)))
+
+	// stopped writes are woken up by Close
+	atomic.StoreInt32(&strategy.resumed, 0)
+	flush(3)
+	flush(4)
+	assert.Equal(t, WriteStallStop, storage.Stats().WriteStall)
+	go func() {
+		done <- storage.Put(test.KeyOf(500), test.ValueOf(500))
+	}()
+	assert.Eventually(t, func() bool { return storage.Stats().StoppedWrites == 2 }, time.Second, time.Millisecond)
+	assert.Nil(t, storage.Close(context.Background()))
+	assert.ErrorIs(t, <-done, ErrClosed)
+}
+
+func TestStorageWrite(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewStorage(dir, Options{DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	assert.Nil(t, storage.Put(test.KeyOf(0), test.ValueOf(0)))
+
+	b := NewWriteBatch()
+	b.Delete(test.KeyOf(0))
+	for i := uint64(1); i < 100; i++ {
+		b.Put(test.KeyOf(i), test.ValueOf(i))
+	}
+	assert.Nil(t, storage.Write(b, WriteOptions{Sync: true}))
+
+	invalid := NewWriteBatch()
+	invalid.Put(test.KeyOf(100), test.ValueOf(100))
+	invalid.Put(test.KeyOf(101), nil)
+	assert.ErrorIs(t, storage.Write(invalid, WriteOptions{}), ErrEmptyValue)
+	invalid.Reset()
+	invalid.Put(test.KeyOf(100), test.ValueOf(100))
+	invalid.Delete(nil)
+	assert.ErrorIs(t, storage.Write(invalid, WriteOptions{}), ErrEmptyKey)
+	assert.Nil(t, mustGet(t, storage, test.KeyOf(100)))
+
+	check := func(storage *Storage) {
+		assert.Nil(t, mustGet(t, storage, test.KeyOf(0)))
+		for i := uint64(1); i < 100; i++ {
+			assert.Equal(t, test.ValueOf(i), mustGet(t, storage, test.KeyOf(i)))
+		}
+	}
+	check(storage)
+	assert.Nil(t, storage.Close(context.Background()))
+	assert.ErrorIs(t, storage.Write(b, WriteOptions{}), ErrClosed)
+
+	reopened, err := NewStorage(dir, Options{DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, reopened)
+	check(reopened)
+	assert.Nil(t, reopened.Close(context.Background()))
+}
+
+func TestStorageSequence(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true}
+	storage, err := NewStorage(dir, opts)
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	assert.Zero(t, storage.LastSeq())
+
+	// every round overwrites all keys, the last round deletes odd keys
+	for round := uint64(0); round < 3; round++ {
+		for i := uint64(0); i < 100; i++ {
+			if round == 2 && i%2 == 1 {
+				assert.Nil(t, storage.Delete(test.KeyOf(i)))
+			} else {
+				assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i+round*100)))
+			}
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	assert.Equal(t, uint64(300), storage.LastSeq())
+	b := NewWriteBatch()
+	b.Put(test.KeyOf(0), test.ValueOf(1000))
+	b.Delete(test.KeyOf(2))
+	assert.Nil(t, storage.Write(b, WriteOptions{}))
+	assert.Equal(t, uint64(301), b.Seq())
+	assert.Equal(t, uint64(302), storage.LastSeq())
+
+	check := func(storage *Storage) {
+		assert.Equal(t, test.ValueOf(1000), mustGet(t, storage, test.KeyOf(0)))
+		assert.Nil(t, mustGet(t, storage, test.KeyOf(2)))
+		for i := uint64(3); i < 100; i++ {
+			if i%2 == 1 {
+				assert.Nil(t, mustGet(t, storage, test.KeyOf(i)))
+			} else {
+				assert.Equal(t, test.ValueOf(i+200), mustGet(t, storage, test.KeyOf(i)))
+			}
+		}
+		iter, err := storage.Scan(test.KeyOf(0), test.KeyOf(99))
+		assert.Nil(t, err)
+		count := 0
+		for ; iter.IsValid(); iter.Next() {
+			count++
+		}
+		assert.Nil(t, iter.Err())
+		// even keys except key 2
+		assert.Equal(t, 49, count)
+	}
+	check(storage)
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	check(storage)
+	// only the newest version of every key is kept by compaction
+	entries := 0
+	for _, table := range storage.levels[0] {
+		iter := sst.NewIterAndSeekToFirst(table)
+		for ; iter.IsValid(); iter.Next() {
+			entries++
+		}
+	}
+	assert.Equal(t, 50, entries)
+	assert.Nil(t, storage.Close(context.Background()))
+
+	// seq is recovered from manifest and wal
+	reopened, err := NewStorage(dir, opts)
+	assert.Nil(t, err)
+	closeOnCleanup(t, reopened)
+	assert.Equal(t, uint64(302), reopened.LastSeq())
+	check(reopened)
+	assert.Nil(t, reopened.Put(test.KeyOf(2), test.ValueOf(2)))
+	assert.Equal(t, uint64(303), reopened.LastSeq())
+	assert.Equal(t, test.ValueOf(2), mustGet(t, reopened, test.KeyOf(2)))
+	assert.Nil(t, reopened.Close(context.Background()))
+}
+
+func TestStorageSnapshot(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	pinnedID := storage.l0SSTables[0].SSTID()
+	snapshot, err := storage.GetSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), snapshot.Seq())
+
+	// overwrite even keys and delete odd keys after snapshot
+	for i := uint64(0); i < 100; i++ {
+		if i%2 == 1 {
+			assert.Nil(t, storage.Delete(test.KeyOf(i)))
+		} else {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i+100)))
+		}
+	}
+	checkSnapshot := func() {
+		opts := ReadOptions{Snapshot: snapshot}
+		for i := uint64(0); i < 100; i++ {
+			value, err := storage.GetWithOptions(test.KeyOf(i), opts)
+			assert.Nil(t, err)
+			assert.Equal(t, test.ValueOf(i), value)
+		}
+		opts.Bounds = iterator.Bounds{Lower: test.KeyOf(0), Upper: test.KeyOf(99)}
+		iter, err := storage.ScanWithOptions(opts)
+		assert.Nil(t, err)
+		// writes during Scan are not visible
+		assert.Nil(t, storage.Put(test.KeyOf(50), test.ValueOf(1000)))
+		i := uint64(0)
+		for ; iter.IsValid(); iter.Next() {
+			assert.Equal(t, test.KeyOf(i), iter.Key())
+			assert.Equal(t, test.ValueOf(i), iter.Value())
+			i++
+		}
+		assert.Nil(t, iter.Err())
+		assert.Equal(t, uint64(100), i)
+		assert.Nil(t, storage.Put(test.KeyOf(50), test.ValueOf(150)))
+	}
+	checkLatest := func() {
+		for i := uint64(0); i < 100; i++ {
+			if i%2 == 1 {
+				assert.Nil(t, mustGet(t, storage, test.KeyOf(i)))
+			} else {
+				assert.Equal(t, test.ValueOf(i+100), mustGet(t, storage, test.KeyOf(i)))
+			}
+		}
+	}
+	checkSnapshot()
+	checkLatest()
+	assert.Nil(t, storage.newMemTable())
+	assert.Nil(t, storage.sinkImMemTableToSST())
+	checkSnapshot()
+
+	// compaction keeps versions visible to snapshot, and the sst pinned by snapshot is kept on disk
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	assert.Empty(t, storage.l0SSTables)
+	checkSnapshot()
+	checkLatest()
+	entries := 0
+	for _, table := range storage.levels[0] {
+		iter := sst.NewIterAndSeekToFirst(table)
+		for ; iter.IsValid(); iter.Next() {
+			entries++
+		}
+	}
+	// the latest version, including tombstones, and the version at snapshot of every key
+	assert.Equal(t, 200, entries)
+	_, err = os.Stat(storage.sstPath(pinnedID))
+	assert.Nil(t, err)
+
+	snapshot.Release()
+	snapshot.Release()
+	_, err = os.Stat(storage.sstPath(pinnedID))
+	assert.True(t, os.IsNotExist(err))
+	_, err = storage.GetWithOptions(test.KeyOf(0), ReadOptions{Snapshot: snapshot})
+	assert.ErrorIs(t, err, ErrSnapshotReleased)
+	_, err = storage.ScanWithOptions(ReadOptions{Snapshot: snapshot})
+	assert.ErrorIs(t, err, ErrSnapshotReleased)
+	checkLatest()
+
+	assert.Nil(t, storage.Close(context.Background()))
+	_, err = storage.GetSnapshot()
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestStorageScanPinsSSTs(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{
+		CompactionStrategy:     compact.NewLeveled(testCompactOptions()),
+		BlockSize:              256,
+		DisableAutoCompactions: true,
+	})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for round := uint64(0); round < 2; round++ {
+		for i := uint64(0); i < 200; i++ {
+			assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i+round)))
+		}
+		assert.Nil(t, storage.newMemTable())
+		assert.Nil(t, storage.sinkImMemTableToSST())
+	}
+	var ids []uint32
+	for _, table := range storage.l0SSTables {
+		ids = append(ids, table.SSTID())
+	}
+	iter, err := storage.Scan(nil, nil)
+	assert.Nil(t, err)
+	reverse, err := storage.ReverseScan(nil, nil)
+	assert.Nil(t, err)
+
+	// ssts read by Scans are kept until the Scans are closed
+	compacted, err := storage.compactSSTs()
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	assert.Empty(t, storage.l0SSTables)
+	for i := uint64(0); i < 200; i++ {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, test.KeyOf(i), iter.Key())
+		assert.Equal(t, test.ValueOf(i+1), iter.Value())
+		iter.Next()
+		assert.True(t, reverse.IsValid())
+		assert.Equal(t, test.KeyOf(199-i), reverse.Key())
+		reverse.Prev()
+	}
+	assert.False(t, iter.IsValid())
+	assert.Nil(t, iter.Err())
+	assert.Nil(t, reverse.Err())
+	iter.Close()
+	for _, id := range ids {
+		_, err = os.Stat(storage.sstPath(id))
+		assert.Nil(t, err)
+	}
+	reverse.Close()
+	reverse.Close()
+	for _, id := range ids {
+		_, err = os.Stat(storage.sstPath(id))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestStorageTxn(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	for i := uint64(0); i < 10; i++ {
+		assert.Nil(t, storage.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+
+	// Txn reads its own writes, others see them after Commit
+	txn, err := storage.BeginTxn()
+	assert.Nil(t, err)
+	value, err := txn.Get(test.KeyOf(1))
+	assert.Nil(t, err)
+	assert.Equal(t, test.ValueOf(1), value)
+	assert.Nil(t, txn.Put(test.KeyOf(1), test.ValueOf(100)))
+	assert.Nil(t, txn.Delete(test.KeyOf(2)))
+	assert.Nil(t, txn.Put(test.KeyOf(10), test.ValueOf(10)))
+	value, err = txn.Get(test.KeyOf(1))
+	assert.Nil(t, err)
+	assert.Equal(t, test.ValueOf(100), value)
+	value, err = txn.Get(test.KeyOf(2))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+	assert.Equal(t, test.ValueOf(1), mustGet(t, storage, test.KeyOf(1)))
+	assert.Equal(t, test.ValueOf(2), mustGet(t, storage, test.KeyOf(2)))
+	iter, err := txn.Scan(test.KeyOf(0), test.KeyOf(10))
+	assert.Nil(t, err)
+	expected := []uint64{0, 100, 3, 4, 5, 6, 7, 8, 9, 10}
+	for i := 0; iter.IsValid(); iter.Next() {
+		assert.Equal(t, test.ValueOf(expected[i]), iter.Value())
+		i++
+	}
+	assert.Nil(t, iter.Err())
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, test.ValueOf(100), mustGet(t, storage, test.KeyOf(1)))
+	assert.Nil(t, mustGet(t, storage, test.KeyOf(2)))
+	assert.Equal(t, test.ValueOf(10), mustGet(t, storage, test.KeyOf(10)))
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	assert.ErrorIs(t, txn.Put(test.KeyOf(1), test.ValueOf(1)), ErrTxnDone)
+	_, err = txn.Get(test.KeyOf(1))
+	assert.ErrorIs(t, err, ErrTxnDone)
+	txn.Rollback()
+
+	// conflict checks keys read by Get and Scan, including keys not found and versions flushed to ssts
+	for _, c := range []struct {
+		name     string
+		read     func(txn *Txn)
+		write    func()
+		conflict bool
+	}{
+		{"overwrite", func(txn *Txn) { txn.Get(test.KeyOf(3)) }, func() { storage.Put(test.KeyOf(3), test.ValueOf(3)) }, true},
+		{"delete", func(txn *Txn) { txn.Get(test.KeyOf(4)) }, func() { storage.Delete(test.KeyOf(4)) }, true},
+		{"insert", func(txn *Txn) { txn.Get(test.KeyOf(20)) }, func() { storage.Put(test.KeyOf(20), test.ValueOf(20)) }, true},
+		{"other key", func(txn *Txn) { txn.Get(test.KeyOf(5)) }, func() { storage.Put(test.KeyOf(6), test.ValueOf(6)) }, false},
+		{"scan", func(txn *Txn) {
+			iter, _ := txn.Scan(test.KeyOf(0), test.KeyOf(9))
+			for ; iter.IsValid(); iter.Next() {
+			}
+		}, func() { storage.Put(test.KeyOf(7), test.ValueOf(7)) }, true},
+		{"flushed", func(txn *Txn) { txn.Get(test.KeyOf(8)) }, func() {
+			storage.Put(test.KeyOf(8), test.ValueOf(8))
+			assert.Nil(t, storage.newMemTable())
+			assert.Nil(t, storage.sinkImMemTableToSST())
+		}, true},
+		{"delete range", func(txn *Txn) { txn.Get(test.KeyOf(9)) }, func() {
+			assert.Nil(t, storage.DeleteRange(test.KeyOf(9), test.KeyOf(10)))
+			assert.Nil(t, storage.newMemTable())
+			assert.Nil(t, storage.sinkImMemTableToSST())
+		}, true},
+		{"delete range of other keys", func(txn *Txn) { txn.Get(test.KeyOf(5)) }, func() {
+			assert.Nil(t, storage.DeleteRange(test.KeyOf(50), test.KeyOf(60)))
+		}, false},
+	} {
+		txn, err := storage.BeginTxn()
+		assert.Nil(t, err)
+		c.read(txn)
+		c.write()
+		assert.Nil(t, txn.Put(test.KeyOf(30), []byte(c.name)))
+		if c.conflict {
+			assert.ErrorIs(t, txn.Commit(), ErrConflict, c.name)
+			assert.NotEqual(t, []byte(c.name), mustGet(t, storage, test.KeyOf(30)), c.name)
+		} else {
+			assert.Nil(t, txn.Commit(), c.name)
+			assert.Equal(t, []byte(c.name), mustGet(t, storage, test.KeyOf(30)), c.name)
+		}
+	}
+
+	// Rollback discards writes
+	txn, err = storage.BeginTxn()
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Put(test.KeyOf(40), test.ValueOf(40)))
+	txn.Rollback()
+	assert.Nil(t, mustGet(t, storage, test.KeyOf(40)))
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	assert.Nil(t, storage.Close(context.Background()))
+	_, err = storage.BeginTxn()
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestStorageTxnConflictAtTableBoundary(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{CompactionStrategy: compact.NewLeveled(testCompactOptions()), DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	txn, err := storage.BeginTxn()
+	assert.Nil(t, err)
+	value, err := txn.Get(test.KeyOf(5))
+	assert.Nil(t, err)
+	assert.Nil(t, value)
+
+	// key 5 put by another writer is compacted into the first key of a level table,
+	// the previous table ends at key 5 because of its range tombstone
+	seq := storage.LastSeq()
+	build := func(add func(builder *sst.TableBuilder)) *sst.Table {
+		id := storage.allocateSSTID()
+		builder := storage.newTableBuilder(1)
+		add(builder)
+		table, err := builder.Build(id, storage.blockCache, storage.sstPath(id))
+		assert.Nil(t, err)
+		return table
+	}
+	first := build(func(builder *sst.TableBuilder) {
+		builder.AddByte(mvcc.MakeKey(test.KeyOf(1), seq+1, mvcc.KindPut), test.ValueOf(1))
+		builder.AddRangeTombstone(mvcc.RangeTombstone{Start: test.KeyOf(2), End: test.KeyOf(5), Seq: seq + 1})
+	})
+	second := build(func(builder *sst.TableBuilder) {
+		builder.AddByte(mvcc.MakeKey(test.KeyOf(5), seq+2, mvcc.KindPut), test.ValueOf(5))
+	})
+	assert.Equal(t, mvcc.SeekKey(test.KeyOf(5), mvcc.MaxSeq), first.LastKey())
+	storage.mu.Lock()
+	storage.levels[0] = []*sst.Table{first, second}
+	atomic.StoreUint64(&storage.lastSeq, seq+2)
+	storage.mu.Unlock()
+	assert.Equal(t, test.ValueOf(5), mustGet(t, storage, test.KeyOf(5)))
+
+	assert.Nil(t, txn.Put(test.KeyOf(6), test.ValueOf(6)))
+	assert.ErrorIs(t, txn.Commit(), ErrConflict)
+	assert.Nil(t, mustGet(t, storage, test.KeyOf(6)))
+}
+
+func TestStorageTxnCounter(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	key := []byte("counter")
+	increase := func() error {
+		txn, err := storage.BeginTxn()
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+		value, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(string(value))
+		if err = txn.Put(key, []byte(strconv.Itoa(n+1))); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := increase()
+				for errors.Is(err, ErrConflict) {
+					err = increase()
+				}
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []byte("400"), mustGet(t, storage, key))
+	assert.Nil(t, storage.Close(context.Background()))
+}
+
+func TestStoragePessimisticTxn(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{DisableAutoCompactions: true})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	begin := func(timeout time.Duration) *Txn {
+		txn, err := storage.BeginTxnWithOptions(TxnOptions{Pessimistic: true, LockTimeout: timeout})
+		assert.Nil(t, err)
+		return txn
+	}
+	a, b := []byte("a"), []byte("b")
+	assert.Nil(t, storage.Put(a, test.ValueOf(0)))
+
+	// keys read by GetForUpdate or written are locked until Txn finishes
+	txn1 := begin(0)
+	value, err := txn1.GetForUpdate(a)
+	assert.Nil(t, err)
+	assert.Equal(t, test.ValueOf(0), value)
+	assert.Nil(t, txn1.Put(b, test.ValueOf(1)))
+	txn2 := begin(20 * time.Millisecond)
+	assert.ErrorIs(t, txn2.Put(a, test.ValueOf(2)), ErrLockTimeout)
+	_, err = txn2.GetForUpdate(b)
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	// Get doesn't lock
+	value, err = txn2.Get(a)
+	assert.Nil(t, err)
+	assert.Equal(t, test.ValueOf(0), value)
+	txn2.Rollback()
+	assert.Nil(t, txn1.Put(a, test.ValueOf(1)))
+	assert.Nil(t, txn1.Commit())
+	assert.Equal(t, test.ValueOf(1), mustGet(t, storage, a))
+	assert.Equal(t, test.ValueOf(1), mustGet(t, storage, b))
+
+	// txn2 waits for b held by txn1, then txn1 waiting for a held by txn2 is a deadlock
+	txn1, txn2 = begin(time.Minute), begin(time.Minute)
+	assert.Nil(t, txn1.Put(a, test.ValueOf(2)))
+	assert.Nil(t, txn2.Put(b, test.ValueOf(3)))
+	done := make(chan error)
+	go func() {
+		_, err := txn2.GetForUpdate(a)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, err = txn1.GetForUpdate(b)
+	assert.ErrorIs(t, err, ErrDeadlock)
+	txn1.Rollback()
+	assert.Nil(t, <-done)
+	assert.Nil(t, txn2.Commit())
+	assert.Equal(t, test.ValueOf(1), mustGet(t, storage, a))
+	assert.Equal(t, test.ValueOf(3), mustGet(t, storage, b))
+	assert.Nil(t, storage.Close(context.Background()))
+}
+
+func TestStoragePessimisticTxnCounter(t *testing.T) {
+	storage, err := NewStorage(t.TempDir(), Options{})
+	assert.Nil(t, err)
+	closeOnCleanup(t, storage)
+	key := []byte("counter")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				txn, err := storage.BeginTxnWithOptions(TxnOptions{Pessimistic: true, LockTimeout: time.Minute})
+				assert.Nil(t, err)
+				value, err := txn.GetForUpdate(key)
+				assert.Nil(t, err)
+				n, _ := strconv.Atoi(string(value))
+				assert.Nil(t, txn.Put(key, []byte(strconv.Itoa(n+1))))
+				assert.Nil(t, txn.Commit())
+			}
+		}()
 	}
+	wg.Wait()
+	assert.Equal(t, []byte("400"), mustGet(t, storage, key))
+	assert.Nil(t, storage.Close(context.Background()))
 }
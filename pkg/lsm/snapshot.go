@@ -0,0 +1,138 @@
+package lsm
+
+import (
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"mini-lsm/pkg/sst"
+)
+
+// Snapshot is a consistent state of Storage at a sequence number, reads at it see no later writes.
+// It pins its ssts so they are not removed by compaction, and compaction keeps the versions it can see,
+// so it should be released as soon as it's not needed.
+type Snapshot struct {
+	si   *StorageInner
+	seq  uint64
+	view view
+	// released is set to 1 by Release
+	released int32
+}
+
+// Seq returns the sequence number of the latest write visible to Snapshot
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Release unpins ssts of Snapshot, reads at a released Snapshot return ErrSnapshotReleased.
+// Iters read at Snapshot should not be used after Release.
+func (s *Snapshot) Release() {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return
+	}
+	s.si.releaseSnapshot(s)
+}
+
+func (s *Snapshot) isReleased() bool {
+	return atomic.LoadInt32(&s.released) == 1
+}
+
+// tables returns all ssts in view
+func (v view) tables() []*sst.Table {
+	tables := append([]*sst.Table{}, v.l0SSTables...)
+	for _, level := range v.levels {
+		tables = append(tables, level...)
+	}
+	return tables
+}
+
+// GetSnapshot returns a Snapshot of the latest state, read at it by ReadOptions
+func (si *StorageInner) GetSnapshot() (*Snapshot, error) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	if si.closed {
+		return nil, ErrClosed
+	}
+	v := si.currentView()
+	// levels is modified in place by compaction
+	v.levels = append([][]*sst.Table{}, v.levels...)
+	s := &Snapshot{si: si, seq: si.LastSeq(), view: v}
+
+	si.snapshotMu.Lock()
+	defer si.snapshotMu.Unlock()
+	si.snapshots[s] = struct{}{}
+	si.pinTables(v.tables())
+	return s, nil
+}
+
+func (si *StorageInner) releaseSnapshot(s *Snapshot) {
+	si.snapshotMu.Lock()
+	defer si.snapshotMu.Unlock()
+	delete(si.snapshots, s)
+	si.unpinTables(s.view.tables())
+}
+
+// pinTables keeps tables from being removed by compaction until unpinTables, it should be called with snapshotMu locked
+func (si *StorageInner) pinTables(tables []*sst.Table) {
+	for _, table := range tables {
+		si.pinned[table.SSTID()]++
+	}
+}
+
+// unpinTables removes tables compacted away once they are not pinned, it should be called with snapshotMu locked
+func (si *StorageInner) unpinTables(tables []*sst.Table) {
+	for _, table := range tables {
+		id := table.SSTID()
+		if si.pinned[id]--; si.pinned[id] > 0 {
+			continue
+		}
+		delete(si.pinned, id)
+		if obsolete, ok := si.obsolete[id]; ok {
+			delete(si.obsolete, id)
+			si.removeTable(obsolete)
+		}
+	}
+}
+
+// snapshotSeqs returns sequence numbers of live snapshots in ascending order
+func (si *StorageInner) snapshotSeqs() []uint64 {
+	si.snapshotMu.Lock()
+	defer si.snapshotMu.Unlock()
+	seqs := make([]uint64, 0, len(si.snapshots))
+	for s := range si.snapshots {
+		seqs = append(seqs, s.seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// removeCompactedTable closes and removes an sst compacted away,
+// it's deferred until the last snapshot or Iterator pinning it is released.
+func (si *StorageInner) removeCompactedTable(table *sst.Table) {
+	si.snapshotMu.Lock()
+	defer si.snapshotMu.Unlock()
+	if si.pinned[table.SSTID()] > 0 {
+		si.obsolete[table.SSTID()] = table
+		return
+	}
+	si.removeTable(table)
+}
+
+func (si *StorageInner) removeTable(table *sst.Table) {
+	table.Close()
+	if err := os.Remove(si.sstPath(table.SSTID())); err != nil {
+		logrus.WithError(err).WithField("sstID", table.SSTID()).Warnln("remove compacted sst error")
+	}
+}
+
+// closeObsoleteTables closes and removes ssts still pinned by snapshots or Iterators, it's called by release
+func (si *StorageInner) closeObsoleteTables() {
+	si.snapshotMu.Lock()
+	defer si.snapshotMu.Unlock()
+	for id, table := range si.obsolete {
+		delete(si.obsolete, id)
+		si.removeTable(table)
+	}
+}
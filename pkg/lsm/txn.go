@@ -0,0 +1,294 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+
+	"mini-lsm/pkg/iterator"
+	"mini-lsm/pkg/memtable"
+	"mini-lsm/pkg/mvcc"
+)
+
+// DefaultLockTimeout is the LockTimeout used if TxnOptions leaves it zero
+const DefaultLockTimeout = time.Second
+
+// TxnOptions configures a Txn
+type TxnOptions struct {
+	// Pessimistic makes Txn lock keys it writes or reads by GetForUpdate, instead of checking conflicts on Commit
+	Pessimistic bool
+	// LockTimeout bounds waiting for a key locked by another pessimistic Txn, ErrLockTimeout is returned after it
+	LockTimeout time.Duration
+}
+
+// Txn buffers its writes, which are applied atomically by Commit. Txn is not safe for concurrent use.
+//
+// An optimistic Txn reads at the Snapshot taken when it began, Commit fails with ErrConflict
+// if any key read by it was written by others after it began.
+//
+// A pessimistic Txn reads the latest state, it locks every key it writes or reads by GetForUpdate
+// until it finishes, so those keys can't be written by other pessimistic Txns meanwhile.
+// Taking a lock fails with ErrLockTimeout or ErrDeadlock, Txn should be rolled back then.
+// Writes out of Txns don't take locks.
+type Txn struct {
+	si       *StorageInner
+	id       uint64
+	startSeq uint64
+	// snapshot is nil for pessimistic Txn
+	snapshot *Snapshot
+	opts     TxnOptions
+	// locked are keys locked by pessimistic Txn
+	locked map[string]struct{}
+	// writes are applied by Commit, local holds them too so that Txn reads its own writes,
+	// localSeq is the seq of the latest write in local.
+	writes   *WriteBatch
+	local    *memtable.Table
+	localSeq uint64
+	// reads are keys read from storage by optimistic Txn, they are checked for conflicts by Commit
+	reads map[string]struct{}
+	done  bool
+}
+
+// BeginTxn starts an optimistic Txn
+func (si *StorageInner) BeginTxn() (*Txn, error) {
+	return si.BeginTxnWithOptions(TxnOptions{})
+}
+
+// BeginTxnWithOptions starts a Txn configured by opts
+func (si *StorageInner) BeginTxnWithOptions(opts TxnOptions) (*Txn, error) {
+	if opts.LockTimeout == 0 {
+		opts.LockTimeout = DefaultLockTimeout
+	}
+	txn := &Txn{
+		si:     si,
+		id:     atomic.AddUint64(&si.nextTxnID, 1),
+		opts:   opts,
+		locked: make(map[string]struct{}),
+		writes: NewWriteBatch(),
+		local:  memtable.NewTable(),
+		reads:  make(map[string]struct{}),
+	}
+	if opts.Pessimistic {
+		si.mu.RLock()
+		defer si.mu.RUnlock()
+		if si.closed {
+			return nil, ErrClosed
+		}
+		txn.startSeq = si.LastSeq()
+		return txn, nil
+	}
+	snapshot, err := si.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	txn.snapshot, txn.startSeq = snapshot, snapshot.Seq()
+	return txn, nil
+}
+
+// StartSeq returns the seq of the latest write when Txn began, optimistic Txn reads at it
+func (txn *Txn) StartSeq() uint64 {
+	return txn.startSeq
+}
+
+// Get returns the value of key written by Txn, if Txn has not written it, optimistic Txn reads it
+// at StartSeq and pessimistic Txn reads the latest state.
+// nil value and nil error are returned if key is not found or has been deleted.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if value, found := txn.local.Get(key, mvcc.MaxSeq); found {
+		if iterator.IsTombstone(value) {
+			return nil, nil
+		}
+		return value, nil
+	}
+	if !txn.opts.Pessimistic {
+		txn.reads[string(key)] = struct{}{}
+	}
+	return txn.si.GetWithOptions(key, ReadOptions{Snapshot: txn.snapshot})
+}
+
+// GetForUpdate is like Get, pessimistic Txn locks key before reading it,
+// so the value stays unchanged until Txn finishes except by Txn itself.
+// Optimistic Txn checks key for conflicts by Commit as Get does.
+func (txn *Txn) GetForUpdate(key []byte) ([]byte, error) {
+	if err := txn.lock(key); err != nil {
+		return nil, err
+	}
+	return txn.Get(key)
+}
+
+// lock takes the lock of key for pessimistic Txn, it does nothing for optimistic Txn
+func (txn *Txn) lock(key []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if !txn.opts.Pessimistic {
+		return nil
+	}
+	if _, ok := txn.locked[string(key)]; ok {
+		return nil
+	}
+	if err := txn.si.locks.Lock(txn.id, key, txn.opts.LockTimeout); err != nil {
+		return err
+	}
+	txn.locked[string(key)] = struct{}{}
+	return nil
+}
+
+func (txn *Txn) Put(key, value []byte) error {
+	if err := checkValue(value); err != nil {
+		return err
+	}
+	return txn.put(key, value)
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	return txn.put(key, nil)
+}
+
+// put buffers a Put of key-value, or a Delete of key if value is empty
+func (txn *Txn) put(key, value []byte) error {
+	if err := txn.lock(key); err != nil {
+		return err
+	}
+	txn.localSeq++
+	if err := txn.local.Put(key, txn.localSeq, value); err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		txn.writes.Delete(key)
+	} else {
+		txn.writes.Put(key, value)
+	}
+	return nil
+}
+
+// Scan returns an Iterator of keys in [lower, upper] like Get sees them, deleted keys are skipped,
+// it moves in both directions like the Iterator of ScanWithOptions.
+// Keys returned by Iterator of optimistic Txn are checked for conflicts as keys read by Get, but keys
+// inserted into [lower, upper] by others are not. Iterator of pessimistic Txn doesn't lock keys.
+// Iterator should not be used after Txn is written or finished, and it should be closed as well.
+func (txn *Txn) Scan(lower, upper []byte) (*Iterator, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	iter, err := txn.si.ScanWithOptions(ReadOptions{
+		Snapshot: txn.snapshot,
+		Bounds:   iterator.Bounds{Lower: lower, Upper: upper},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// writes of Txn shadow the same keys in storage, MergeIterator takes the first Iter for the same key
+	local := mvcc.NewIteratorWithTombstones(txn.local.Scan(lower, upper), mvcc.MaxSeq)
+	iter.Iter = iterator.NewTombstoneFilter(iterator.NewMergeIterator(local, iter.Iter))
+	if txn.opts.Pessimistic {
+		return iter, nil
+	}
+	t := &txnIter{Iter: iter.Iter, txn: txn}
+	t.recordRead()
+	iter.Iter = t
+	return iter, nil
+}
+
+// Commit applies writes of Txn atomically like Write, for optimistic Txn, ErrConflict is returned
+// without applying anything if any key read by Txn has a version newer than StartSeq.
+// Txn is finished after Commit, locks of pessimistic Txn are released.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.finish()
+	if txn.writes.Count() == 0 {
+		return nil
+	}
+	if txn.opts.Pessimistic {
+		return txn.si.write(txn.writes, WriteOptions{}, nil)
+	}
+	return txn.si.write(txn.writes, WriteOptions{}, txn.checkConflict)
+}
+
+// checkConflict is called by write with no other write in progress, so no version is added during it
+func (txn *Txn) checkConflict() error {
+	v := txn.si.currentView()
+	for key := range txn.reads {
+		ver, found, err := txn.si.getFromView(v, []byte(key), mvcc.MaxSeq)
+		if err != nil {
+			return err
+		}
+		if found && ver.seq > txn.StartSeq() {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Rollback discards writes of Txn, Txn is finished after Rollback, locks of pessimistic Txn are released
+func (txn *Txn) Rollback() {
+	if !txn.done {
+		txn.finish()
+	}
+}
+
+func (txn *Txn) finish() {
+	txn.done = true
+	if txn.snapshot != nil {
+		txn.snapshot.Release()
+	}
+	for key := range txn.locked {
+		txn.si.locks.Unlock(txn.id, []byte(key))
+	}
+}
+
+// txnIter records every key it returns as read by txn
+type txnIter struct {
+	iterator.Iter
+	txn *Txn
+}
+
+func (t *txnIter) recordRead() {
+	if !t.Iter.IsValid() {
+		return
+	}
+	key := t.Iter.Key()
+	if _, found := t.txn.local.Get(key, mvcc.MaxSeq); !found {
+		t.txn.reads[string(key)] = struct{}{}
+	}
+}
+
+func (t *txnIter) Next() {
+	t.Iter.Next()
+	t.recordRead()
+}
+
+func (t *txnIter) Prev() {
+	t.Iter.Prev()
+	t.recordRead()
+}
+
+func (t *txnIter) Seek(key []byte) {
+	t.Iter.Seek(key)
+	t.recordRead()
+}
+
+func (t *txnIter) SeekForPrev(key []byte) {
+	t.Iter.SeekForPrev(key)
+	t.recordRead()
+}
+
+func (t *txnIter) SeekToFirst() {
+	t.Iter.SeekToFirst()
+	t.recordRead()
+}
+
+func (t *txnIter) SeekToLast() {
+	t.Iter.SeekToLast()
+	t.recordRead()
+}
@@ -0,0 +1,95 @@
+package lsm
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"mini-lsm/pkg/batch"
+	"mini-lsm/pkg/block"
+)
+
+// WriteBatch collects Puts and Deletes which are applied atomically by Write
+type WriteBatch = batch.Batch
+
+func NewWriteBatch() *WriteBatch {
+	return batch.New()
+}
+
+// WriteOptions configures Write
+type WriteOptions struct {
+	// Sync makes the batch durable on disk before Write returns
+	Sync bool
+}
+
+// Write applies all Puts and Deletes in b to the active memtable as one unit,
+// readers see either none or all of them, so does recovery from wal.
+// Entries of b take consecutive sequence numbers from b.Seq(), which is assigned by Write.
+// An error like ErrEmptyKey, ErrValueTooLarge or ErrInvalidRange is returned without applying anything
+// if any entry is invalid.
+func (si *StorageInner) Write(b *WriteBatch, opts WriteOptions) error {
+	err := b.Iterate(func(kind batch.Kind, key, value []byte) error {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+		switch kind {
+		case batch.KindPut:
+			return checkValue(value)
+		case batch.KindRangeDelete:
+			if len(value) > MaxKeySize {
+				return ErrKeyTooLarge
+			}
+			if bytes.Compare(key, value) >= 0 {
+				return ErrInvalidRange
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if b.Count() == 0 {
+		return nil
+	}
+	return si.write(b, opts, nil)
+}
+
+// write applies a valid batch, readers see it once lastSeq is published.
+// If check is not nil, it's called before b is applied with no other write in progress,
+// b is not applied if check returns an error.
+func (si *StorageInner) write(b *WriteBatch, opts WriteOptions, check func() error) error {
+	var estimateSize int64
+	_ = b.Iterate(func(kind batch.Kind, key, value []byte) error {
+		estimateSize += int64(block.SizeOfUint32)*3 + int64(len(key)) + int64(len(value))
+		return nil
+	})
+
+	si.waitWriteStall()
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	if si.closed {
+		return ErrClosed
+	}
+	si.writeMu.Lock()
+	if check != nil {
+		if err := check(); err != nil {
+			si.writeMu.Unlock()
+			return err
+		}
+	}
+	seq := atomic.LoadUint64(&si.lastSeq) + 1
+	b.SetSeq(seq)
+	if err := si.memt.PutBatch(b); err != nil {
+		si.writeMu.Unlock()
+		return err
+	}
+	atomic.StoreUint64(&si.lastSeq, seq+uint64(b.Count())-1)
+	si.writeMu.Unlock()
+
+	if opts.Sync {
+		if err := si.memt.SyncWal(); err != nil {
+			return err
+		}
+	}
+	si.addMemtSize(estimateSize)
+	return nil
+}
@@ -0,0 +1,89 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WriteStall is the condition of writes, writes are stalled when flushes or compactions fall behind
+type WriteStall int32
+
+const (
+	// WriteStallNone means writes are not stalled
+	WriteStallNone WriteStall = iota
+	// WriteStallSlowdown means every write is delayed by WriteSlowdownDelay
+	WriteStallSlowdown
+	// WriteStallStop means writes are blocked until flushes or compactions catch up
+	WriteStallStop
+)
+
+func (w WriteStall) String() string {
+	switch w {
+	case WriteStallNone:
+		return "none"
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallStop:
+		return "stop"
+	}
+	return "unknown"
+}
+
+// updateWriteStall recomputes the write stall condition by the number of immutable memtables,
+// the number of L0 ssts and pending compaction bytes. It should be called with mu locked
+// after memtables or ssts changed, writes blocked by WriteStallStop are woken up.
+func (si *StorageInner) updateWriteStall() {
+	opts := si.opts
+	imm := len(si.immMemt)
+	l0 := len(si.l0SSTables)
+	pending := si.compactionStrategy.EstimatePendingCompactionBytes(si.l0SSTables, si.levels)
+	atomic.StoreUint64(&si.pendingCompactionBytes, pending)
+	// ssts are only compacted explicitly, waiting for compactions may block writes forever
+	compactionStall := !opts.DisableAutoCompactions
+
+	stall := WriteStallNone
+	switch {
+	case si.closed:
+		// writes are rejected by ErrClosed instead
+	case imm >= opts.MemTableStopWritesTrigger,
+		compactionStall && l0 >= opts.Level0StopWritesTrigger,
+		compactionStall && pending >= opts.HardPendingCompactionBytesLimit:
+		stall = WriteStallStop
+	case imm >= opts.MemTableSlowdownWritesTrigger,
+		compactionStall && l0 >= opts.Level0SlowdownWritesTrigger,
+		compactionStall && pending >= opts.SoftPendingCompactionBytesLimit:
+		stall = WriteStallSlowdown
+	}
+
+	si.stallMu.Lock()
+	defer si.stallMu.Unlock()
+	if si.writeStall != stall {
+		logrus.WithField("immutableMemTables", imm).
+			WithField("l0SSTables", l0).
+			WithField("pendingCompactionBytes", pending).
+			Infof("write stall changes from %s to %s", si.writeStall, stall)
+		si.writeStall = stall
+		si.stallCond.Broadcast()
+	}
+}
+
+// waitWriteStall delays or blocks a write as the write stall condition requires,
+// it should be called before mu is locked.
+func (si *StorageInner) waitWriteStall() {
+	si.stallMu.Lock()
+	switch si.writeStall {
+	case WriteStallSlowdown:
+		si.stallMu.Unlock()
+		atomic.AddUint64(&si.delayedWrites, 1)
+		time.Sleep(si.opts.WriteSlowdownDelay)
+		return
+	case WriteStallStop:
+		atomic.AddUint64(&si.stoppedWrites, 1)
+		for si.writeStall == WriteStallStop {
+			si.stallCond.Wait()
+		}
+	}
+	si.stallMu.Unlock()
+}
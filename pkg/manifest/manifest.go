@@ -0,0 +1,177 @@
+package manifest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const sizeOfUint32 = 4
+
+// TableRecord tells which level a sst belongs to, level 0 is L0
+type TableRecord struct {
+	Level int    `json:"level"`
+	ID    uint32 `json:"id"`
+}
+
+// Record is one atomic change of the lsm structure
+type Record struct {
+	// Removed ssts are deleted from their level
+	Removed []TableRecord `json:"removed,omitempty"`
+	// Added ssts take the place of the first removed sst on the same level,
+	// or become the newest ones when nothing is removed from the level.
+	Added []TableRecord `json:"added,omitempty"`
+	// NextSSTID is the smallest sst id which is never allocated
+	NextSSTID uint32 `json:"next_sst_id"`
+	// LastSeq is the largest sequence number allocated when the record is added,
+	// it's not less than sequence numbers of all ssts.
+	LastSeq uint64 `json:"last_seq,omitempty"`
+}
+
+// Manifest is an append-only log of Record
+// Manifest writes every record in this layout following:
+// | recordLen(4B) | record(json) | checksum(4B) |
+type Manifest struct {
+	mu sync.Mutex
+	fd *os.File
+}
+
+// Create creates a new manifest file on path, the file should not exist
+func Create(path string) (*Manifest, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{fd: fd}, nil
+}
+
+// Recover reads all records in the manifest on path,
+// then returns the Manifest opened for appending.
+// A torn record at the tail is truncated.
+func Recover(path string) (*Manifest, []Record, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, valid, err := replay(bufio.NewReader(fd))
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	if err = fd.Truncate(valid); err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	if _, err = fd.Seek(valid, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	return &Manifest{fd: fd}, records, nil
+}
+
+func replay(r io.Reader) ([]Record, int64, error) {
+	records := make([]Record, 0)
+	var valid int64
+	var buf [sizeOfUint32]byte
+	for {
+		_, err := io.ReadFull(r, buf[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, valid, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(buf[:])+sizeOfUint32)
+		_, err = io.ReadFull(r, body)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, valid, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		payload := body[:len(body)-sizeOfUint32]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(body[len(payload):]) {
+			return records, valid, nil
+		}
+		var record Record
+		if err = json.Unmarshal(payload, &record); err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		valid += int64(sizeOfUint32 + len(body))
+	}
+}
+
+// AddRecord appends record to manifest and syncs it to disk
+func (m *Manifest) AddRecord(record Record) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sizeOfUint32+len(payload)+sizeOfUint32)
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[sizeOfUint32:], payload)
+	binary.BigEndian.PutUint32(buf[sizeOfUint32+len(payload):], crc32.ChecksumIEEE(payload))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err = m.fd.Write(buf); err != nil {
+		return err
+	}
+	return m.fd.Sync()
+}
+
+// Close closes the manifest file
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fd.Close()
+}
+
+// Apply applies record to levels, levels[0] is L0 which is ordered from the newest to the oldest
+// it returns the new levels, levels passed in may be modified.
+func (r Record) Apply(levels [][]uint32) [][]uint32 {
+	for _, t := range r.Added {
+		for len(levels) <= t.Level {
+			levels = append(levels, make([]uint32, 0))
+		}
+	}
+
+	// insertAt is where added ssts should be placed on every level
+	insertAt := make(map[int]int)
+	for _, t := range r.Removed {
+		if t.Level >= len(levels) {
+			continue
+		}
+		for i, id := range levels[t.Level] {
+			if id != t.ID {
+				continue
+			}
+			if at, ok := insertAt[t.Level]; !ok || i < at {
+				insertAt[t.Level] = i
+			}
+			levels[t.Level] = append(levels[t.Level][:i], levels[t.Level][i+1:]...)
+			break
+		}
+	}
+
+	added := make(map[int][]uint32)
+	for _, t := range r.Added {
+		added[t.Level] = append(added[t.Level], t.ID)
+	}
+	for level, ids := range added {
+		at, ok := insertAt[level]
+		if !ok {
+			at = 0
+		}
+		newLevel := make([]uint32, 0, len(levels[level])+len(ids))
+		newLevel = append(newLevel, levels[level][:at]...)
+		newLevel = append(newLevel, ids...)
+		levels[level] = append(newLevel, levels[level][at:]...)
+	}
+	return levels
+}
@@ -0,0 +1,68 @@
+package manifest_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/manifest"
+)
+
+func TestManifestRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MANIFEST")
+	m, err := manifest.Create(path)
+	assert.Nil(t, err)
+	records := []manifest.Record{
+		{Added: []manifest.TableRecord{{Level: 0, ID: 1}}, NextSSTID: 2},
+		{Added: []manifest.TableRecord{{Level: 0, ID: 2}}, NextSSTID: 3},
+		{
+			Removed:   []manifest.TableRecord{{Level: 0, ID: 1}},
+			Added:     []manifest.TableRecord{{Level: 1, ID: 3}},
+			NextSSTID: 4,
+		},
+	}
+	for _, record := range records {
+		assert.Nil(t, m.AddRecord(record))
+	}
+	assert.Nil(t, m.Close())
+
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	// a torn record at the tail should be dropped
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.Nil(t, err)
+	_, err = fd.Write([]byte{0, 0, 0, 100, '{'})
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	m, recovered, err := manifest.Recover(path)
+	assert.Nil(t, err)
+	assert.Equal(t, records, recovered)
+	assert.Nil(t, m.Close())
+	fiRecovered, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), fiRecovered.Size())
+}
+
+func TestRecordApply(t *testing.T) {
+	levels := make([][]uint32, 1)
+	for id := uint32(1); id <= 4; id++ {
+		levels = manifest.Record{Added: []manifest.TableRecord{{Level: 0, ID: id}}}.Apply(levels)
+	}
+	assert.Equal(t, [][]uint32{{4, 3, 2, 1}}, levels)
+
+	// added sst takes the place of the removed ones
+	levels = manifest.Record{
+		Removed: []manifest.TableRecord{{Level: 0, ID: 2}, {Level: 0, ID: 1}},
+		Added:   []manifest.TableRecord{{Level: 0, ID: 5}},
+	}.Apply(levels)
+	assert.Equal(t, [][]uint32{{4, 3, 5}}, levels)
+
+	levels = manifest.Record{
+		Removed: []manifest.TableRecord{{Level: 0, ID: 5}},
+		Added:   []manifest.TableRecord{{Level: 2, ID: 6}, {Level: 2, ID: 7}},
+	}.Apply(levels)
+	assert.Equal(t, [][]uint32{{4, 3}, {}, {6, 7}}, levels)
+}
@@ -6,26 +6,106 @@ import (
 
 	"github.com/huandu/skiplist"
 
+	"mini-lsm/pkg/batch"
+	"mini-lsm/pkg/iterator"
+	"mini-lsm/pkg/mvcc"
 	"mini-lsm/pkg/sst"
+	"mini-lsm/pkg/wal"
 )
 
+// Table is keyed by internal keys(see mvcc), every write adds a new version of its key
 type Table struct {
 	mu sync.RWMutex
 	m  *skiplist.SkipList
+	// maxSeq is the largest sequence number written to Table
+	maxSeq uint64
+	// rangeTombstones are written by DeleteRange, they are not applied by Get and Scan of Table
+	rangeTombstones mvcc.RangeTombstones
+
+	// id is same as the id of sst which this Table will be flushed to
+	id uint32
+	// wal is nil if this Table is not backed by a write-ahead log
+	wal *wal.Wal
 }
 
+// NewTable returns a Table without write-ahead log
 func NewTable() *Table {
 	return &Table{m: skiplist.New(skiplist.Bytes)}
 }
 
-func (t *Table) Get(key []byte) []byte {
+// NewTableWithWal returns a Table which logs every write to a new wal segment on path
+func NewTableWithWal(id uint32, path string) (*Table, error) {
+	w, err := wal.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Table{m: skiplist.New(skiplist.Bytes), id: id, wal: w}, nil
+}
+
+// RecoverFromWal rebuilds a Table from the wal segment on path,
+// later writes will be appended to the same segment.
+// Records written before sequence numbers were introduced take seqs after lastSeq in the order they are replayed,
+// so a later write of the same key shadows an earlier one, MaxSeq covers them.
+func RecoverFromWal(id uint32, path string, lastSeq uint64) (*Table, error) {
+	t := &Table{m: skiplist.New(skiplist.Bytes), id: id}
+	w, err := wal.Recover(path, func(key, value []byte) error {
+		if len(key) == 0 {
+			b, err := batch.Decode(value)
+			if err != nil {
+				return err
+			}
+			t.applyBatch(b)
+			return nil
+		}
+		if t.maxSeq > lastSeq {
+			lastSeq = t.maxSeq
+		}
+		lastSeq++
+		t.set(key, lastSeq, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.wal = w
+	return t, nil
+}
+
+func (t *Table) ID() uint32 {
+	return t.id
+}
+
+func (t *Table) IsEmpty() bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	ele, ok := t.m.GetValue(key)
-	if !ok {
-		return nil
+	return t.m.Len() == 0 && len(t.rangeTombstones) == 0
+}
+
+// MaxSeq returns the largest sequence number written to Table
+func (t *Table) MaxSeq() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.maxSeq
+}
+
+// Get returns the value of the newest version of key visible at seq and whether it's found,
+// value of a deleted key is a tombstone(see iterator.IsTombstone).
+func (t *Table) Get(key []byte, seq uint64) ([]byte, bool) {
+	value, _, found := t.GetVersion(key, seq)
+	return value, found
+}
+
+// GetVersion is like Get, it also returns the seq of the version found
+func (t *Table) GetVersion(key []byte, seq uint64) ([]byte, uint64, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	seekKey := mvcc.SeekKey(key, seq)
+	ele := t.m.Find(seekKey)
+	if ele == nil || !mvcc.SameUserKey(ele.Key().([]byte), seekKey) {
+		return nil, 0, false
 	}
-	return inlineDeepCopy(ele.([]byte))
+	_, version, _, _ := mvcc.ParseKey(ele.Key().([]byte))
+	return inlineDeepCopy(ele.Value.([]byte)), version, true
 }
 
 func inlineDeepCopy(in []byte) (out []byte) {
@@ -34,20 +114,116 @@ func inlineDeepCopy(in []byte) (out []byte) {
 	return out
 }
 
-func (t *Table) Put(key, value []byte) {
+// Put writes key-value at seq to wal first(if there is one), then to Table,
+// an empty value is a tombstone.
+func (t *Table) Put(key []byte, seq uint64, value []byte) error {
+	b := batch.New()
+	if len(value) == 0 {
+		b.Delete(key)
+	} else {
+		b.Put(key, value)
+	}
+	b.SetSeq(seq)
+	return t.PutBatch(b)
+}
+
+// PutBatch writes b to wal as one record first(if there is one), then applies all entries of b to Table,
+// readers see either none or all of them.
+func (t *Table) PutBatch(b *batch.Batch) error {
 	t.mu.Lock()
-	t.m.Set(inlineDeepCopy(key), inlineDeepCopy(value))
-	t.mu.Unlock()
+	defer t.mu.Unlock()
+	if t.wal != nil {
+		if err := t.wal.PutBatch(b.Encode()); err != nil {
+			return err
+		}
+	}
+	t.applyBatch(b)
+	return nil
 }
 
-func (t *Table) Scan(lower, upper []byte) *Iterator {
+// applyBatch sets every entry of b at its seq, Delete is set as a tombstone
+func (t *Table) applyBatch(b *batch.Batch) {
+	seq := b.Seq()
+	_ = b.Iterate(func(kind batch.Kind, key, value []byte) error {
+		switch kind {
+		case batch.KindRangeDelete:
+			t.addRangeTombstone(key, value, seq)
+		case batch.KindDelete:
+			t.set(key, seq, nil)
+		default:
+			t.set(key, seq, value)
+		}
+		seq++
+		return nil
+	})
+}
+
+func (t *Table) addRangeTombstone(start, end []byte, seq uint64) {
+	t.rangeTombstones = append(t.rangeTombstones, mvcc.RangeTombstone{
+		Start: inlineDeepCopy(start),
+		End:   inlineDeepCopy(end),
+		Seq:   seq,
+	})
+	if seq > t.maxSeq {
+		t.maxSeq = seq
+	}
+}
+
+// RangeTombstones returns range tombstones written to Table
+func (t *Table) RangeTombstones() mvcc.RangeTombstones {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	head := t.m.Find(lower)
-	return &Iterator{ele: head, end: upper}
+	return t.rangeTombstones[:len(t.rangeTombstones):len(t.rangeTombstones)]
+}
+
+// set adds the version of key at seq, its kind is decided by whether value is a tombstone
+func (t *Table) set(key []byte, seq uint64, value []byte) {
+	kind := mvcc.KindPut
+	if len(value) == 0 {
+		kind = mvcc.KindDelete
+	}
+	t.m.Set(mvcc.MakeKey(key, seq, kind), inlineDeepCopy(value))
+	if seq > t.maxSeq {
+		t.maxSeq = seq
+	}
 }
 
+// SyncWal makes all writes of Table durable on disk
+func (t *Table) SyncWal() error {
+	if t.wal == nil {
+		return nil
+	}
+	return t.wal.Sync()
+}
+
+// CloseWal closes the wal segment, the Table should not be written after CloseWal
+func (t *Table) CloseWal() error {
+	if t.wal == nil {
+		return nil
+	}
+	return t.wal.Close()
+}
+
+// Scan returns an Iterator of all versions of user keys in [lower, upper], its keys are internal keys,
+// nil upper scans to the last key.
+func (t *Table) Scan(lower, upper []byte) *Iterator {
+	iter := &Iterator{
+		t:     t,
+		start: mvcc.SeekKey(lower, mvcc.MaxSeq),
+	}
+	if upper != nil {
+		// the largest internal key of upper
+		iter.end = mvcc.MakeKey(upper, 0, mvcc.KindDelete)
+	}
+	iter.SeekToFirst()
+	return iter
+}
+
+// Flush adds all versions and range tombstones in Table to builder
 func (t *Table) Flush(builder *sst.TableBuilder) {
+	for _, tombstone := range t.rangeTombstones {
+		builder.AddRangeTombstone(tombstone)
+	}
 	head := t.m.Front()
 	if head == nil {
 		return
@@ -62,11 +238,17 @@ func (t *Table) Flush(builder *sst.TableBuilder) {
 	}
 }
 
+// Iterator iterates versions of Table in [start, end]
 type Iterator struct {
+	t   *Table
 	ele *skiplist.Element
-	end []byte
+	// start and end are the smallest and the largest internal keys of Iterator, nil end is unbounded
+	start []byte
+	end   []byte
 }
 
+var _ iterator.Iter = (*Iterator)(nil)
+
 func (m *Iterator) Value() []byte {
 	return inlineDeepCopy(m.ele.Value.([]byte))
 }
@@ -82,10 +264,79 @@ func (m *Iterator) IsValid() bool {
 	return m.ele != nil && len(m.ele.Key().([]byte)) != 0
 }
 
+// Err always returns nil, memtable is in memory
+func (m *Iterator) Err() error {
+	return nil
+}
+
 func (m *Iterator) Next() {
+	if !m.IsValid() {
+		return
+	}
 	m.ele = m.ele.Next()
-	if m.ele != nil && bytes.Compare(m.ele.Key().([]byte), m.end) == 1 {
-		m.ele = nil
+	m.checkEnd()
+}
+
+func (m *Iterator) Prev() {
+	if !m.IsValid() {
 		return
 	}
+	m.ele = m.ele.Prev()
+	m.checkStart()
+}
+
+func (m *Iterator) Seek(key []byte) {
+	if bytes.Compare(key, m.start) < 0 {
+		key = m.start
+	}
+	m.t.mu.RLock()
+	defer m.t.mu.RUnlock()
+	m.ele = m.t.m.Find(key)
+	m.checkEnd()
+}
+
+func (m *Iterator) SeekForPrev(key []byte) {
+	if m.end != nil && bytes.Compare(key, m.end) > 0 {
+		key = m.end
+	}
+	m.t.mu.RLock()
+	defer m.t.mu.RUnlock()
+	// the element before the first one greater than key
+	ele := m.t.m.Find(key)
+	if ele == nil {
+		ele = m.t.m.Back()
+	} else if !bytes.Equal(ele.Key().([]byte), key) {
+		ele = ele.Prev()
+	}
+	m.ele = ele
+	m.checkStart()
+}
+
+func (m *Iterator) SeekToFirst() {
+	m.Seek(m.start)
+}
+
+func (m *Iterator) SeekToLast() {
+	if m.end != nil {
+		m.SeekForPrev(m.end)
+		return
+	}
+	m.t.mu.RLock()
+	defer m.t.mu.RUnlock()
+	m.ele = m.t.m.Back()
+	m.checkStart()
+}
+
+// checkEnd makes Iterator invalid if it's after end
+func (m *Iterator) checkEnd() {
+	if m.ele != nil && m.end != nil && bytes.Compare(m.ele.Key().([]byte), m.end) > 0 {
+		m.ele = nil
+	}
+}
+
+// checkStart makes Iterator invalid if it's before start
+func (m *Iterator) checkStart() {
+	if m.ele != nil && bytes.Compare(m.ele.Key().([]byte), m.start) < 0 {
+		m.ele = nil
+	}
 }
@@ -1,26 +1,186 @@
 package memtable_test
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"mini-lsm/pkg/batch"
 	"mini-lsm/pkg/memtable"
+	"mini-lsm/pkg/mvcc"
 	"mini-lsm/pkg/test"
+	"mini-lsm/pkg/wal"
 )
 
 func TestMemtable(t *testing.T) {
 	tb := memtable.NewTable()
 	for i := uint64(0); i < 100; i++ {
-		tb.Put(test.KeyOf(i), test.ValueOf(i))
+		tb.Put(test.KeyOf(i), i+1, test.ValueOf(i))
 	}
 	iter := tb.Scan(test.KeyOf(10), test.KeyOf(20))
 	for i := uint64(10); i <= 20; i++ {
-		expectKey := test.KeyOf(i)
+		expectKey := mvcc.MakeKey(test.KeyOf(i), i+1, mvcc.KindPut)
 		expectValue := test.ValueOf(i)
 		assert.True(t, iter.IsValid())
 		assert.Equalf(t, expectKey, iter.Key(), "expect key %s, actual key: %s", expectKey, iter.Key())
 		assert.Equalf(t, expectValue, iter.Value(), "expect key %s, actual key: %s", expectValue, iter.Value())
 		iter.Next()
 	}
+	assert.False(t, iter.IsValid())
+	assert.Equal(t, uint64(100), tb.MaxSeq())
+
+	// backward in the same bounds
+	iter.SeekToLast()
+	for i := uint64(20); i >= 10; i-- {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, mvcc.MakeKey(test.KeyOf(i), i+1, mvcc.KindPut), iter.Key())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+	iter.SeekForPrev(mvcc.SeekKey(test.KeyOf(15), mvcc.MaxSeq))
+	assert.Equal(t, mvcc.MakeKey(test.KeyOf(14), 15, mvcc.KindPut), iter.Key())
+	iter.Next()
+	assert.Equal(t, mvcc.MakeKey(test.KeyOf(15), 16, mvcc.KindPut), iter.Key())
+	iter.SeekForPrev(mvcc.SeekKey(test.KeyOf(10), mvcc.MaxSeq))
+	assert.False(t, iter.IsValid())
+	iter.Seek(mvcc.SeekKey(test.KeyOf(21), mvcc.MaxSeq))
+	assert.False(t, iter.IsValid())
+	iter.Seek(mvcc.SeekKey(test.KeyOf(0), mvcc.MaxSeq))
+	assert.Equal(t, mvcc.MakeKey(test.KeyOf(10), 11, mvcc.KindPut), iter.Key())
+
+	// nil bounds are unbounded
+	iter = tb.Scan(nil, nil)
+	assert.Equal(t, mvcc.MakeKey(test.KeyOf(0), 1, mvcc.KindPut), iter.Key())
+	iter.SeekToLast()
+	assert.Equal(t, mvcc.MakeKey(test.KeyOf(99), 100, mvcc.KindPut), iter.Key())
+	iter.SeekForPrev(mvcc.SeekKey(test.KeyOf(1000), mvcc.MaxSeq))
+	assert.Equal(t, mvcc.MakeKey(test.KeyOf(99), 100, mvcc.KindPut), iter.Key())
+	iter.Next()
+	assert.False(t, iter.IsValid())
+}
+
+func TestMemtableVersions(t *testing.T) {
+	tb := memtable.NewTable()
+	assert.Nil(t, tb.Put(test.KeyOf(1), 10, test.ValueOf(10)))
+	assert.Nil(t, tb.Put(test.KeyOf(1), 20, test.ValueOf(20)))
+	assert.Nil(t, tb.Put(test.KeyOf(1), 30, nil))
+
+	_, ok := tb.Get(test.KeyOf(1), 9)
+	assert.False(t, ok)
+	for _, c := range []struct {
+		seq   uint64
+		value []byte
+	}{{10, test.ValueOf(10)}, {19, test.ValueOf(10)}, {20, test.ValueOf(20)}, {30, nil}, {mvcc.MaxSeq, nil}} {
+		value, ok := tb.Get(test.KeyOf(1), c.seq)
+		assert.True(t, ok)
+		if c.value == nil {
+			assert.Empty(t, value)
+		} else {
+			assert.Equal(t, c.value, value)
+		}
+	}
+	_, ok = tb.Get(test.KeyOf(0), mvcc.MaxSeq)
+	assert.False(t, ok)
+	_, ok = tb.Get(test.KeyOf(2), mvcc.MaxSeq)
+	assert.False(t, ok)
+
+	// versions are scanned from the newest to the oldest
+	iter := tb.Scan(test.KeyOf(1), test.KeyOf(1))
+	for _, seq := range []uint64{30, 20, 10} {
+		assert.True(t, iter.IsValid())
+		_, actual, _, err := mvcc.ParseKey(iter.Key())
+		assert.Nil(t, err)
+		assert.Equal(t, seq, actual)
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+}
+
+func TestMemtablePutBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	tb, err := memtable.NewTableWithWal(1, path)
+	assert.Nil(t, err)
+	assert.Nil(t, tb.Put(test.KeyOf(0), 1, test.ValueOf(0)))
+	b := batch.New()
+	b.Delete(test.KeyOf(0))
+	b.Put(test.KeyOf(1), test.ValueOf(1))
+	b.Put(test.KeyOf(2), test.ValueOf(2))
+	b.SetSeq(2)
+	assert.Nil(t, tb.PutBatch(b))
+	assert.Nil(t, tb.CloseWal())
+
+	for _, table := range []*memtable.Table{tb, mustRecover(t, path)} {
+		assert.Equal(t, uint64(4), table.MaxSeq())
+		value, ok := table.Get(test.KeyOf(0), 1)
+		assert.True(t, ok)
+		assert.Equal(t, test.ValueOf(0), value)
+		value, ok = table.Get(test.KeyOf(0), 4)
+		assert.True(t, ok)
+		assert.Empty(t, value)
+		for i := uint64(1); i <= 2; i++ {
+			_, ok = table.Get(test.KeyOf(i), i)
+			assert.False(t, ok)
+			value, ok = table.Get(test.KeyOf(i), i+2)
+			assert.True(t, ok)
+			assert.Equal(t, test.ValueOf(i), value)
+		}
+	}
+}
+
+func TestMemtableDeleteRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	tb, err := memtable.NewTableWithWal(1, path)
+	assert.Nil(t, err)
+	b := batch.New()
+	b.Put(test.KeyOf(0), test.ValueOf(0))
+	b.DeleteRange(test.KeyOf(10), test.KeyOf(20))
+	b.SetSeq(1)
+	assert.Nil(t, tb.PutBatch(b))
+	assert.Nil(t, tb.CloseWal())
+
+	expected := mvcc.RangeTombstones{{Start: test.KeyOf(10), End: test.KeyOf(20), Seq: 2}}
+	for _, table := range []*memtable.Table{tb, mustRecover(t, path)} {
+		assert.False(t, table.IsEmpty())
+		assert.Equal(t, uint64(2), table.MaxSeq())
+		assert.Equal(t, expected, table.RangeTombstones())
+		// range tombstones are not point versions
+		_, ok := table.Get(test.KeyOf(10), 2)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, uint64(2), tb.RangeTombstones().CoveringSeq(test.KeyOf(19), 2))
+	assert.Zero(t, tb.RangeTombstones().CoveringSeq(test.KeyOf(19), 1))
+	assert.Zero(t, tb.RangeTombstones().CoveringSeq(test.KeyOf(20), 2))
+}
+
+func TestMemtableRecoverLegacyWal(t *testing.T) {
+	// records written before sequence numbers take seqs after lastSeq in order
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := wal.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Put(test.KeyOf(0), test.ValueOf(0)))
+	assert.Nil(t, w.Put(test.KeyOf(1), test.ValueOf(1)))
+	assert.Nil(t, w.Put(test.KeyOf(1), nil))
+	assert.Nil(t, w.Close())
+
+	tb, err := memtable.RecoverFromWal(1, path, 10)
+	assert.Nil(t, err)
+	t.Cleanup(func() { tb.CloseWal() })
+	assert.Equal(t, uint64(13), tb.MaxSeq())
+	value, ok := tb.Get(test.KeyOf(0), mvcc.MaxSeq)
+	assert.True(t, ok)
+	assert.Equal(t, test.ValueOf(0), value)
+	value, ok = tb.Get(test.KeyOf(1), mvcc.MaxSeq)
+	assert.True(t, ok)
+	assert.Empty(t, value)
+	value, ok = tb.Get(test.KeyOf(1), 12)
+	assert.True(t, ok)
+	assert.Equal(t, test.ValueOf(1), value)
+}
+
+func mustRecover(t *testing.T, path string) *memtable.Table {
+	tb, err := memtable.RecoverFromWal(1, path, 0)
+	assert.Nil(t, err)
+	t.Cleanup(func() { tb.CloseWal() })
+	return tb
 }
@@ -0,0 +1,227 @@
+package mvcc
+
+import (
+	"bytes"
+
+	"mini-lsm/pkg/iterator"
+)
+
+// Iterator turns an Iter of internal keys into an Iter of user keys.
+// It returns the newest version of every user key visible at seq, deleted keys are skipped,
+// including keys deleted by range tombstones.
+// The Iter should be ordered by internal key, like MergeIterator does.
+type Iterator struct {
+	iter iterator.Iter
+	seq  uint64
+	// key is the user key of the current version
+	key []byte
+	// reverse is set when Iterator moves backward, iter is before the versions of key then,
+	// so the current version is copied to value.
+	reverse bool
+	value   []byte
+	// lastKey is the internal key of the last version returned or skipped as a deletion,
+	// older versions of the same user key are shadowed by it.
+	lastKey []byte
+	// keepTombstones returns deleted keys with their tombstones instead of skipping them,
+	// deleted is set if the current version is deleted.
+	keepTombstones  bool
+	deleted         bool
+	rangeTombstones RangeTombstones
+	err             error
+}
+
+var _ iterator.Iter = (*Iterator)(nil)
+
+// NewIterator returns an Iterator reading iter at seq
+func NewIterator(iter iterator.Iter, seq uint64) *Iterator {
+	m := &Iterator{iter: iter, seq: seq}
+	m.findVisible()
+	return m
+}
+
+// NewIteratorWithRangeTombstones is like NewIterator, versions deleted by rangeTombstones are skipped as well
+func NewIteratorWithRangeTombstones(iter iterator.Iter, seq uint64, rangeTombstones RangeTombstones) *Iterator {
+	m := &Iterator{iter: iter, seq: seq, rangeTombstones: rangeTombstones}
+	m.findVisible()
+	return m
+}
+
+// NewIteratorWithTombstones is like NewIterator, but deleted keys are returned with tombstones as values,
+// so that they shadow the same keys of other Iters merged after it.
+func NewIteratorWithTombstones(iter iterator.Iter, seq uint64) *Iterator {
+	m := &Iterator{iter: iter, seq: seq, keepTombstones: true}
+	m.findVisible()
+	return m
+}
+
+// InternalBounds converts Bounds of user keys to Bounds of their internal keys,
+// an Iter of internal keys bounded by them iterates all versions of user keys in bounds.
+func InternalBounds(bounds iterator.Bounds) iterator.Bounds {
+	internal := iterator.Bounds{ExcludeLower: bounds.ExcludeLower, ExcludeUpper: bounds.ExcludeUpper}
+	if bounds.Lower != nil {
+		if bounds.ExcludeLower {
+			// the largest internal key of Lower
+			internal.Lower = MakeKey(bounds.Lower, 0, KindDelete)
+		} else {
+			internal.Lower = SeekKey(bounds.Lower, MaxSeq)
+		}
+	}
+	if bounds.Upper != nil {
+		if bounds.ExcludeUpper {
+			internal.Upper = SeekKey(bounds.Upper, MaxSeq)
+		} else {
+			internal.Upper = MakeKey(bounds.Upper, 0, KindDelete)
+		}
+	}
+	return internal
+}
+
+// findVisible moves iter to the first visible version of a user key which is not returned yet
+func (m *Iterator) findVisible() {
+	m.key = nil
+	for m.iter.IsValid() {
+		key := m.iter.Key()
+		if m.lastKey != nil && SameUserKey(key, m.lastKey) {
+			m.iter.Next()
+			continue
+		}
+		userKey, seq, kind, err := ParseKey(key)
+		if err != nil {
+			m.err = err
+			return
+		}
+		if seq > m.seq {
+			m.iter.Next()
+			continue
+		}
+		m.lastKey = append(m.lastKey[:0], key...)
+		deleted := kind == KindDelete || m.rangeTombstones.CoveringSeq(userKey, m.seq) > seq
+		if deleted && !m.keepTombstones {
+			m.iter.Next()
+			continue
+		}
+		m.key = append([]byte{}, userKey...)
+		m.deleted = deleted
+		return
+	}
+}
+
+func (m *Iterator) Key() []byte {
+	if !m.IsValid() {
+		return nil
+	}
+	return m.key
+}
+
+func (m *Iterator) Value() []byte {
+	if !m.IsValid() {
+		return nil
+	}
+	if m.deleted {
+		return []byte{}
+	}
+	if m.reverse {
+		return m.value
+	}
+	return m.iter.Value()
+}
+
+func (m *Iterator) IsValid() bool {
+	return m.err == nil && m.key != nil && (m.reverse || m.iter.IsValid())
+}
+
+// Err returns the error of iter or the error of parsing an internal key
+func (m *Iterator) Err() error {
+	if m.err != nil {
+		return m.err
+	}
+	return m.iter.Err()
+}
+
+func (m *Iterator) Next() {
+	if !m.IsValid() {
+		return
+	}
+	if m.reverse {
+		// versions of key are skipped by lastKey
+		m.iter.Seek(SeekKey(m.key, MaxSeq))
+		m.lastKey = MakeKey(m.key, 0, KindDelete)
+		m.reverse = false
+	} else {
+		m.iter.Next()
+	}
+	m.findVisible()
+}
+
+func (m *Iterator) Prev() {
+	if !m.IsValid() {
+		return
+	}
+	if !m.reverse {
+		m.iter.SeekForPrev(SeekKey(m.key, MaxSeq))
+		m.reverse = true
+	}
+	m.findPrevVisible()
+}
+
+// Seek moves to the first user key not less than key which has a visible version
+func (m *Iterator) Seek(key []byte) {
+	m.iter.Seek(SeekKey(key, MaxSeq))
+	m.resetForward()
+}
+
+// SeekForPrev moves to the last user key not greater than key which has a visible version
+func (m *Iterator) SeekForPrev(key []byte) {
+	// the largest internal key of key
+	m.iter.SeekForPrev(MakeKey(key, 0, KindDelete))
+	m.reverse = true
+	m.findPrevVisible()
+}
+
+func (m *Iterator) SeekToFirst() {
+	m.iter.SeekToFirst()
+	m.resetForward()
+}
+
+func (m *Iterator) SeekToLast() {
+	m.iter.SeekToLast()
+	m.reverse = true
+	m.findPrevVisible()
+}
+
+func (m *Iterator) resetForward() {
+	m.reverse, m.lastKey, m.err = false, nil, nil
+	m.findVisible()
+}
+
+// findPrevVisible moves iter backward over the previous user key which has a visible version,
+// versions of a user key are met from the oldest, so the last one visible at seq is the current version.
+func (m *Iterator) findPrevVisible() {
+	m.key, m.value, m.err = nil, nil, nil
+	var key, value []byte
+	found, deleted := false, false
+	for m.iter.IsValid() {
+		userKey, seq, kind, err := ParseKey(m.iter.Key())
+		if err != nil {
+			m.err = err
+			return
+		}
+		if found && !bytes.Equal(userKey, key) {
+			if !deleted || m.keepTombstones {
+				break
+			}
+			found = false
+		}
+		if seq <= m.seq {
+			key = append(key[:0], userKey...)
+			value = append(value[:0], m.iter.Value()...)
+			deleted = kind == KindDelete || m.rangeTombstones.CoveringSeq(userKey, m.seq) > seq
+			found = true
+		}
+		m.iter.Prev()
+	}
+	if !found || deleted && !m.keepTombstones || m.iter.Err() != nil {
+		return
+	}
+	m.key, m.value, m.deleted = key, value, deleted
+}
@@ -0,0 +1,136 @@
+package mvcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Kind is the value type of a version
+type Kind uint8
+
+const (
+	KindDelete Kind = 0
+	KindPut    Kind = 1
+	// KindRangeDelete is the kind of RangeTombstone, it's never the kind of a point version
+	KindRangeDelete Kind = 2
+	// kindSeek sorts before every kind of the same seq, it's only used by SeekKey
+	kindSeek Kind = 0xff
+)
+
+// MaxSeq is the largest sequence number, seq takes the high 56 bits of trailer
+const MaxSeq uint64 = 1<<56 - 1
+
+const (
+	escapeByte     = 0x00
+	escapedZero    = 0xff
+	terminatorByte = 0x01
+	trailerSize    = 8
+	// suffixSize is the size of terminator and trailer
+	suffixSize = 2 + trailerSize
+)
+
+var ErrInvalidKey = errors.New("invalid internal key")
+
+// Internal keys are stored in memtables and ssts, every version of a user key has its own internal key.
+// Internal key is in this layout:
+// | escaped user key | 0x00 0x01 | ^(seq<<8 | kind)(8B big endian) |
+// every 0x00 in user key is escaped as 0x00 0xff, so internal keys compared by bytes.Compare are
+// ordered by user key ascending, then by seq descending, the newest version of a user key comes first.
+
+// AppendKey appends the internal key of userKey at seq to dst
+func AppendKey(dst, userKey []byte, seq uint64, kind Kind) []byte {
+	for {
+		i := bytes.IndexByte(userKey, escapeByte)
+		if i < 0 {
+			dst = append(dst, userKey...)
+			break
+		}
+		dst = append(dst, userKey[:i+1]...)
+		dst = append(dst, escapedZero)
+		userKey = userKey[i+1:]
+	}
+	dst = append(dst, escapeByte, terminatorByte)
+	return binary.BigEndian.AppendUint64(dst, ^(seq<<8 | uint64(kind)))
+}
+
+// MakeKey returns the internal key of userKey at seq
+func MakeKey(userKey []byte, seq uint64, kind Kind) []byte {
+	return AppendKey(make([]byte, 0, len(userKey)+suffixSize), userKey, seq, kind)
+}
+
+// SeekKey returns the smallest internal key of userKey whose version is visible at seq,
+// seeking it finds the newest version of userKey not newer than seq.
+func SeekKey(userKey []byte, seq uint64) []byte {
+	return MakeKey(userKey, seq, kindSeek)
+}
+
+// ParseKey splits an internal key into its user key, seq and kind,
+// userKey shares memory with key unless user key contains 0x00.
+func ParseKey(key []byte) (userKey []byte, seq uint64, kind Kind, err error) {
+	escaped, ok := escapedUserKey(key)
+	if !ok {
+		return nil, 0, 0, ErrInvalidKey
+	}
+	if userKey, ok = unescape(escaped); !ok {
+		return nil, 0, 0, ErrInvalidKey
+	}
+	trailer := ^binary.BigEndian.Uint64(key[len(key)-trailerSize:])
+	return userKey, trailer >> 8, Kind(trailer), nil
+}
+
+// UserKey returns the user key of an internal key, it's nil if key is not a valid internal key
+func UserKey(key []byte) []byte {
+	escaped, ok := escapedUserKey(key)
+	if !ok {
+		return nil
+	}
+	userKey, _ := unescape(escaped)
+	return userKey
+}
+
+// CompareUserKey compares user keys of internal keys a and b
+func CompareUserKey(a, b []byte) int {
+	return bytes.Compare(trimSuffix(a), trimSuffix(b))
+}
+
+// SameUserKey returns whether internal keys a and b are versions of the same user key
+func SameUserKey(a, b []byte) bool {
+	return bytes.Equal(trimSuffix(a), trimSuffix(b))
+}
+
+func trimSuffix(key []byte) []byte {
+	if len(key) < suffixSize {
+		return key
+	}
+	return key[:len(key)-suffixSize]
+}
+
+// escapedUserKey returns the escaped user key of key, it checks the terminator only
+func escapedUserKey(key []byte) ([]byte, bool) {
+	if len(key) < suffixSize {
+		return nil, false
+	}
+	n := len(key) - suffixSize
+	if key[n] != escapeByte || key[n+1] != terminatorByte {
+		return nil, false
+	}
+	return key[:n], true
+}
+
+func unescape(escaped []byte) ([]byte, bool) {
+	i := bytes.IndexByte(escaped, escapeByte)
+	if i < 0 {
+		return escaped, true
+	}
+	userKey := make([]byte, 0, len(escaped))
+	for i >= 0 {
+		if i+1 >= len(escaped) || escaped[i+1] != escapedZero {
+			return nil, false
+		}
+		userKey = append(userKey, escaped[:i+1]...)
+		escaped = escaped[i+2:]
+		i = bytes.IndexByte(escaped, escapeByte)
+	}
+	return append(userKey, escaped...), true
+}
@@ -0,0 +1,219 @@
+package mvcc_test
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/iterator"
+	"mini-lsm/pkg/mvcc"
+)
+
+func TestKeyEncodeDecode(t *testing.T) {
+	for _, userKey := range [][]byte{
+		[]byte("a"), {}, {0}, {0, 0}, {0xff, 0}, []byte("a\x00b\x00"), {0, 1}, {1, 0, 0xff},
+	} {
+		for _, seq := range []uint64{0, 1, 1 << 40, mvcc.MaxSeq} {
+			for _, kind := range []mvcc.Kind{mvcc.KindPut, mvcc.KindDelete} {
+				key := mvcc.MakeKey(userKey, seq, kind)
+				actualKey, actualSeq, actualKind, err := mvcc.ParseKey(key)
+				assert.Nil(t, err)
+				assert.Equal(t, userKey, actualKey)
+				assert.Equal(t, seq, actualSeq)
+				assert.Equal(t, kind, actualKind)
+				assert.Equal(t, userKey, mvcc.UserKey(key))
+			}
+		}
+	}
+	for _, invalid := range [][]byte{nil, []byte("a"), []byte("0123456789"), append([]byte{0}, mvcc.MakeKey(nil, 1, mvcc.KindPut)...)} {
+		_, _, _, err := mvcc.ParseKey(invalid)
+		assert.ErrorIs(t, err, mvcc.ErrInvalidKey)
+		assert.Nil(t, mvcc.UserKey(invalid))
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	// ordered by user key ascending, then by seq descending
+	expected := [][]byte{
+		mvcc.MakeKey([]byte(""), 1, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a"), 2, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a"), 1, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a"), 1, mvcc.KindDelete),
+		mvcc.MakeKey([]byte("a"), 0, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a\x00"), mvcc.MaxSeq, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a\x00\x00"), 5, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a\x00\x01"), 5, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a\x01"), 5, mvcc.KindPut),
+		mvcc.MakeKey([]byte("a\xff"), 5, mvcc.KindPut),
+		mvcc.MakeKey([]byte("b"), 5, mvcc.KindPut),
+	}
+	actual := make([][]byte, 0, len(expected))
+	for i := len(expected) - 1; i >= 0; i-- {
+		actual = append(actual, expected[i])
+	}
+	sort.Slice(actual, func(i, j int) bool { return bytes.Compare(actual[i], actual[j]) < 0 })
+	assert.Equal(t, expected, actual)
+
+	for i := 1; i < len(expected); i++ {
+		assert.LessOrEqual(t, mvcc.CompareUserKey(expected[i-1], expected[i]), 0)
+	}
+	assert.True(t, mvcc.SameUserKey(expected[1], expected[4]))
+	assert.False(t, mvcc.SameUserKey(expected[4], expected[5]))
+
+	// SeekKey is not greater than every version visible at seq
+	seekKey := mvcc.SeekKey([]byte("a"), 1)
+	assert.Positive(t, bytes.Compare(seekKey, expected[1]))
+	assert.Negative(t, bytes.Compare(seekKey, expected[2]))
+}
+
+// sliceIter iterates keys in order, it's invalid when idx is out of keys
+type sliceIter struct {
+	keys, values [][]byte
+	idx          int
+}
+
+func (s *sliceIter) Key() []byte   { return s.keys[s.idx] }
+func (s *sliceIter) Value() []byte { return s.values[s.idx] }
+func (s *sliceIter) IsValid() bool { return s.idx >= 0 && s.idx < len(s.keys) }
+func (s *sliceIter) Err() error    { return nil }
+func (s *sliceIter) Next() {
+	if s.IsValid() {
+		s.idx++
+	}
+}
+func (s *sliceIter) Prev() {
+	if s.IsValid() {
+		s.idx--
+	}
+}
+func (s *sliceIter) Seek(key []byte) {
+	s.idx = sort.Search(len(s.keys), func(i int) bool { return bytes.Compare(s.keys[i], key) >= 0 })
+}
+func (s *sliceIter) SeekForPrev(key []byte) {
+	s.idx = sort.Search(len(s.keys), func(i int) bool { return bytes.Compare(s.keys[i], key) > 0 }) - 1
+}
+func (s *sliceIter) SeekToFirst() { s.idx = 0 }
+func (s *sliceIter) SeekToLast()  { s.idx = len(s.keys) - 1 }
+
+var _ iterator.Iter = (*sliceIter)(nil)
+
+func TestIterator(t *testing.T) {
+	newIter := func() iterator.Iter {
+		versions := []struct {
+			key   string
+			seq   uint64
+			kind  mvcc.Kind
+			value string
+		}{
+			{"a", 3, mvcc.KindPut, "a3"},
+			{"a", 1, mvcc.KindPut, "a1"},
+			{"b", 4, mvcc.KindDelete, ""},
+			{"b", 2, mvcc.KindPut, "b2"},
+			{"c", 5, mvcc.KindPut, "c5"},
+			{"d", 2, mvcc.KindDelete, ""},
+			{"d", 1, mvcc.KindPut, "d1"},
+		}
+		iter := &sliceIter{}
+		for _, v := range versions {
+			iter.keys = append(iter.keys, mvcc.MakeKey([]byte(v.key), v.seq, v.kind))
+			iter.values = append(iter.values, []byte(v.value))
+		}
+		return iter
+	}
+	check := func(seq uint64, expected ...string) {
+		iter := mvcc.NewIterator(newIter(), seq)
+		for i := 0; i < len(expected); i += 2 {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, []byte(expected[i]), iter.Key())
+			assert.Equal(t, []byte(expected[i+1]), iter.Value())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+		assert.Nil(t, iter.Err())
+		iter.SeekToLast()
+		for i := len(expected) - 2; i >= 0; i -= 2 {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, []byte(expected[i]), iter.Key())
+			assert.Equal(t, []byte(expected[i+1]), iter.Value())
+			iter.Prev()
+		}
+		assert.False(t, iter.IsValid())
+		assert.Nil(t, iter.Err())
+	}
+	check(mvcc.MaxSeq, "a", "a3", "c", "c5")
+	check(3, "a", "a3", "b", "b2")
+	check(2, "a", "a1", "b", "b2")
+	check(1, "a", "a1", "d", "d1")
+	check(0)
+
+	// deleted keys are returned with tombstones
+	iter := mvcc.NewIteratorWithTombstones(newIter(), 4)
+	expected := []string{"a", "a3", "b", "", "d", ""}
+	for i := 0; i < len(expected); i += 2 {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, []byte(expected[i]), iter.Key())
+		assert.Equal(t, []byte(expected[i+1]), iter.Value())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	iter.SeekForPrev([]byte("e"))
+	for i := len(expected) - 2; i >= 0; i -= 2 {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, []byte(expected[i]), iter.Key())
+		assert.Equal(t, []byte(expected[i+1]), iter.Value())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+
+	// switch direction and seek by user keys
+	iter = mvcc.NewIterator(newIter(), mvcc.MaxSeq)
+	checkKey := func(key, value string) {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, []byte(key), iter.Key())
+		assert.Equal(t, []byte(value), iter.Value())
+	}
+	iter.Seek([]byte("b"))
+	checkKey("c", "c5")
+	iter.Prev()
+	checkKey("a", "a3")
+	iter.Next()
+	checkKey("c", "c5")
+	iter.SeekForPrev([]byte("b"))
+	checkKey("a", "a3")
+	iter.SeekForPrev([]byte("c"))
+	checkKey("c", "c5")
+	iter.Prev()
+	checkKey("a", "a3")
+	iter.Prev()
+	assert.False(t, iter.IsValid())
+	iter.SeekToFirst()
+	checkKey("a", "a3")
+
+	// internal bounds keep all versions of user keys in bounds
+	for _, c := range []struct {
+		bounds   iterator.Bounds
+		expected []string
+	}{
+		{iterator.Bounds{Lower: []byte("a"), Upper: []byte("c")}, []string{"a", "c"}},
+		{iterator.Bounds{Lower: []byte("a"), Upper: []byte("c"), ExcludeLower: true, ExcludeUpper: true}, nil},
+		{iterator.Bounds{Lower: []byte("b"), ExcludeLower: true}, []string{"c"}},
+		{iterator.Bounds{Upper: []byte("b")}, []string{"a"}},
+	} {
+		bounded := iterator.NewBoundedIter(newIter(), mvcc.InternalBounds(c.bounds))
+		bounded.SeekToFirst()
+		iter = mvcc.NewIterator(bounded, mvcc.MaxSeq)
+		for _, key := range c.expected {
+			assert.True(t, iter.IsValid())
+			assert.Equal(t, []byte(key), iter.Key())
+			iter.Next()
+		}
+		assert.False(t, iter.IsValid())
+	}
+
+	broken := &sliceIter{keys: [][]byte{[]byte("a")}, values: [][]byte{[]byte("1")}}
+	iter = mvcc.NewIterator(broken, mvcc.MaxSeq)
+	assert.False(t, iter.IsValid())
+	assert.ErrorIs(t, iter.Err(), mvcc.ErrInvalidKey)
+}
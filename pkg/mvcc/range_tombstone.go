@@ -0,0 +1,38 @@
+package mvcc
+
+import (
+	"bytes"
+)
+
+// RangeTombstone deletes versions of user keys in [Start, End) older than Seq,
+// readers see the deletion at seq not less than Seq.
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// Contains returns whether userKey is in [Start, End)
+func (t RangeTombstone) Contains(userKey []byte) bool {
+	return bytes.Compare(t.Start, userKey) <= 0 && bytes.Compare(userKey, t.End) < 0
+}
+
+// Overlaps returns whether [Start, End) overlaps user keys in [lower, upper], nil upper is unbounded
+func (t RangeTombstone) Overlaps(lower, upper []byte) bool {
+	return (upper == nil || bytes.Compare(t.Start, upper) <= 0) && bytes.Compare(lower, t.End) < 0
+}
+
+// RangeTombstones are RangeTombstone from memtables and ssts, they may overlap each other
+type RangeTombstones []RangeTombstone
+
+// CoveringSeq returns the largest Seq of tombstones visible at seq which contain userKey, 0 if there is none,
+// versions of userKey older than it are deleted.
+func (ts RangeTombstones) CoveringSeq(userKey []byte, seq uint64) uint64 {
+	var covering uint64
+	for _, t := range ts {
+		if t.Seq <= seq && t.Seq > covering && t.Contains(userKey) {
+			covering = t.Seq
+		}
+	}
+	return covering
+}
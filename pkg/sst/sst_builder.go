@@ -3,15 +3,19 @@ package sst
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"os"
-	"sync"
+
+	"github.com/sirupsen/logrus"
 
 	"mini-lsm/pkg/block"
+	"mini-lsm/pkg/bloom"
+	"mini-lsm/pkg/mvcc"
 	"mini-lsm/pkg/utils"
 )
 
-// TableBuilder can build sst
+// TableBuilder can build sst, keys are internal keys(see mvcc) added in ascending order
 // 3. save meta for block to metas
 type TableBuilder struct {
 	// builder is current Block Builder
@@ -19,6 +23,8 @@ type TableBuilder struct {
 
 	// firstKey: save firstKey for every Block
 	firstKey []byte
+	// lastKey: save lastKey for every Block
+	lastKey []byte
 
 	// data: append encoded Block to
 	data     [][]byte
@@ -28,7 +34,34 @@ type TableBuilder struct {
 	metas []*block.Meta
 
 	// blockSize is size of every Block
-	blockSize uint16
+	blockSize uint32
+
+	// keyHashes saves hash of every user key for bloom filter
+	keyHashes []uint32
+	// bitsPerKey of bloom filter, bloom filter is disabled if it's less than 1
+	bitsPerKey int
+
+	// compressor compresses every Block
+	compressor block.Compressor
+
+	// rangeTombstones are written to the range deletion block
+	rangeTombstones mvcc.RangeTombstones
+}
+
+// DefaultBloomBitsPerKey makes the false positive rate of bloom filter about 1%
+const DefaultBloomBitsPerKey = 10
+
+// minCompressionRatio: a block is stored uncompressed if compression saves less than 1/minCompressionRatio of it
+const minCompressionRatio = 8
+
+// TableBuilderOptions configures TableBuilder
+type TableBuilderOptions struct {
+	// BlockSize is the max size of every Block, except the Block of an oversized key-value pair
+	BlockSize uint32
+	// BloomBitsPerKey is bits per key of bloom filter, bloom filter is disabled if it's less than 1
+	BloomBitsPerKey int
+	// Compressor compresses every Block, nil means no compression
+	Compressor block.Compressor
 }
 
 func deepcopy(key []byte) []byte {
@@ -38,54 +71,94 @@ func deepcopy(key []byte) []byte {
 }
 
 // NewTableBuilder receives max blockSize and return a TableBuilder
-func NewTableBuilder(blockSize uint16) *TableBuilder {
+func NewTableBuilder(blockSize uint32) *TableBuilder {
+	return NewTableBuilderWithOptions(TableBuilderOptions{BlockSize: blockSize, BloomBitsPerKey: DefaultBloomBitsPerKey})
+}
+
+// NewTableBuilderWithOptions return a TableBuilder configured by opts
+func NewTableBuilderWithOptions(opts TableBuilderOptions) *TableBuilder {
+	compressor := opts.Compressor
+	if compressor == nil {
+		compressor = block.NewNoneCompressor()
+	}
 	return &TableBuilder{
-		builder:   block.NewBlockBuilder(blockSize),
-		metas:     make([]*block.Meta, 0),
-		blockSize: blockSize,
+		builder:    block.NewBlockBuilder(opts.BlockSize),
+		metas:      make([]*block.Meta, 0),
+		blockSize:  opts.BlockSize,
+		bitsPerKey: opts.BloomBitsPerKey,
+		compressor: compressor,
 	}
 }
 
 // Add receives a pair of key value(string), if builder has been full, we'll close
 // current block, create new Block then add key-value to it.
 func (t *TableBuilder) Add(key, value string) {
-	if t.firstKey == nil {
-		t.firstKey = []byte(key)
-	}
-	if t.builder.Add(key, value) {
-		return
-	}
-	t.finishBlock()
-	if !t.builder.Add(key, value) {
-		panic("build error")
-	}
-	t.firstKey = []byte(key)
+	t.AddByte([]byte(key), []byte(value))
 }
 
 // AddByte receives a pair of key value([]byte), if builder has been full, we'll close
 // current block, create new Block then add key-value to it.
+// A key-value pair larger than block size is written as its own block.
 func (t *TableBuilder) AddByte(key, value []byte) {
+	// versions of a user key are added together, the user key is hashed once
+	if t.lastKey == nil || !mvcc.SameUserKey(key, t.lastKey) {
+		t.keyHashes = append(t.keyHashes, bloom.Hash(mvcc.UserKey(key)))
+	}
+	if !t.builder.AddByte(key, value) {
+		t.finishBlock()
+		utils.Assert(t.builder.AddByte(key, value), "table builder add key value failed")
+	}
 	if t.firstKey == nil {
 		t.firstKey = deepcopy(key)
 	}
-	if t.builder.AddByte(key, value) {
-		return
+	t.lastKey = append(t.lastKey[:0], key...)
+	if t.builder.EstimatedSize() > int(t.blockSize) {
+		t.finishBlock()
 	}
-	t.finishBlock()
-	utils.Assert(t.builder.AddByte(key, value), "table builder add key value failed")
-	t.firstKey = deepcopy(key)
+}
+
+// AddRangeTombstone adds a range tombstone to the range deletion block, it can be added in any order
+func (t *TableBuilder) AddRangeTombstone(tombstone mvcc.RangeTombstone) {
+	t.rangeTombstones = append(t.rangeTombstones, mvcc.RangeTombstone{
+		Start: deepcopy(tombstone.Start),
+		End:   deepcopy(tombstone.End),
+		Seq:   tombstone.Seq,
+	})
 }
 
 // Build build sst with all built block
 // WARNING: after Build calling
 // the data in TableBuilder is dirty(other metadata was appended to it)
-func (t *TableBuilder) Build(id uint32, cache *sync.Map, path string) (*Table, error) {
+// The file on path is removed if Build fails.
+func (t *TableBuilder) Build(id uint32, cache BlockCache, path string) (*Table, error) {
 	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o644)
 	if err != nil {
 		return nil, err
 	}
+	table, err := t.build(id, cache, fd)
+	if err != nil {
+		_ = fd.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return table, nil
+}
+
+func (t *TableBuilder) build(id uint32, cache BlockCache, fd *os.File) (*Table, error) {
 	t.finishBlock()
 	blockMeta := block.EncodedBlockMeta(t.metas)
+	blockMeta = binary.BigEndian.AppendUint32(blockMeta, checksum(blockMeta))
+	filter := bloom.Build(t.keyHashes, t.bitsPerKey)
+	bloomBlock := binary.BigEndian.AppendUint32([]byte(filter), checksum(filter))
+	rangeDel := encodeRangeTombstones(t.rangeTombstones)
+	rangeDel = binary.BigEndian.AppendUint32(rangeDel, checksum(rangeDel))
+	// blocks go back to the pool after they are written, or when writing fails
+	defer func() {
+		for _, data := range t.data {
+			utils.GlobalPool.Put(data)
+		}
+		t.data = nil
+	}()
 	bw := bufio.NewWriter(fd)
 	written := 0
 	for i := range t.data {
@@ -94,20 +167,33 @@ func (t *TableBuilder) Build(id uint32, cache *sync.Map, path string) (*Table, e
 			return nil, err
 		}
 		written += n
-		utils.GlobalPool.Put(t.data[i])
 	}
-	utils.Assertf(written == int(t.dataSize), "mismatch data size write to sst file, written(%d) != t.dataSize(%d)", written, t.dataSize)
 	n, err := bw.Write(blockMeta)
 	if err != nil {
 		return nil, err
 	}
-	utils.Assertf(n == len(blockMeta), "mismatch block meta size write to sst file")
+	m, err := bw.Write(bloomBlock)
+	if err != nil {
+		return nil, err
+	}
+	r, err := bw.Write(rangeDel)
+	if err != nil {
+		return nil, err
+	}
 
 	metaOffset := t.dataSize
-	utils.Assertf(metaOffset < math.MaxUint32, "metaOffset %d should be less than 1<<32-1", metaOffset)
-	var buf [block.SizeOfUint32]byte
-	binary.BigEndian.PutUint32(buf[:], uint32(metaOffset))
-	_, err = bw.Write(buf[:])
+	bloomOffset := metaOffset + int64(n)
+	rangeDelOffset := bloomOffset + int64(m)
+	if rangeDelOffset >= math.MaxUint32 {
+		return nil, fmt.Errorf("sst size %d exceeds the max size %d", rangeDelOffset, uint32(math.MaxUint32))
+	}
+	buf := footer{
+		metaOffset:     uint32(metaOffset),
+		bloomOffset:    uint32(bloomOffset),
+		rangeDelOffset: uint32(rangeDelOffset),
+		version:        latestFormatVersion,
+	}.encode()
+	_, err = bw.Write(buf)
 	if err != nil {
 		return nil, err
 	}
@@ -119,29 +205,65 @@ func (t *TableBuilder) Build(id uint32, cache *sync.Map, path string) (*Table, e
 	if err != nil {
 		return nil, err
 	}
-	return &Table{
-		id:          id,
-		fd:          fd,
-		metas:       t.metas,
-		metaOffsets: uint32(metaOffset),
-		blockCache:  cache,
-	}, nil
+	table := &Table{
+		id:              id,
+		fd:              fd,
+		metas:           t.metas,
+		metaOffsets:     uint32(metaOffset),
+		bloom:           filter,
+		rangeTombstones: t.rangeTombstones,
+		version:         latestFormatVersion,
+		format:          block.LatestFormat,
+		size:            uint64(written + n + m + r + len(buf)),
+		blockCache:      cache,
+	}
+	table.initBounds()
+	return table, nil
 }
 
 func (t *TableBuilder) Len() uint32 {
 	return uint32(len(t.metas))
 }
 
+// IsEmpty returns true if no key-value or range tombstone has been added
+func (t *TableBuilder) IsEmpty() bool {
+	return len(t.metas) == 0 && t.builder.IsEmpty() && len(t.rangeTombstones) == 0
+}
+
+// EstimatedSize returns the size of built blocks, it's used to split ssts
+func (t *TableBuilder) EstimatedSize() int64 {
+	return t.dataSize
+}
+
 func (t *TableBuilder) finishBlock() {
 	builder := t.builder
 	if !builder.IsEmpty() {
 		t.metas = append(t.metas, &block.Meta{
 			Offset:   uint32(t.dataSize),
 			FirstKey: deepcopy(t.firstKey),
+			LastKey:  deepcopy(t.lastKey),
 		})
-		data := builder.Build().Encode()
+		data := t.compress(builder.Build().Encode())
+		data = binary.BigEndian.AppendUint32(data, checksum(data))
 		t.data = append(t.data, data)
 		t.dataSize += int64(len(data))
 	}
 	t.builder = block.NewBlockBuilder(t.blockSize)
+	t.firstKey = nil
+}
+
+// compress returns | compressed block | compression type |,
+// data is kept uncompressed if it can't be compressed well.
+// compressed isn't taken from the pool, it's dropped when it's not used and Compressor may outgrow dst.
+func (t *TableBuilder) compress(data []byte) []byte {
+	if t.compressor.Type() != block.CompressionNone {
+		compressed, err := t.compressor.Compress(make([]byte, 0, len(data)), data)
+		if err != nil {
+			logrus.WithError(err).Warnln("compress block error, block is written uncompressed")
+		} else if len(compressed) < len(data)-len(data)/minCompressionRatio {
+			utils.GlobalPool.Put(data)
+			return append(compressed, byte(t.compressor.Type()))
+		}
+	}
+	return append(data, byte(block.CompressionNone))
 }
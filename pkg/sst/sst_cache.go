@@ -0,0 +1,27 @@
+package sst
+
+import (
+	"mini-lsm/pkg/block"
+)
+
+// BlockCacheKey identifies a block of a sst in BlockCache
+type BlockCacheKey struct {
+	SSTID    uint32
+	BlockIdx uint32
+}
+
+// Hash is used to shard BlockCache
+func (k BlockCacheKey) Hash() uint64 {
+	// fibonacci hashing, high bits are mixed into low bits which pick the shard
+	h := (uint64(k.SSTID)<<32 | uint64(k.BlockIdx)) * 0x9e3779b97f4a7c15
+	return h ^ h>>32
+}
+
+// BlockCache caches decoded blocks shared by all Tables, *cache.Cache[BlockCacheKey, *block.Block] implements it.
+// Blocks of a Table are removed from BlockCache when it's closed.
+type BlockCache interface {
+	Get(key BlockCacheKey) (*block.Block, bool)
+	// Insert caches blk, charge is the size of blk in bytes
+	Insert(key BlockCacheKey, blk *block.Block, charge int64)
+	Remove(key BlockCacheKey)
+}
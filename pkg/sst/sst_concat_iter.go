@@ -0,0 +1,150 @@
+package sst
+
+import (
+	"bytes"
+	"sort"
+
+	"mini-lsm/pkg/iterator"
+)
+
+// ConcatIter iterates a run of Table one by one,
+// tables in the run should be sorted by key and have no overlapping key range.
+type ConcatIter struct {
+	tables  []*Table
+	current *Iter
+	// idx is the index of the table current iterates
+	idx int
+	err error
+}
+
+var _ iterator.Iter = &ConcatIter{}
+
+func NewConcatIterAndSeekToFirst(tables []*Table) *ConcatIter {
+	iter := &ConcatIter{tables: tables}
+	iter.SeekToFirst()
+	return iter
+}
+
+func NewConcatIterAndSeekToKey(tables []*Table, key []byte) *ConcatIter {
+	iter := &ConcatIter{tables: tables}
+	iter.Seek(key)
+	return iter
+}
+
+func (c *ConcatIter) SeekToFirst() {
+	c.err = nil
+	c.current = nil
+	c.idx = 0
+	if len(c.tables) > 0 {
+		c.current = NewIterAndSeekToFirst(c.tables[0])
+	}
+	c.skipInvalid()
+}
+
+func (c *ConcatIter) SeekToLast() {
+	c.err = nil
+	c.current = nil
+	c.idx = len(c.tables) - 1
+	if c.idx >= 0 {
+		c.current = NewIterAndSeekToLast(c.tables[c.idx])
+	}
+	c.skipInvalidBackward()
+}
+
+// Seek seeks to the first key which is greater than or equal to key
+func (c *ConcatIter) Seek(key []byte) {
+	// the first table which may contain key
+	idx := sort.Search(len(c.tables), func(i int) bool {
+		return !c.tables[i].EndsBefore(key)
+	})
+	c.err = nil
+	c.current = nil
+	c.idx = idx
+	if idx < len(c.tables) {
+		c.current = NewIterAndSeekToKey(c.tables[idx], key)
+	}
+	c.skipInvalid()
+}
+
+// SeekForPrev seeks to the last key which is less than or equal to key
+func (c *ConcatIter) SeekForPrev(key []byte) {
+	// the last table whose first key <= key
+	idx := sort.Search(len(c.tables), func(i int) bool {
+		return bytes.Compare(c.tables[i].FirstKey(), key) > 0
+	}) - 1
+	c.err = nil
+	c.current = nil
+	c.idx = idx
+	if idx >= 0 {
+		c.current = &Iter{table: c.tables[idx]}
+		c.current.SeekForPrev(key)
+	}
+	c.skipInvalidBackward()
+}
+
+func (c *ConcatIter) skipInvalid() {
+	for c.current != nil && !c.current.IsValid() {
+		if c.err = c.current.Err(); c.err != nil {
+			return
+		}
+		if c.idx+1 >= len(c.tables) {
+			c.current = nil
+			return
+		}
+		c.idx++
+		c.current = NewIterAndSeekToFirst(c.tables[c.idx])
+	}
+}
+
+func (c *ConcatIter) skipInvalidBackward() {
+	for c.current != nil && !c.current.IsValid() {
+		if c.err = c.current.Err(); c.err != nil {
+			return
+		}
+		if c.idx == 0 {
+			c.current = nil
+			return
+		}
+		c.idx--
+		c.current = NewIterAndSeekToLast(c.tables[c.idx])
+	}
+}
+
+func (c *ConcatIter) Key() []byte {
+	if !c.IsValid() {
+		return nil
+	}
+	return c.current.Key()
+}
+
+func (c *ConcatIter) Value() []byte {
+	if !c.IsValid() {
+		return nil
+	}
+	return c.current.Value()
+}
+
+func (c *ConcatIter) IsValid() bool {
+	return c.err == nil && c.current != nil && c.current.IsValid()
+}
+
+func (c *ConcatIter) Next() {
+	if !c.IsValid() {
+		return
+	}
+	c.current.Next()
+	c.skipInvalid()
+}
+
+func (c *ConcatIter) Prev() {
+	if !c.IsValid() {
+		return
+	}
+	c.current.Prev()
+	c.skipInvalidBackward()
+}
+
+// Err returns the error which makes ConcatIter invalid, nil if ConcatIter reaches the end normally
+func (c *ConcatIter) Err() error {
+	return c.err
+}
@@ -0,0 +1,61 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// ErrCorruption matches every CorruptionError by errors.Is
+var ErrCorruption = errors.New("sst corruption")
+
+// ErrUnsupportedFormat is wrapped by CorruptionError when sst is in a format which can't be read
+var ErrUnsupportedFormat = errors.New("unsupported sst format")
+
+const (
+	// MetaBlockIdx is the BlockIdx of CorruptionError when block metas are corrupted
+	MetaBlockIdx uint32 = math.MaxUint32
+	// BloomBlockIdx is the BlockIdx of CorruptionError when bloom filter is corrupted
+	BloomBlockIdx uint32 = math.MaxUint32 - 1
+	// RangeDelBlockIdx is the BlockIdx of CorruptionError when range deletion block is corrupted
+	RangeDelBlockIdx uint32 = math.MaxUint32 - 2
+)
+
+// CorruptionError is returned when data read from sst mismatches its checksum or can't be decoded
+type CorruptionError struct {
+	SSTID    uint32
+	BlockIdx uint32
+	Err      error
+}
+
+func (e *CorruptionError) Error() string {
+	switch e.BlockIdx {
+	case MetaBlockIdx:
+		return fmt.Sprintf("sst %d block meta: %s: %s", e.SSTID, ErrCorruption, e.Err)
+	case BloomBlockIdx:
+		return fmt.Sprintf("sst %d bloom filter: %s: %s", e.SSTID, ErrCorruption, e.Err)
+	case RangeDelBlockIdx:
+		return fmt.Sprintf("sst %d range deletion block: %s: %s", e.SSTID, ErrCorruption, e.Err)
+	}
+	return fmt.Sprintf("sst %d block %d: %s: %s", e.SSTID, e.BlockIdx, ErrCorruption, e.Err)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	errChecksumMismatch = errors.New("checksum mismatch")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// checksum returns crc32c of data, every block and the block metas have one as trailer
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
@@ -0,0 +1,161 @@
+package sst
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"mini-lsm/pkg/block"
+	"mini-lsm/pkg/mvcc"
+)
+
+// sst: | blocks | block_metadata | checksum | bloom | checksum | range_del | checksum | footer |
+// footer: | range_del_offset(4B) | metadata_offset(4B) | bloom_offset(4B) | format_version(4B) | magic(8B) |
+// ssts written before format_version was introduced have only metadata_offset and bloom_offset in footer,
+// ssts older than formatVersionRangeDelete have neither range_del nor range_del_offset.
+// ssts written before bloom filters were added have neither bloom nor bloom_offset, and older ones have no checksums,
+// they are not supported: such layouts fail the checks of formatVersionLegacy and are reported as ErrUnsupportedFormat.
+// range_del: | count(uvarint) | tombstone | tombstone | ... |
+// tombstone: | startLen(uvarint) | start | endLen(uvarint) | end | seq(8B) |
+const (
+	// formatVersionLegacy is the version of ssts without format_version, blocks are in block.FormatPlain
+	formatVersionLegacy uint32 = 1
+	// formatVersionPrefix delta encodes keys in blocks, blocks are in block.FormatPrefix
+	formatVersionPrefix uint32 = 2
+	// formatVersionVarint encodes lengths as uvarints and offsets as uint32, blocks are in block.FormatVarint
+	formatVersionVarint uint32 = 3
+	// formatVersionCompression appends block.CompressionType to every block: | block | compression type | checksum |
+	formatVersionCompression uint32 = 4
+	// formatVersionInternalKey stores internal keys(see mvcc) instead of user keys,
+	// ssts of older versions are read as if all keys are put at seq 0.
+	formatVersionInternalKey uint32 = 5
+	// formatVersionRangeDelete adds the range deletion block, which stores range tombstones
+	formatVersionRangeDelete uint32 = 6
+
+	latestFormatVersion = formatVersionRangeDelete
+
+	footerMagic uint64 = 0x6d696e692d6c736d // "mini-lsm"
+
+	legacyFooterSize = 2 * 4
+	footerSize       = 3*4 + 8
+	// rangeDelFooterSize is the size of footer with range_del_offset
+	rangeDelFooterSize = footerSize + 4
+)
+
+type footer struct {
+	metaOffset  uint32
+	bloomOffset uint32
+	version     uint32
+	// rangeDelOffset is 0 if version is older than formatVersionRangeDelete
+	rangeDelOffset uint32
+}
+
+// blockFormat returns the format of blocks in sst of the version
+func blockFormat(version uint32) (block.Format, error) {
+	switch version {
+	case formatVersionLegacy:
+		return block.FormatPlain, nil
+	case formatVersionPrefix:
+		return block.FormatPrefix, nil
+	case formatVersionVarint, formatVersionCompression, formatVersionInternalKey, formatVersionRangeDelete:
+		return block.FormatVarint, nil
+	}
+	return 0, fmt.Errorf("%w: unknown sst format version %d", ErrUnsupportedFormat, version)
+}
+
+func (f footer) encode() []byte {
+	buf := make([]byte, 0, rangeDelFooterSize)
+	buf = binary.BigEndian.AppendUint32(buf, f.rangeDelOffset)
+	buf = binary.BigEndian.AppendUint32(buf, f.metaOffset)
+	buf = binary.BigEndian.AppendUint32(buf, f.bloomOffset)
+	buf = binary.BigEndian.AppendUint32(buf, f.version)
+	return binary.BigEndian.AppendUint64(buf, footerMagic)
+}
+
+// readFooter reads footer at the end of fd, it returns the size of footer as well
+func readFooter(fd *os.File, fileSize int64) (footer, int64, error) {
+	if fileSize < legacyFooterSize {
+		return footer{}, 0, fmt.Errorf("file size %d is too small", fileSize)
+	}
+	size := int64(footerSize)
+	if fileSize < size {
+		size = legacyFooterSize
+	}
+	buf := make([]byte, size)
+	if _, err := fd.ReadAt(buf, fileSize-size); err != nil {
+		return footer{}, 0, err
+	}
+	if size == footerSize && binary.BigEndian.Uint64(buf[footerSize-8:]) == footerMagic {
+		f := footer{
+			metaOffset:  binary.BigEndian.Uint32(buf),
+			bloomOffset: binary.BigEndian.Uint32(buf[4:]),
+			version:     binary.BigEndian.Uint32(buf[8:]),
+		}
+		if f.version < formatVersionRangeDelete {
+			return f, footerSize, nil
+		}
+		if fileSize < rangeDelFooterSize {
+			return footer{}, 0, fmt.Errorf("file size %d is too small", fileSize)
+		}
+		if _, err := fd.ReadAt(buf[:4], fileSize-rangeDelFooterSize); err != nil {
+			return footer{}, 0, err
+		}
+		f.rangeDelOffset = binary.BigEndian.Uint32(buf)
+		return f, rangeDelFooterSize, nil
+	}
+	buf = buf[size-legacyFooterSize:]
+	return footer{
+		metaOffset:  binary.BigEndian.Uint32(buf),
+		bloomOffset: binary.BigEndian.Uint32(buf[4:]),
+		version:     formatVersionLegacy,
+	}, legacyFooterSize, nil
+}
+
+// encodeRangeTombstones encodes tombstones as range_del
+func encodeRangeTombstones(tombstones mvcc.RangeTombstones) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(tombstones)))
+	for _, t := range tombstones {
+		buf = binary.AppendUvarint(buf, uint64(len(t.Start)))
+		buf = append(buf, t.Start...)
+		buf = binary.AppendUvarint(buf, uint64(len(t.End)))
+		buf = append(buf, t.End...)
+		buf = binary.BigEndian.AppendUint64(buf, t.Seq)
+	}
+	return buf
+}
+
+// decodeRangeTombstones decodes range_del encoded by encodeRangeTombstones
+func decodeRangeTombstones(data []byte) (mvcc.RangeTombstones, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("invalid range tombstone count")
+	}
+	data = data[n:]
+	readBytes := func() ([]byte, bool) {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, false
+		}
+		b := data[n : n+int(length)]
+		data = data[n+int(length):]
+		return b, true
+	}
+	tombstones := make(mvcc.RangeTombstones, 0)
+	for i := uint64(0); i < count; i++ {
+		start, ok := readBytes()
+		if !ok {
+			return nil, fmt.Errorf("invalid start of range tombstone %d", i)
+		}
+		end, ok := readBytes()
+		if !ok || len(data) < 8 {
+			return nil, fmt.Errorf("invalid end of range tombstone %d", i)
+		}
+		tombstones = append(tombstones, mvcc.RangeTombstone{Start: start, End: end, Seq: binary.BigEndian.Uint64(data)})
+		data = data[8:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%d bytes left after range tombstones", len(data))
+	}
+	return tombstones, nil
+}
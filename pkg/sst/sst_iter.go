@@ -1,65 +1,185 @@
 package sst
 
 import (
+	"bytes"
+
 	"mini-lsm/pkg/block"
 	"mini-lsm/pkg/iterator"
+	"mini-lsm/pkg/mvcc"
 )
 
+// Iter iterates all key-value pairs in a Table by internal key,
+// it becomes invalid when reading block failed, Err returns the error.
 type Iter struct {
 	table   *Table
 	blkIter *block.Iter
 	blkIdx  uint32
+	err     error
+	// key is the internal key converted from the user key in blocks of an older sst
+	key []byte
 }
 
 var _ iterator.Iter = &Iter{}
 
 func NewIterAndSeekToFirst(table *Table) *Iter {
-	blkIter := block.NewBlockIterAndSeekToFirst(table.ReadBlockCached(0))
-	return &Iter{table: table, blkIter: blkIter, blkIdx: 0}
+	i := &Iter{table: table}
+	i.SeekToFirst()
+	return i
+}
+
+func NewIterAndSeekToLast(table *Table) *Iter {
+	i := &Iter{table: table}
+	i.SeekToLast()
+	return i
 }
 
 func NewIterAndSeekToKey(table *Table, key []byte) *Iter {
-	blkIdx, iter := seekToKey(table, key)
-	return &Iter{table: table, blkIter: iter, blkIdx: blkIdx}
+	i := &Iter{table: table}
+	i.Seek(key)
+	return i
+}
+
+// readBlock returns an empty block iter and saves the error if block can't be read
+func (i *Iter) readBlock(blkIdx uint32) *block.Block {
+	blk, err := i.table.ReadBlockCached(blkIdx)
+	if err != nil {
+		i.err = err
+		return nil
+	}
+	return blk
 }
 
 func (i *Iter) SeekToFirst() {
+	i.err = nil
 	i.blkIdx = 0
-	i.blkIter = block.NewBlockIterAndSeekToFirst(i.table.ReadBlockCached(0))
+	if i.table.Len() == 0 {
+		// Table has only range tombstones
+		i.blkIter = block.NewBlockIter(nil)
+		return
+	}
+	i.blkIter = block.NewBlockIterAndSeekToFirst(i.readBlock(0))
+	i.checkBlockErr()
+}
+
+// SeekToLast seeks to the last internal key
+func (i *Iter) SeekToLast() {
+	i.err = nil
+	if i.table.Len() == 0 {
+		i.blkIter = block.NewBlockIter(nil)
+		return
+	}
+	i.blkIdx = i.table.Len() - 1
+	i.blkIter = block.NewBlockIter(i.readBlock(i.blkIdx))
+	i.blkIter.SeekToLast()
+	i.checkBlockErr()
+}
+
+// Seek seeks to the first internal key which is greater than or equal to key
+func (i *Iter) Seek(key []byte) {
+	i.err = nil
+	if i.table.Len() == 0 {
+		i.blkIter = block.NewBlockIter(nil)
+		return
+	}
+	i.blkIdx = i.table.FindBlockIdx(key)
+	if i.table.HasInternalKeys() {
+		i.seekBlock(key)
+		return
+	}
+	// every user key has only one version at seq 0, it's less than key if key is a larger internal key of the user key
+	i.seekBlock(mvcc.UserKey(key))
+	if i.IsValid() && bytes.Compare(i.Key(), key) < 0 {
+		i.Next()
+	}
+}
+
+// seekBlock seeks blkIter of blkIdx to the first key in blocks not less than blkKey, moving to the next block if needed
+func (i *Iter) seekBlock(blkKey []byte) {
+	i.blkIter = block.NewBlockIterAndSeekToKey(i.readBlock(i.blkIdx), blkKey)
+	if !i.blkIter.IsValid() && i.err == nil && !i.checkBlockErr() {
+		i.blkIdx++
+		if i.blkIdx < i.table.Len() {
+			i.blkIter = block.NewBlockIterAndSeekToFirst(i.readBlock(i.blkIdx))
+			i.checkBlockErr()
+		}
+	}
 }
 
-func seekToKey(t *Table, key []byte) (uint32, *block.Iter) {
-	blkIdx := t.FindBlockIdx(key)
-	blkIter := block.NewBlockIterAndSeekToKey(t.ReadBlockCached(blkIdx), key)
-	if !blkIter.IsValid() {
-		blkIdx++
-		if blkIdx < t.Len() {
-			blkIter = block.NewBlockIterAndSeekToFirst(t.ReadBlockCached(blkIdx))
+// SeekForPrev seeks to the last internal key which is less than or equal to key
+func (i *Iter) SeekForPrev(key []byte) {
+	i.Seek(key)
+	if i.IsValid() {
+		if bytes.Compare(i.Key(), key) > 0 {
+			i.Prev()
 		}
+		return
+	}
+	if i.err == nil {
+		i.SeekToLast()
 	}
-	return blkIdx, blkIter
 }
 
-func (i *Iter) SeekToKey(key []byte) {
-	i.blkIdx, i.blkIter = seekToKey(i.table, key)
+// checkBlockErr saves the error of blkIter as a CorruptionError, it returns whether blkIter failed
+func (i *Iter) checkBlockErr() bool {
+	if err := i.blkIter.Err(); err != nil {
+		i.err = &CorruptionError{SSTID: i.table.SSTID(), BlockIdx: i.blkIdx, Err: err}
+		return true
+	}
+	return false
 }
 
 func (i *Iter) Key() []byte {
+	if !i.IsValid() {
+		return nil
+	}
+	if !i.table.HasInternalKeys() {
+		kind := mvcc.KindPut
+		if iterator.IsTombstone(i.blkIter.Value()) {
+			kind = mvcc.KindDelete
+		}
+		i.key = mvcc.AppendKey(i.key[:0], i.blkIter.Key(), 0, kind)
+		return i.key
+	}
 	return i.blkIter.Key()
 }
 
 func (i *Iter) Value() []byte {
+	if !i.IsValid() {
+		return nil
+	}
 	return i.blkIter.Value()
 }
 func (i *Iter) IsValid() bool {
-	return i.blkIter.IsValid()
+	return i.err == nil && i.blkIter.IsValid()
 }
 func (i *Iter) Next() {
+	if !i.IsValid() {
+		return
+	}
 	i.blkIter.Next()
-	if !i.blkIter.IsValid() {
+	if !i.blkIter.IsValid() && !i.checkBlockErr() {
 		i.blkIdx++
 		if i.blkIdx < i.table.Len() {
-			i.blkIter = block.NewBlockIterAndSeekToFirst(i.table.ReadBlockCached(i.blkIdx))
+			i.blkIter = block.NewBlockIterAndSeekToFirst(i.readBlock(i.blkIdx))
+			i.checkBlockErr()
 		}
 	}
 }
+
+func (i *Iter) Prev() {
+	if !i.IsValid() {
+		return
+	}
+	i.blkIter.Prev()
+	if !i.blkIter.IsValid() && !i.checkBlockErr() && i.blkIdx > 0 {
+		i.blkIdx--
+		i.blkIter = block.NewBlockIter(i.readBlock(i.blkIdx))
+		i.blkIter.SeekToLast()
+		i.checkBlockErr()
+	}
+}
+
+// Err returns the error which makes Iter invalid, nil if Iter reaches the end normally
+func (i *Iter) Err() error {
+	return i.err
+}
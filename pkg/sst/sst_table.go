@@ -5,11 +5,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"os"
-	"sync"
 
 	"mini-lsm/pkg/block"
+	"mini-lsm/pkg/bloom"
+	"mini-lsm/pkg/mvcc"
 	"mini-lsm/pkg/utils"
 )
 
@@ -20,58 +20,177 @@ type Table struct {
 	// fd hold the file descriptor of the open file
 	fd *os.File
 
-	// all metas, hold block offset and first key
+	// all metas, hold block offset and first key,
+	// keys of metas are internal keys even if the sst stores user keys(see HasInternalKeys).
 	metas []*block.Meta
 
 	// metaOffsets
 	metaOffsets uint32
 	id          uint32
+	// size of the sst file
+	size uint64
 
-	// blockCache is a map[[2]uint32]*block.Block
-	blockCache *sync.Map
+	// bloom filter over all keys, it may be empty
+	bloom bloom.Filter
+	// rangeTombstones are read from the range deletion block
+	rangeTombstones mvcc.RangeTombstones
+	// firstKey and lastKey are bounds of Table, see FirstKey and LastKey,
+	// lastKeyExclusive is set if lastKey is the end of a range tombstone, which is not in Table.
+	firstKey         []byte
+	lastKey          []byte
+	lastKeyExclusive bool
+	// version is the format version of sst
+	version uint32
+	// format of blocks, it depends on the format version of sst
+	format block.Format
+
+	// blockCache may be nil, then blocks aren't cached
+	blockCache BlockCache
 }
 
-func OpenTableFromFile(id uint32, blockCache *sync.Map, fd *os.File) (*Table, error) {
+// OpenTableFromFile reads block metas from fd and returns the Table,
+// a CorruptionError is returned if block metas mismatch their checksum.
+func OpenTableFromFile(id uint32, blockCache BlockCache, fd *os.File) (*Table, error) {
 	fi, err := fd.Stat()
 	if err != nil {
 		return nil, err
 	}
-	// read meta offset(last block.SizeOfUint32 byte)
-	var rawMetaOffset [block.SizeOfUint32]byte
-	n, err := fd.ReadAt(rawMetaOffset[:], int64(uint16(fi.Size())-block.SizeOfUint32))
+	var footer footer
+	corruption := func(blockIdx uint32, err error) error {
+		if footer.version == formatVersionLegacy {
+			// ssts in layouts older than formatVersionLegacy fail its checks as well
+			err = fmt.Errorf("%w: no format version, it's corrupted or written before bloom filters were added: %s", ErrUnsupportedFormat, err)
+		}
+		return &CorruptionError{SSTID: id, BlockIdx: blockIdx, Err: err}
+	}
+	footer, footerSize, err := readFooter(fd, fi.Size())
 	if err != nil {
-		return nil, err
+		return nil, corruption(MetaBlockIdx, err)
+	}
+	format, err := blockFormat(footer.version)
+	if err != nil {
+		return nil, corruption(MetaBlockIdx, err)
+	}
+	blockMetaOffset, bloomOffset := footer.metaOffset, footer.bloomOffset
+	end := fi.Size() - footerSize
+	bloomEnd := end
+	if footer.version >= formatVersionRangeDelete {
+		bloomEnd = int64(footer.rangeDelOffset)
+		if bloomEnd+int64(block.SizeOfUint32) > end {
+			return nil, corruption(MetaBlockIdx, fmt.Errorf("range deletion offset %d out of file size %d", bloomEnd, fi.Size()))
+		}
 	}
-	if uint16(n) != block.SizeOfUint32 {
-		return nil, fmt.Errorf("misread the meta offset %d, should be %d", n, block.SizeOfUint32)
+	if int64(blockMetaOffset)+int64(block.SizeOfUint32) > int64(bloomOffset) ||
+		int64(bloomOffset)+int64(block.SizeOfUint32) > bloomEnd {
+		return nil, corruption(MetaBlockIdx, fmt.Errorf("meta offset %d or bloom offset %d out of file size %d", blockMetaOffset, bloomOffset, fi.Size()))
 	}
-	blockMetaOffset := binary.BigEndian.Uint32(rawMetaOffset[:])
 
-	// seek to offset for reading metadata
-	_, err = fd.Seek(int64(blockMetaOffset), io.SeekStart)
-	if err != nil {
+	rawBlockMeta := make([]byte, end-int64(blockMetaOffset))
+	if _, err = fd.ReadAt(rawBlockMeta, int64(blockMetaOffset)); err != nil {
 		return nil, err
 	}
-
-	// sst: | blocks | block_metadata{offset, firstkey} | metadata_offset |
-	rawMetas, err := block.DecodeBlockMetaFromReader(io.LimitReader(fd, int64(uint16(fi.Size())-block.SizeOfUint32)-int64(blockMetaOffset)))
+	rawRangeDel := rawBlockMeta[bloomEnd-int64(blockMetaOffset):]
+	rawBloom := rawBlockMeta[bloomOffset-blockMetaOffset : bloomEnd-int64(blockMetaOffset)]
+	rawBlockMeta, err = verifyChecksum(rawBlockMeta[:bloomOffset-blockMetaOffset])
 	if err != nil {
-		return nil, err
+		return nil, corruption(MetaBlockIdx, err)
+	}
+	rawMetas, err := block.DecodeBlockMetaWithFormat(rawBlockMeta, format)
+	if err != nil {
+		return nil, corruption(MetaBlockIdx, err)
+	}
+	if footer.version < formatVersionInternalKey {
+		for _, meta := range rawMetas {
+			// the smallest and the largest internal keys at seq 0
+			meta.FirstKey = mvcc.MakeKey(meta.FirstKey, 0, mvcc.KindPut)
+			meta.LastKey = mvcc.MakeKey(meta.LastKey, 0, mvcc.KindDelete)
+		}
 	}
-	return &Table{
-		fd:          fd,
-		metas:       rawMetas,
-		metaOffsets: blockMetaOffset,
-		id:          id,
-		blockCache:  blockCache,
-	}, err
+	filter, err := verifyChecksum(rawBloom)
+	if err != nil {
+		return nil, corruption(BloomBlockIdx, err)
+	}
+	var rangeTombstones mvcc.RangeTombstones
+	if footer.version >= formatVersionRangeDelete {
+		rawRangeDel, err := verifyChecksum(rawRangeDel)
+		if err != nil {
+			return nil, corruption(RangeDelBlockIdx, err)
+		}
+		if rangeTombstones, err = decodeRangeTombstones(rawRangeDel); err != nil {
+			return nil, corruption(RangeDelBlockIdx, err)
+		}
+	}
+	if len(rawMetas) == 0 && len(rangeTombstones) == 0 {
+		return nil, corruption(MetaBlockIdx, errors.New("no block in sst"))
+	}
+	table := &Table{
+		fd:              fd,
+		metas:           rawMetas,
+		metaOffsets:     blockMetaOffset,
+		bloom:           bloom.Filter(filter),
+		rangeTombstones: rangeTombstones,
+		version:         footer.version,
+		format:          format,
+		id:              id,
+		size:            uint64(fi.Size()),
+		blockCache:      blockCache,
+	}
+	table.initBounds()
+	return table, nil
 }
 
+// initBounds sets bounds of Table, which cover its blocks and range tombstones
+func (t *Table) initBounds() {
+	if len(t.metas) != 0 {
+		t.firstKey, t.lastKey = t.metas[0].FirstKey, t.metas[len(t.metas)-1].LastKey
+	}
+	for _, tombstone := range t.rangeTombstones {
+		// the smallest internal keys of Start and End, End itself is not deleted
+		start, end := mvcc.SeekKey(tombstone.Start, mvcc.MaxSeq), mvcc.SeekKey(tombstone.End, mvcc.MaxSeq)
+		if t.firstKey == nil || bytes.Compare(start, t.firstKey) < 0 {
+			t.firstKey = start
+		}
+		if t.lastKey == nil || bytes.Compare(end, t.lastKey) > 0 {
+			t.lastKey, t.lastKeyExclusive = end, true
+		}
+	}
+}
+
+// verifyChecksum checks the checksum trailer of data, returns data without the trailer
+func verifyChecksum(data []byte) ([]byte, error) {
+	if len(data) < int(block.SizeOfUint32) {
+		return nil, errChecksumMismatch
+	}
+	content := data[:len(data)-int(block.SizeOfUint32)]
+	if checksum(content) != binary.BigEndian.Uint32(data[len(content):]) {
+		return nil, errChecksumMismatch
+	}
+	return content, nil
+}
+
+// HasInternalKeys returns whether keys in blocks are internal keys,
+// blocks of older ssts store user keys, which are converted to internal keys at seq 0 by Iter,
+// so versions of the same user key in such ssts can't be ordered by seq.
+func (t *Table) HasInternalKeys() bool {
+	return t.version >= formatVersionInternalKey
+}
+
+// Close closes the sst file and invalidates its blocks in block cache
 func (t *Table) Close() error {
+	if t.blockCache != nil {
+		for i := uint32(0); i < t.Len(); i++ {
+			t.blockCache.Remove(BlockCacheKey{SSTID: t.id, BlockIdx: i})
+		}
+	}
 	return t.fd.Close()
 }
 
+// ReadBlock reads the block on blockIdx from disk,
+// a CorruptionError is returned if the block mismatches its checksum or can't be decoded.
 func (t *Table) ReadBlock(blockIdx uint32) (*block.Block, error) {
+	if blockIdx >= t.Len() {
+		return nil, fmt.Errorf("%w: block idx %d out of %d blocks", ErrReadBlockError, blockIdx, t.Len())
+	}
 	offset := t.metas[blockIdx].Offset
 	var offsetEnd uint32
 	if blockIdx < uint32(len(t.metas)-1) {
@@ -79,6 +198,9 @@ func (t *Table) ReadBlock(blockIdx uint32) (*block.Block, error) {
 	} else {
 		offsetEnd = t.metaOffsets
 	}
+	if offsetEnd < offset {
+		return nil, &CorruptionError{SSTID: t.id, BlockIdx: blockIdx, Err: fmt.Errorf("block end %d before block offset %d", offsetEnd, offset)}
+	}
 	data := utils.GlobalPool.Get(int(offsetEnd - offset))
 	defer utils.GlobalPool.Put(data)
 	n, err := t.fd.ReadAt(data, int64(offset))
@@ -88,22 +210,53 @@ func (t *Table) ReadBlock(blockIdx uint32) (*block.Block, error) {
 	if n != int(offsetEnd-offset) {
 		return nil, ErrReadBlockError
 	}
+	content, err := verifyChecksum(data)
+	if err != nil {
+		return nil, &CorruptionError{SSTID: t.id, BlockIdx: blockIdx, Err: err}
+	}
+	if t.version >= formatVersionCompression {
+		if len(content) == 0 {
+			return nil, &CorruptionError{SSTID: t.id, BlockIdx: blockIdx, Err: errors.New("missing compression type")}
+		}
+		typ := block.CompressionType(content[len(content)-1])
+		if typ != block.CompressionNone {
+			// buf goes back to the pool on every path, decompressed may outgrow it into a new slice
+			buf := utils.GlobalPool.Get(2 * len(content))
+			defer utils.GlobalPool.Put(buf)
+			decompressed, err := block.Decompress(typ, buf[:0], content[:len(content)-1])
+			if err != nil {
+				return nil, &CorruptionError{SSTID: t.id, BlockIdx: blockIdx, Err: err}
+			}
+			content = decompressed
+		} else {
+			content = content[:len(content)-1]
+		}
+	}
 	b := &block.Block{}
-	b.Decode(data)
+	if err = b.DecodeWithFormat(content, t.format); err != nil {
+		return nil, &CorruptionError{SSTID: t.id, BlockIdx: blockIdx, Err: err}
+	}
 	return b, nil
 }
 
-func (t *Table) ReadBlockCached(blockIdx uint32) *block.Block {
-	key := [2]uint32{t.id, blockIdx}
-	if v, ok := t.blockCache.Load(key); ok {
-		return v.(*block.Block)
+// ReadBlockCached reads the block on blockIdx from block cache, the block is read from disk and cached on miss
+func (t *Table) ReadBlockCached(blockIdx uint32) (*block.Block, error) {
+	if t.blockCache == nil {
+		return t.ReadBlock(blockIdx)
+	}
+	key := BlockCacheKey{SSTID: t.id, BlockIdx: blockIdx}
+	if blk, ok := t.blockCache.Get(key); ok {
+		return blk, nil
 	}
 	blk, err := t.ReadBlock(blockIdx)
-	utils.Assertf(err == nil, "read block id: %d error: %s", blockIdx, err)
-	t.blockCache.Store(key, blk)
-	return blk
+	if err != nil {
+		return nil, err
+	}
+	t.blockCache.Insert(key, blk, int64(blk.Size()))
+	return blk, nil
 }
 
+// FindBlockIdx returns the index of the block which may contain internal key
 func (t *Table) FindBlockIdx(key []byte) uint32 {
 	satSub1 := func(a uint32) uint32 {
 		if a > 0 {
@@ -131,3 +284,41 @@ func (t *Table) Meta() []*block.Meta {
 func (t *Table) SSTID() uint32 {
 	return t.id
 }
+
+// FirstKey returns the smallest internal key in Table,
+// a range tombstone counts as the smallest internal key of its start.
+func (t *Table) FirstKey() []byte {
+	return t.firstKey
+}
+
+// LastKey returns the largest internal key in Table,
+// a range tombstone counts as the smallest internal key of its end, though the end is not deleted,
+// then LastKey is an exclusive bound, see EndsBefore.
+func (t *Table) LastKey() []byte {
+	return t.lastKey
+}
+
+// EndsBefore returns whether all internal keys in Table are less than key,
+// it's true for the smallest internal key of the end of a range tombstone which decides LastKey.
+func (t *Table) EndsBefore(key []byte) bool {
+	if t.lastKeyExclusive {
+		return bytes.Compare(t.lastKey, key) <= 0
+	}
+	return bytes.Compare(t.lastKey, key) < 0
+}
+
+// RangeTombstones returns range tombstones in Table, they are not applied by Iter,
+// readers should apply them to versions from all memtables and ssts.
+func (t *Table) RangeTombstones() mvcc.RangeTombstones {
+	return t.rangeTombstones
+}
+
+// MayContain returns false if user key is definitely not in Table
+func (t *Table) MayContain(key []byte) bool {
+	return t.bloom.MayContain(bloom.Hash(key))
+}
+
+// Size returns the size of sst file in bytes
+func (t *Table) Size() uint64 {
+	return t.size
+}
@@ -1,15 +1,22 @@
 package sst_test
 
 import (
+	"bytes"
+	"compress/flate"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
-	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"mini-lsm/pkg/block"
+	"mini-lsm/pkg/cache"
+	"mini-lsm/pkg/mvcc"
 	"mini-lsm/pkg/sst"
 	"mini-lsm/pkg/test"
 )
@@ -18,7 +25,7 @@ func TestBuildSSTSingleKey(t *testing.T) {
 	tb := sst.NewTableBuilder(16)
 	tb.Add("233", "233333")
 	tempdir := t.TempDir()
-	_, err := tb.Build(0, &sync.Map{}, filepath.Join(tempdir, "1.sst"))
+	_, err := tb.Build(0, nil, filepath.Join(tempdir, "1.sst"))
 	assert.Nil(t, err)
 }
 
@@ -32,7 +39,7 @@ func TestBuildSSTTowBlocks(t *testing.T) {
 	tb.Add("66", "66")
 	assert.Greater(t, tb.Len(), uint32(2))
 	tempdir := t.TempDir()
-	sstable, err := tb.Build(0, &sync.Map{}, filepath.Join(tempdir, "1.sst"))
+	sstable, err := tb.Build(0, nil, filepath.Join(tempdir, "1.sst"))
 	assert.Nil(t, err)
 	assert.NotNil(t, sstable)
 }
@@ -50,7 +57,7 @@ func TestSSTDecode(t *testing.T) {
 	assert.Nil(t, err)
 	fd, err := os.Open(fp)
 	assert.Nil(t, err)
-	nsstable, err := sst.OpenTableFromFile(0, &sync.Map{}, fd)
+	nsstable, err := sst.OpenTableFromFile(0, nil, fd)
 	assert.Nil(t, err)
 	assert.Equal(t, sstable.Meta(), nsstable.Meta())
 	assert.Nil(t, sstable.Close())
@@ -84,7 +91,7 @@ func TestSSTIterSeekToKey(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		rdInt, _ := rand.Int(rand.Reader, big.NewInt(64))
 		idx := rdInt.Uint64() % 1000
-		iter.SeekToKey(test.KeyOf(idx))
+		iter.Seek(test.KeyOf(idx))
 		key := iter.Key()
 		value := iter.Value()
 		assert.Equalf(t, test.KeyOf(idx), key, "expect key %s, actual key: %s", test.KeyOf(idx), key)
@@ -92,6 +99,416 @@ func TestSSTIterSeekToKey(t *testing.T) {
 	}
 }
 
+func TestSSTIterReverse(t *testing.T) {
+	pairs := test.NewKeyValuePair(1000)
+	sstable, _, err := test.GenerateSST(t.TempDir, pairs)
+	assert.Nil(t, err)
+	defer sstable.Close()
+	assert.Greater(t, sstable.Len(), uint32(1))
+	iter := sst.NewIterAndSeekToLast(sstable)
+	for i := len(pairs) - 1; i >= 0; i-- {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pairs[i].Key, iter.Key())
+		assert.Equal(t, pairs[i].Value, iter.Value())
+		iter.Prev()
+	}
+	assert.False(t, iter.IsValid())
+	assert.Nil(t, iter.Err())
+	for i := range pairs {
+		iter.SeekForPrev(pairs[i].Key)
+		assert.Equal(t, pairs[i].Key, iter.Key())
+		// a key between pairs[i] and pairs[i+1]
+		iter.SeekForPrev(append(pairs[i].Key, 0))
+		assert.Equal(t, pairs[i].Key, iter.Key())
+	}
+	iter.SeekForPrev([]byte("a"))
+	assert.False(t, iter.IsValid())
+	iter.SeekForPrev([]byte("z"))
+	assert.Equal(t, pairs[999].Key, iter.Key())
+
+	// ConcatIter moves across ssts in both directions
+	tables := make([]*sst.Table, 0)
+	for i := 0; i < len(pairs); i += 250 {
+		table, _, err := test.GenerateSST(t.TempDir, pairs[i:i+250])
+		assert.Nil(t, err)
+		defer table.Close()
+		tables = append(tables, table)
+	}
+	concat := sst.NewConcatIterAndSeekToFirst(tables)
+	concat.SeekToLast()
+	for i := len(pairs) - 1; i >= 0; i-- {
+		assert.True(t, concat.IsValid())
+		assert.Equal(t, pairs[i].Key, concat.Key())
+		concat.Prev()
+	}
+	assert.False(t, concat.IsValid())
+	concat.SeekForPrev(append(test.KeyOf(249), 0))
+	assert.Equal(t, test.KeyOf(249), concat.Key())
+	concat.Next()
+	assert.Equal(t, test.KeyOf(250), concat.Key())
+	concat.Prev()
+	assert.Equal(t, test.KeyOf(249), concat.Key())
+	concat.Seek(test.KeyOf(750))
+	concat.Prev()
+	assert.Equal(t, test.KeyOf(749), concat.Key())
+	concat.SeekForPrev([]byte("a"))
+	assert.False(t, concat.IsValid())
+	assert.Nil(t, concat.Err())
+}
+
+// corruptSST flips one byte at offset of the sst file and reopens it
+func corruptSST(t *testing.T, fp string, offset int64) (*sst.Table, error) {
+	fd, err := os.OpenFile(fp, os.O_RDWR, 0)
+	assert.Nil(t, err)
+	var b [1]byte
+	_, err = fd.ReadAt(b[:], offset)
+	assert.Nil(t, err)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b[:], offset)
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+	fd, err = os.Open(fp)
+	assert.Nil(t, err)
+	return sst.OpenTableFromFile(1, nil, fd)
+}
+
+func TestSSTBlockCorruption(t *testing.T) {
+	pairs := test.NewKeyValuePair(1000)
+	sstable, fp, err := test.GenerateSST(t.TempDir, pairs)
+	assert.Nil(t, err)
+	assert.Greater(t, sstable.Len(), uint32(2))
+	corruptOffset := int64(sstable.Meta()[1].Offset) + 10
+	keyInCorruptedBlock := sstable.Meta()[1].FirstKey
+	assert.Nil(t, sstable.Close())
+
+	corrupted, err := corruptSST(t, fp, corruptOffset)
+	assert.Nil(t, err)
+	defer corrupted.Close()
+	_, err = corrupted.ReadBlock(0)
+	assert.Nil(t, err)
+	_, err = corrupted.ReadBlock(1)
+	assert.True(t, errors.Is(err, sst.ErrCorruption))
+	var corruption *sst.CorruptionError
+	assert.True(t, errors.As(err, &corruption))
+	assert.Equal(t, uint32(1), corruption.SSTID)
+	assert.Equal(t, uint32(1), corruption.BlockIdx)
+
+	iter := sst.NewIterAndSeekToFirst(corrupted)
+	for iter.IsValid() {
+		iter.Next()
+	}
+	assert.True(t, errors.Is(iter.Err(), sst.ErrCorruption))
+	iter = sst.NewIterAndSeekToKey(corrupted, keyInCorruptedBlock)
+	assert.False(t, iter.IsValid())
+	assert.True(t, errors.Is(iter.Err(), sst.ErrCorruption))
+}
+
+func TestSSTMetaCorruption(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// offset returns the offset to corrupt by the footer: | meta offset | bloom offset | version | magic |
+		offset   func(metaOffset, bloomOffset uint32) int64
+		blockIdx uint32
+	}{
+		{"meta", func(metaOffset, _ uint32) int64 { return int64(metaOffset) + 5 }, sst.MetaBlockIdx},
+		{"bloom", func(_, bloomOffset uint32) int64 { return int64(bloomOffset) + 1 }, sst.BloomBlockIdx},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sstable, fp, err := test.GenerateSST(t.TempDir, test.NewKeyValuePair(1000))
+			assert.Nil(t, err)
+			assert.Nil(t, sstable.Close())
+			content, err := os.ReadFile(fp)
+			assert.Nil(t, err)
+			footer := content[len(content)-20:]
+
+			_, err = corruptSST(t, fp, c.offset(binary.BigEndian.Uint32(footer), binary.BigEndian.Uint32(footer[4:])))
+			assert.True(t, errors.Is(err, sst.ErrCorruption))
+			var corruption *sst.CorruptionError
+			assert.True(t, errors.As(err, &corruption))
+			assert.Equal(t, c.blockIdx, corruption.BlockIdx)
+		})
+	}
+}
+
+// internalKeyValuePairs returns pairs whose keys are internal keys of test.KeyOf(i) at seq i+1
+func internalKeyValuePairs(keyCount uint64) []test.Pair {
+	pairs := test.NewKeyValuePair(keyCount)
+	for i := range pairs {
+		pairs[i].Key = mvcc.MakeKey(pairs[i].Key, uint64(i)+1, mvcc.KindPut)
+	}
+	return pairs
+}
+
+func TestSSTBloomFilter(t *testing.T) {
+	pairs := internalKeyValuePairs(1000)
+	sstable, fp, err := test.GenerateSST(t.TempDir, pairs)
+	assert.Nil(t, err)
+	assert.Nil(t, sstable.Close())
+	fd, err := os.Open(fp)
+	assert.Nil(t, err)
+	sstable, err = sst.OpenTableFromFile(1, nil, fd)
+	assert.Nil(t, err)
+	defer sstable.Close()
+	for i := uint64(0); i < 1000; i++ {
+		assert.True(t, sstable.MayContain(test.KeyOf(i)))
+	}
+	mayContain := 0
+	for i := uint64(1000); i < 2000; i++ {
+		if sstable.MayContain(test.KeyOf(i)) {
+			mayContain++
+		}
+	}
+	assert.Less(t, mayContain, 50)
+
+	tb := sst.NewTableBuilderWithOptions(sst.TableBuilderOptions{BlockSize: test.GenerateBlockSize})
+	tb.AddByte(pairs[1].Key, pairs[1].Value)
+	noBloom, err := tb.Build(2, nil, filepath.Join(t.TempDir(), "2.sst"))
+	assert.Nil(t, err)
+	defer noBloom.Close()
+	assert.True(t, noBloom.MayContain(test.KeyOf(2)))
+}
+
+func TestSSTLegacyFormat(t *testing.T) {
+	pairs := test.NewKeyValuePair(100)
+	fp := filepath.Join(t.TempDir(), "1.sst")
+	assert.Nil(t, test.WriteLegacySST(fp, pairs))
+	fd, err := os.Open(fp)
+	assert.Nil(t, err)
+	sstable, err := sst.OpenTableFromFile(1, nil, fd)
+	assert.Nil(t, err)
+	defer sstable.Close()
+
+	// user keys are read as internal keys at seq 0
+	iter := sst.NewIterAndSeekToFirst(sstable)
+	for i := range pairs {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, mvcc.MakeKey(pairs[i].Key, 0, mvcc.KindPut), iter.Key())
+		assert.Equal(t, pairs[i].Value, iter.Value())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	assert.Nil(t, iter.Err())
+	iter.Seek(mvcc.SeekKey(test.KeyOf(42), mvcc.MaxSeq))
+	assert.Equal(t, test.ValueOf(42), iter.Value())
+	// the largest internal key of a user key is greater than its only version
+	iter.Seek(mvcc.MakeKey(test.KeyOf(42), 0, mvcc.KindDelete))
+	assert.Equal(t, test.ValueOf(43), iter.Value())
+	iter.Seek(mvcc.MakeKey(test.KeyOf(99), 0, mvcc.KindDelete))
+	assert.False(t, iter.IsValid())
+	assert.Equal(t, mvcc.MakeKey(pairs[0].Key, 0, mvcc.KindPut), sstable.FirstKey())
+	assert.True(t, sstable.MayContain(test.KeyOf(1000)))
+}
+
+func TestSSTUnsupportedFormat(t *testing.T) {
+	pairs := test.NewKeyValuePair(100)
+	blk, meta := test.EncodeLegacyBlock(pairs)
+	for _, content := range [][]byte{
+		// | block | checksum | block_metadata | checksum | metadata_offset |, written before bloom filters were added
+		binary.BigEndian.AppendUint32(append(test.AppendChecksum(blk), test.AppendChecksum(meta)...), uint32(len(blk)+4)),
+		// | block | block_metadata | metadata_offset |, written before checksums were added
+		binary.BigEndian.AppendUint32(append(append([]byte{}, blk...), meta...), uint32(len(blk))),
+	} {
+		fp := filepath.Join(t.TempDir(), "1.sst")
+		assert.Nil(t, os.WriteFile(fp, content, 0o644))
+		fd, err := os.Open(fp)
+		assert.Nil(t, err)
+		_, err = sst.OpenTableFromFile(1, nil, fd)
+		assert.ErrorIs(t, err, sst.ErrCorruption)
+		assert.ErrorIs(t, err, sst.ErrUnsupportedFormat)
+		fd.Close()
+	}
+}
+
+func TestSSTVersions(t *testing.T) {
+	// every key has versions at seq 3, 2 and 1, the oldest one is a deletion
+	tb := sst.NewTableBuilder(test.GenerateBlockSize)
+	for i := uint64(0); i < 100; i++ {
+		tb.AddByte(mvcc.MakeKey(test.KeyOf(i), 3, mvcc.KindPut), test.ValueOf(i+300))
+		tb.AddByte(mvcc.MakeKey(test.KeyOf(i), 2, mvcc.KindPut), test.ValueOf(i+200))
+		tb.AddByte(mvcc.MakeKey(test.KeyOf(i), 1, mvcc.KindDelete), nil)
+	}
+	sstable, err := tb.Build(1, nil, filepath.Join(t.TempDir(), "1.sst"))
+	assert.Nil(t, err)
+	defer sstable.Close()
+	assert.Greater(t, sstable.Len(), uint32(1))
+
+	for _, c := range []struct {
+		seq   uint64
+		value func(i uint64) []byte
+	}{
+		{mvcc.MaxSeq, func(i uint64) []byte { return test.ValueOf(i + 300) }},
+		{2, func(i uint64) []byte { return test.ValueOf(i + 200) }},
+		{1, func(uint64) []byte { return []byte{} }},
+	} {
+		for i := uint64(0); i < 100; i++ {
+			seekKey := mvcc.SeekKey(test.KeyOf(i), c.seq)
+			iter := sst.NewIterAndSeekToKey(sstable, seekKey)
+			assert.True(t, iter.IsValid())
+			assert.True(t, mvcc.SameUserKey(seekKey, iter.Key()))
+			assert.Equal(t, c.value(i), iter.Value())
+		}
+	}
+	iter := sst.NewIterAndSeekToKey(sstable, mvcc.SeekKey(test.KeyOf(0), 0))
+	assert.Equal(t, test.KeyOf(1), mvcc.UserKey(iter.Key()))
+}
+
+func TestSSTRangeTombstones(t *testing.T) {
+	dir := t.TempDir()
+	tombstones := mvcc.RangeTombstones{
+		{Start: test.KeyOf(50), End: test.KeyOf(150), Seq: 5},
+		{Start: test.KeyOf(0), End: test.KeyOf(10), Seq: 3},
+	}
+	tb := sst.NewTableBuilder(test.GenerateBlockSize)
+	for i := uint64(20); i < 100; i++ {
+		tb.AddByte(mvcc.MakeKey(test.KeyOf(i), 1, mvcc.KindPut), test.ValueOf(i))
+	}
+	for _, tombstone := range tombstones {
+		tb.AddRangeTombstone(tombstone)
+	}
+	built, err := tb.Build(1, nil, filepath.Join(dir, "1.sst"))
+	assert.Nil(t, err)
+	defer built.Close()
+
+	// tombstone only
+	tb = sst.NewTableBuilder(test.GenerateBlockSize)
+	assert.True(t, tb.IsEmpty())
+	tb.AddRangeTombstone(tombstones[0])
+	assert.False(t, tb.IsEmpty())
+	onlyTombstone, err := tb.Build(2, nil, filepath.Join(dir, "2.sst"))
+	assert.Nil(t, err)
+	defer onlyTombstone.Close()
+
+	for _, c := range []struct {
+		table      *sst.Table
+		tombstones mvcc.RangeTombstones
+		firstKey   []byte
+		lastKey    []byte
+	}{
+		{built, tombstones, mvcc.SeekKey(test.KeyOf(0), mvcc.MaxSeq), mvcc.SeekKey(test.KeyOf(150), mvcc.MaxSeq)},
+		{onlyTombstone, tombstones[:1], mvcc.SeekKey(test.KeyOf(50), mvcc.MaxSeq), mvcc.SeekKey(test.KeyOf(150), mvcc.MaxSeq)},
+	} {
+		fd, err := os.Open(filepath.Join(dir, fmt.Sprintf("%d.sst", c.table.SSTID())))
+		assert.Nil(t, err)
+		opened, err := sst.OpenTableFromFile(c.table.SSTID(), nil, fd)
+		assert.Nil(t, err)
+		for _, table := range []*sst.Table{c.table, opened} {
+			assert.Equal(t, c.tombstones, table.RangeTombstones())
+			assert.Equal(t, c.firstKey, table.FirstKey())
+			assert.Equal(t, c.lastKey, table.LastKey())
+			// the end of a range tombstone is not in table
+			assert.True(t, table.EndsBefore(c.lastKey))
+			assert.False(t, table.EndsBefore(mvcc.MakeKey(test.KeyOf(149), 0, mvcc.KindDelete)))
+		}
+		assert.Nil(t, opened.Close())
+	}
+	iter := sst.NewIterAndSeekToFirst(onlyTombstone)
+	assert.False(t, iter.IsValid())
+	assert.Nil(t, iter.Err())
+	iter = sst.NewIterAndSeekToKey(onlyTombstone, mvcc.SeekKey(test.KeyOf(60), mvcc.MaxSeq))
+	assert.False(t, iter.IsValid())
+	assert.Nil(t, iter.Err())
+}
+
+func TestSSTLargeEntry(t *testing.T) {
+	pairs := test.NewKeyValuePair(100)
+	// a large value in the middle and at the end of sst
+	pairs[50].Value = bytes.Repeat([]byte("v"), 100000)
+	pairs[99].Value = bytes.Repeat([]byte("v"), 200000)
+	sstable, fp, err := test.GenerateSST(t.TempDir, pairs)
+	assert.Nil(t, err)
+	assert.Nil(t, sstable.Close())
+	fd, err := os.Open(fp)
+	assert.Nil(t, err)
+	sstable, err = sst.OpenTableFromFile(1, nil, fd)
+	assert.Nil(t, err)
+	defer sstable.Close()
+
+	// large entries are in their own blocks
+	for _, idx := range []uint64{50, 99} {
+		blk, err := sstable.ReadBlock(sstable.FindBlockIdx(test.KeyOf(idx)))
+		assert.Nil(t, err)
+		iter := block.NewBlockIterAndSeekToFirst(blk)
+		assert.Equal(t, test.KeyOf(idx), iter.Key())
+		iter.Next()
+		assert.False(t, iter.IsValid())
+	}
+	iter := sst.NewIterAndSeekToFirst(sstable)
+	for i := range pairs {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pairs[i].Key, iter.Key())
+		assert.Equal(t, pairs[i].Value, iter.Value())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	assert.Nil(t, iter.Err())
+}
+
+func TestSSTCompression(t *testing.T) {
+	pairs := test.NewKeyValuePair(1000)
+	// an incompressible value is stored uncompressed
+	pairs[500].Value = make([]byte, 10000)
+	_, err := rand.Read(pairs[500].Value)
+	assert.Nil(t, err)
+	build := func(compressor block.Compressor) (*sst.Table, string) {
+		tb := sst.NewTableBuilderWithOptions(sst.TableBuilderOptions{BlockSize: test.GenerateBlockSize, Compressor: compressor})
+		for i := range pairs {
+			tb.AddByte(pairs[i].Key, pairs[i].Value)
+		}
+		fp := filepath.Join(t.TempDir(), "1.sst")
+		table, err := tb.Build(1, nil, fp)
+		assert.Nil(t, err)
+		return table, fp
+	}
+	uncompressed, _ := build(nil)
+	assert.Nil(t, uncompressed.Close())
+	compressed, fp := build(block.NewFlateCompressor(flate.BestCompression))
+	assert.Nil(t, compressed.Close())
+	assert.Less(t, compressed.Size()*2, uncompressed.Size())
+
+	fd, err := os.Open(fp)
+	assert.Nil(t, err)
+	sstable, err := sst.OpenTableFromFile(1, nil, fd)
+	assert.Nil(t, err)
+	defer sstable.Close()
+	iter := sst.NewIterAndSeekToFirst(sstable)
+	for i := range pairs {
+		assert.True(t, iter.IsValid())
+		assert.Equal(t, pairs[i].Key, iter.Key())
+		assert.Equal(t, pairs[i].Value, iter.Value())
+		iter.Next()
+	}
+	assert.False(t, iter.IsValid())
+	assert.Nil(t, iter.Err())
+}
+
+func TestSSTBlockCache(t *testing.T) {
+	blockCache := cache.New[sst.BlockCacheKey, *block.Block](1<<20, 4, sst.BlockCacheKey.Hash)
+	tb := sst.NewTableBuilder(test.GenerateBlockSize)
+	pairs := test.NewKeyValuePair(1000)
+	for i := range pairs {
+		tb.AddByte(pairs[i].Key, pairs[i].Value)
+	}
+	sstable, err := tb.Build(1, blockCache, filepath.Join(t.TempDir(), "1.sst"))
+	assert.Nil(t, err)
+
+	for round := 0; round < 2; round++ {
+		iter := sst.NewIterAndSeekToFirst(sstable)
+		for iter.IsValid() {
+			iter.Next()
+		}
+		assert.Nil(t, iter.Err())
+	}
+	stats := blockCache.Stats()
+	assert.Equal(t, uint64(sstable.Len()), stats.Misses)
+	assert.Equal(t, uint64(sstable.Len()), stats.Hits)
+	assert.Equal(t, int(sstable.Len()), stats.Count)
+
+	// blocks are invalidated after sst is closed
+	assert.Nil(t, sstable.Close())
+	assert.Equal(t, 0, blockCache.Stats().Count)
+	assert.Equal(t, int64(0), blockCache.Stats().Charge)
+}
+
 func BenchmarkSSTEncode(b *testing.B) {
 	pairs := test.NewKeyValuePair(1000)
 	b.ResetTimer()
@@ -107,7 +524,7 @@ func BenchmarkSSTDecode(b *testing.B) {
 	st.Close()
 	for i := 0; i < b.N; i++ {
 		fd, _ := os.Open(fp)
-		tb, _ := sst.OpenTableFromFile(0, &sync.Map{}, fd)
+		tb, _ := sst.OpenTableFromFile(0, nil, fd)
 		tb.Close()
 	}
 }
@@ -131,7 +548,7 @@ func BenchmarkSSTIterSeekToKeyExists(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		for j := uint64(0); j < 100; j++ {
 			iter.SeekToFirst()
-			iter.SeekToKey(test.KeyOf(j))
+			iter.Seek(test.KeyOf(j))
 		}
 	}
 	sstable.Close()
@@ -144,7 +561,7 @@ func BenchmarkSSTIterSeekToKeyNonExists(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		for j := uint64(0); j < 100; j++ {
 			iter.SeekToFirst()
-			iter.SeekToKey(test.KeyOf(j + 10086))
+			iter.Seek(test.KeyOf(j + 10086))
 		}
 	}
 	sstable.Close()
@@ -1,24 +1,19 @@
 package test
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"os"
 	"path/filepath"
-	"reflect"
-	"sync"
 	"unsafe"
 
 	"mini-lsm/pkg/sst"
 )
 
 func s2b(s string) []byte {
-	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh := reflect.SliceHeader{
-		Data: sh.Data,
-		Len:  sh.Len,
-		Cap:  sh.Len,
-	}
-	// // nolint:govet // unsafe for transfer string to []byte
-	return *(*[]byte)(unsafe.Pointer(&bh))
+	// unsafe for transfer string to []byte, the returned bytes must not be modified
+	return unsafe.Slice(unsafe.StringData(s), len(s))
 }
 
 func BigKeyOf(idx uint64) []byte {
@@ -63,6 +58,47 @@ func GenerateSST(tempdirFn func() string, keyValuePairs []Pair) (*sst.Table, str
 	}
 	tempdir := tempdirFn()
 	fp := filepath.Join(tempdir, "1.sst")
-	sstable, err := tb.Build(1, &sync.Map{}, fp)
+	sstable, err := tb.Build(1, nil, fp)
 	return sstable, fp, err
 }
+
+// EncodeLegacyBlock encodes pairs into one block and its block_metadata in format before format version was introduced:
+// block: | offsetLen | offsets | dataLen | data(keyLen | key | valueLen | value) |
+// block_metadata: | offset(4B) | firstKeyLen(2B) | firstKey | lastKeyLen(2B) | lastKey |
+func EncodeLegacyBlock(pairs []Pair) (blk, meta []byte) {
+	var data, offsets []byte
+	for _, pair := range pairs {
+		offsets = binary.BigEndian.AppendUint16(offsets, uint16(len(data)))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(pair.Key)))
+		data = append(data, pair.Key...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(pair.Value)))
+		data = append(data, pair.Value...)
+	}
+	blk = binary.BigEndian.AppendUint16(nil, uint16(len(pairs)))
+	blk = append(blk, offsets...)
+	blk = binary.BigEndian.AppendUint16(blk, uint16(len(data)))
+	blk = append(blk, data...)
+
+	meta = binary.BigEndian.AppendUint32(nil, 0)
+	meta = binary.BigEndian.AppendUint16(meta, uint16(len(pairs[0].Key)))
+	meta = append(meta, pairs[0].Key...)
+	meta = binary.BigEndian.AppendUint16(meta, uint16(len(pairs[len(pairs)-1].Key)))
+	meta = append(meta, pairs[len(pairs)-1].Key...)
+	return blk, meta
+}
+
+// AppendChecksum appends the crc32c trailer of data
+func AppendChecksum(data []byte) []byte {
+	return binary.BigEndian.AppendUint32(data, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// WriteLegacySST writes pairs of user keys into one block of an sst on path in format before format version was introduced:
+// sst: | block | checksum | block_metadata | checksum | bloom(empty) | checksum | metadata_offset | bloom_offset |
+func WriteLegacySST(path string, pairs []Pair) error {
+	blk, meta := EncodeLegacyBlock(pairs)
+	blk, meta = AppendChecksum(blk), AppendChecksum(meta)
+	content := append(append(blk, meta...), AppendChecksum(nil)...)
+	content = binary.BigEndian.AppendUint32(content, uint32(len(blk)))
+	content = binary.BigEndian.AppendUint32(content, uint32(len(blk)+len(meta)))
+	return os.WriteFile(path, content, 0o644)
+}
@@ -1,21 +1,25 @@
 package utils
 
 import (
-	"runtime/debug"
+	"fmt"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Assert panics with message if assert is false.
+// It's only for invariants broken by bugs, errors caused by input or disk should be returned.
 func Assert(assert bool, message string) {
 	if !assert {
-		debug.PrintStack()
-		logrus.Fatalln(message)
+		logrus.Errorln(message)
+		panic(message)
 	}
 }
 
+// Assertf is Assert with a formatted message
 func Assertf(assert bool, message string, params ...interface{}) {
 	if !assert {
-		debug.PrintStack()
-		logrus.Fatalf(message, params...)
+		message = fmt.Sprintf(message, params...)
+		logrus.Errorln(message)
+		panic(message)
 	}
 }
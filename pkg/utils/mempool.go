@@ -46,7 +46,8 @@ func floorLog2(length int) int {
 func (sp *slicePool) Get(length int) []byte {
 	index := ceilLog2(length) - sp.minLenExp
 	if index >= len(sp.pools) {
-		return nil
+		// too large to be pooled
+		return make([]byte, length)
 	}
 	if index < 0 {
 		index = 0
@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+const (
+	sizeOfUint32 = 4
+	// recordHeaderSize is keyLen + valueLen
+	recordHeaderSize = sizeOfUint32 * 2
+)
+
+var (
+	// ErrCorruption is returned by Recover if a record before the tail of the segment mismatches its checksum
+	ErrCorruption = errors.New("wal corruption")
+	// ErrRecordTooLarge is returned if key or value of a record is larger than 1<<32 - 1
+	ErrRecordTooLarge = errors.New("wal record is too large")
+)
+
+// Wal is a write-ahead log segment, every memtable owns one segment.
+// Wal writes every record in this layout following:
+// | keyLen(4B) | valueLen(4B) | key | value | checksum(4B) |
+// checksum is crc32 of all bytes before it in the record.
+// A record with an empty key holds an encoded batch in value(see PutBatch), keys of writes are never empty.
+type Wal struct {
+	mu sync.Mutex
+	fd *os.File
+	bw *bufio.Writer
+}
+
+// Create creates a new wal segment on path, the file should not exist
+func Create(path string) (*Wal, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Wal{fd: fd, bw: bufio.NewWriter(fd)}, nil
+}
+
+// Recover replays every complete record in the segment on path by calling fn,
+// then returns the Wal opened for appending.
+// A torn record at the tail (left by a crash in the middle of a write) is truncated,
+// an error matching ErrCorruption is returned if any record before it is broken.
+// Recover fails with the error returned by fn.
+func Recover(path string, fn func(key, value []byte) error) (*Wal, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	valid, err := replay(bufio.NewReader(fd), fi.Size(), fn)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if err = fd.Truncate(valid); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if _, err = fd.Seek(valid, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &Wal{fd: fd, bw: bufio.NewWriter(fd)}, nil
+}
+
+// replay reads records from r of size until EOF or a torn record at the tail,
+// returns the byte length of all valid records.
+// Lengths in a record header are checked against the remaining size before its body is read.
+func replay(r io.Reader, size int64, fn func(key, value []byte) error) (int64, error) {
+	var valid int64
+	var header [recordHeaderSize]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		keyLen := int64(binary.BigEndian.Uint32(header[:sizeOfUint32]))
+		valueLen := int64(binary.BigEndian.Uint32(header[sizeOfUint32:]))
+		recordSize := recordHeaderSize + keyLen + valueLen + sizeOfUint32
+		if valid+recordSize > size {
+			// the record was not completely written
+			return valid, nil
+		}
+		body := make([]byte, recordSize-recordHeaderSize)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return 0, err
+		}
+		checksumOffset := len(body) - sizeOfUint32
+		checksum := crc32.Update(crc32.ChecksumIEEE(header[:]), crc32.IEEETable, body[:checksumOffset])
+		if checksum != binary.BigEndian.Uint32(body[checksumOffset:]) {
+			if valid+recordSize == size {
+				// the last record may be partly written over preallocated bytes
+				return valid, nil
+			}
+			return 0, fmt.Errorf("%w: checksum mismatch of record at offset %d", ErrCorruption, valid)
+		}
+		if err = fn(body[:keyLen], body[keyLen:checksumOffset]); err != nil {
+			return 0, err
+		}
+		valid += recordSize
+	}
+}
+
+// Put appends a key-value record to the segment, an empty value stands for a deletion.
+// After Put returns the record has been handed to os, use Sync to make it durable on disk.
+func (w *Wal) Put(key, value []byte) error {
+	return w.writeRecord(key, value)
+}
+
+// PutBatch appends an encoded batch as one record, so the batch is either replayed entirely or not at all
+func (w *Wal) PutBatch(data []byte) error {
+	return w.writeRecord(nil, data)
+}
+
+func (w *Wal) writeRecord(key, value []byte) error {
+	if uint64(len(key)) > math.MaxUint32 || uint64(len(value)) > math.MaxUint32 {
+		return ErrRecordTooLarge
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var buf [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(buf[:sizeOfUint32], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[sizeOfUint32:], uint32(len(value)))
+	checksum := crc32.ChecksumIEEE(buf[:])
+	checksum = crc32.Update(checksum, crc32.IEEETable, key)
+	checksum = crc32.Update(checksum, crc32.IEEETable, value)
+
+	if _, err := w.bw.Write(buf[:]); err != nil {
+		return err
+	}
+	if _, err := w.bw.Write(key); err != nil {
+		return err
+	}
+	if _, err := w.bw.Write(value); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(buf[:sizeOfUint32], checksum)
+	if _, err := w.bw.Write(buf[:sizeOfUint32]); err != nil {
+		return err
+	}
+	return w.bw.Flush()
+}
+
+// Sync flushes the segment to disk
+func (w *Wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	return w.fd.Sync()
+}
+
+// Close flushes buffered records and closes the segment file
+func (w *Wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.bw.Flush(); err != nil {
+		w.fd.Close()
+		return err
+	}
+	return w.fd.Close()
+}
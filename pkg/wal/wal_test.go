@@ -0,0 +1,135 @@
+package wal_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"mini-lsm/pkg/test"
+	"mini-lsm/pkg/wal"
+)
+
+func replayAll(t *testing.T, path string) ([]test.Pair, *wal.Wal) {
+	var pairs []test.Pair
+	w, err := wal.Recover(path, func(key, value []byte) error {
+		pairs = append(pairs, test.Pair{Key: append([]byte{}, key...), Value: append([]byte{}, value...)})
+		return nil
+	})
+	assert.Nil(t, err)
+	return pairs, w
+}
+
+func TestWalRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := wal.Create(path)
+	assert.Nil(t, err)
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, w.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, w.Put(test.KeyOf(100), nil))
+	assert.Nil(t, w.Sync())
+	assert.Nil(t, w.Close())
+
+	pairs, w := replayAll(t, path)
+	defer w.Close()
+	assert.Len(t, pairs, 101)
+	for i := uint64(0); i < 100; i++ {
+		assert.Equal(t, test.KeyOf(i), pairs[i].Key)
+		assert.Equal(t, test.ValueOf(i), pairs[i].Value)
+	}
+	assert.Equal(t, test.KeyOf(100), pairs[100].Key)
+	assert.Empty(t, pairs[100].Value)
+}
+
+func TestWalRecoverTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := wal.Create(path)
+	assert.Nil(t, err)
+	for i := uint64(0); i < 10; i++ {
+		assert.Nil(t, w.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, w.Close())
+
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, fi.Size()-3))
+
+	pairs, w := replayAll(t, path)
+	assert.Len(t, pairs, 9)
+	// append after the torn record was dropped
+	assert.Nil(t, w.Put(test.KeyOf(9), test.ValueOf(9)))
+	assert.Nil(t, w.Close())
+
+	pairs, w = replayAll(t, path)
+	defer w.Close()
+	assert.Len(t, pairs, 10)
+	assert.Equal(t, test.ValueOf(9), pairs[9].Value)
+}
+
+func TestWalRecoverCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := wal.Create(path)
+	assert.Nil(t, err)
+	for i := uint64(0); i < 10; i++ {
+		assert.Nil(t, w.Put(test.KeyOf(i), test.ValueOf(i)))
+	}
+	assert.Nil(t, w.Close())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	recordSize := len(content) / 10
+
+	// a broken record before the tail is not a torn write
+	broken := append([]byte{}, content...)
+	broken[recordSize+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, broken, 0o644))
+	_, err = wal.Recover(path, func(key, value []byte) error { return nil })
+	assert.ErrorIs(t, err, wal.ErrCorruption)
+
+	// the last record is torn
+	broken = append([]byte{}, content...)
+	broken[len(broken)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, broken, 0o644))
+	pairs, w := replayAll(t, path)
+	assert.Len(t, pairs, 9)
+	assert.Nil(t, w.Close())
+
+	// lengths in the header of the last record are out of the file
+	broken = append([]byte{}, content[:9*recordSize]...)
+	broken = append(broken, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	assert.Nil(t, os.WriteFile(path, broken, 0o644))
+	pairs, w = replayAll(t, path)
+	defer w.Close()
+	assert.Len(t, pairs, 9)
+}
+
+func TestWalRecoverBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := wal.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Put(test.KeyOf(0), test.ValueOf(0)))
+	assert.Nil(t, w.PutBatch([]byte("batch")))
+	assert.Nil(t, w.Close())
+
+	pairs, w := replayAll(t, path)
+	defer w.Close()
+	assert.Len(t, pairs, 2)
+	assert.Empty(t, pairs[1].Key)
+	assert.Equal(t, []byte("batch"), pairs[1].Value)
+}
+
+func TestWalRecoverError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.wal")
+	w, err := wal.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Put(test.KeyOf(0), test.ValueOf(0)))
+	assert.Nil(t, w.Close())
+
+	expected := errors.New("replay error")
+	_, err = wal.Recover(path, func(key, value []byte) error {
+		return expected
+	})
+	assert.ErrorIs(t, err, expected)
+}